@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/accrual/accrualstub"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"go.uber.org/zap"
+)
+
+func main() {
+	if err := logger.Initialize(zap.InfoLevel.String()); err != nil {
+		log.Println("init logger error" + err.Error())
+		os.Exit(1)
+	}
+	var (
+		addr       string
+		rulesPath  string
+		accrual    float64
+		steps      int
+		limitEvery int
+		retryAfter int
+	)
+	flag.StringVar(&addr, "a", "localhost:8081", "address and port to run accrual stub")
+	flag.StringVar(&rulesPath, "c", "", "path to JSON file with stub rules")
+	flag.Float64Var(&accrual, "accrual", 500, "accrual for orders without explicit rule")
+	flag.IntVar(&steps, "steps", 2, "intermediate statuses before order is processed")
+	flag.IntVar(&limitEvery, "limit-every", 0, "answer 429 on every N-th request, 0 disables")
+	flag.IntVar(&retryAfter, "retry-after", 60, "Retry-After value in seconds for 429 responses")
+	flag.Parse()
+
+	cfg := accrualstub.Config{
+		Default: &accrualstub.Rule{Accrual: models.PointsFromFloat(accrual), Steps: steps},
+		RateLimit: accrualstub.RateLimit{
+			Every:             limitEvery,
+			RetryAfter:        retryAfter,
+			RequestsPerMinute: 60,
+		},
+	}
+	if rulesPath != "" {
+		fileCfg, err := accrualstub.LoadConfig(rulesPath)
+		if err != nil {
+			logger.Log.Error("Load stub rules error", zap.Error(err))
+			os.Exit(1)
+		}
+		cfg = fileCfg
+	}
+
+	logger.Log.Info("Run accrual stub on", zap.String("addr", addr))
+	if err := http.ListenAndServe(addr, logger.WithLog(accrualstub.NewHandler(cfg).ServeHTTP)); err != nil {
+		logger.Log.Error("Run accrual stub error", zap.Error(err))
+		os.Exit(1)
+	}
+}
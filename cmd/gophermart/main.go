@@ -6,8 +6,11 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/hasher"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
 	"github.com/Dorrrke/loyality-system.git/pkg/server"
 	"github.com/Dorrrke/loyality-system.git/pkg/storage"
 	"github.com/caarlos0/env/v6"
@@ -29,6 +32,18 @@ func main() {
 	flag.Var(&s.Config.HostConfig, "a", "address and port to run server")
 	flag.StringVar(&DBaddr, "d", "", "databse addr")
 	flag.Var(&s.Config.AccrualConfig, "r", "address and port accrual")
+	flag.StringVar(&s.Config.EnvValues.JWT.Secret, "jwt-secret", "", "secret for signing JWT")
+	flag.StringVar(&s.Config.EnvValues.JWT.Keys, "jwt-keys", "", "JWT keys in a form kid:secret,kid:secret")
+	flag.StringVar(&s.Config.EnvValues.JWT.ActiveKID, "jwt-kid", "", "id of JWT key used for signing")
+	flag.StringVar(&s.Config.EnvValues.JWT.KeysFile, "jwt-keys-file", "", "path to JSON file with JWT keys")
+	flag.StringVar(&s.Config.EnvValues.JWT.Issuer, "jwt-issuer", "", "JWT issuer")
+	flag.StringVar(&s.Config.EnvValues.JWT.Audience, "jwt-audience", "", "JWT audience")
+	flag.DurationVar(&s.Config.EnvValues.JWT.TTL, "jwt-ttl", 15*time.Minute, "access token lifetime")
+	flag.DurationVar(&s.Config.EnvValues.JWT.RefreshTTL, "jwt-refresh-ttl", 30*24*time.Hour, "refresh token lifetime")
+	flag.BoolVar(&s.Config.EnvValues.Cookie.Enabled, "auth-cookie", false, "return tokens in HttpOnly cookies")
+	flag.BoolVar(&s.Config.EnvValues.Cookie.Secure, "auth-cookie-secure", true, "set Secure attribute on auth cookies")
+	flag.StringVar(&s.Config.EnvValues.Cookie.SameSite, "auth-cookie-samesite", "lax", "SameSite mode of auth cookies: lax, strict or none")
+	flag.StringVar(&s.Config.EnvValues.Cookie.Domain, "auth-cookie-domain", "", "domain of auth cookies")
 
 	flag.Parse()
 	servErr := env.Parse(&s.Config.EnvValues.ServerCfg)
@@ -57,14 +72,77 @@ func main() {
 	if accrualErr == nil {
 		s.Config.AccrualConfig.Set(s.Config.EnvValues.AccrualCfg.AccrualAddr)
 	}
+	if err := env.Parse(&s.Config.EnvValues.AccrualWorkers); err != nil {
+		logger.Log.Error("env accrual workers err", zap.Error(err))
+	}
+	if err := env.Parse(&s.Config.EnvValues.JWT); err != nil {
+		logger.Log.Error("env jwt err", zap.Error(err))
+	}
+	jwtKeys, err := s.Config.EnvValues.JWT.LoadKeys()
+	if err != nil {
+		logger.Log.Error("Invalid JWT keys config", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := env.Parse(&s.Config.EnvValues.Cookie); err != nil {
+		logger.Log.Error("env cookie err", zap.Error(err))
+	}
+	if _, err := s.Config.EnvValues.Cookie.SameSiteMode(); err != nil {
+		logger.Log.Error("Invalid auth cookie config", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := env.Parse(&s.Config.EnvValues.Notifier); err != nil {
+		logger.Log.Error("env notifier err", zap.Error(err))
+	}
+	if kind := s.Config.EnvValues.Notifier.Kind; kind != "log" && (kind != "file" || s.Config.EnvValues.Notifier.File == "") {
+		logger.Log.Error("Invalid notifier config: NOTIFIER must be log or file, file requires NOTIFIER_FILE", zap.String("NOTIFIER", kind))
+		os.Exit(1)
+	}
+	if err := env.Parse(&s.Config.EnvValues.Password); err != nil {
+		logger.Log.Error("env password err", zap.Error(err))
+	}
+	if _, err := hasher.New(s.Config.EnvValues.Password.HasherParams()); err != nil {
+		logger.Log.Error("Invalid password hashing config", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := env.Parse(&s.Config.EnvValues.LoginLimit); err != nil {
+		logger.Log.Error("env login limit err", zap.Error(err))
+	}
+	if _, err := s.Config.EnvValues.LoginLimit.TrustedProxyNets(); err != nil {
+		logger.Log.Error("Invalid LOGIN_TRUSTED_PROXIES", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := env.Parse(&s.Config.EnvValues.Admin); err != nil {
+		logger.Log.Error("env admin err", zap.Error(err))
+	}
+	if err := env.Parse(&s.Config.EnvValues.TOTP); err != nil {
+		logger.Log.Error("env totp err", zap.Error(err))
+	}
+	if s.Config.EnvValues.TOTP.SecretKey == "" {
+		logger.Log.Warn("TOTP_SECRET_KEY is not set, TOTP secrets are stored unencrypted")
+	}
+	if err := env.Parse(&s.Config.EnvValues.Validation); err != nil {
+		logger.Log.Error("env validation err", zap.Error(err))
+	}
+	if _, err := s.Config.EnvValues.Validation.LoginRegexp(); err != nil {
+		logger.Log.Error("Invalid LOGIN_PATTERN", zap.Error(err))
+		os.Exit(1)
+	}
 	if s.Config.EnvValues.DataBaseDsn.DBDSN == "" && DBaddr == "" {
-		log.Println("Error init db")
-		log.Println("DB env str" + s.Config.EnvValues.DataBaseDsn.DBDSN)
-		log.Println("DB flag str" + DBaddr)
+		logger.Log.Warn("DATABASE_URI is not set, using in-memory storage; data will be lost on restart")
+		s.ConnStorage(storage.NewMemStorage())
+	}
+	// Случайный секрет допустим только для запуска в памяти: с базой токены одной реплики
+	// не принимались бы другими, а каждый перезапуск разлогинивал бы всех
+	if len(jwtKeys.Keys) == 0 && (s.Config.EnvValues.DataBaseDsn.DBDSN != "" || DBaddr != "") {
+		logger.Log.Error("JWT keys are not configured: set JWT_SECRET, JWT_KEYS or JWT_KEYS_FILE")
 		os.Exit(1)
 	}
 	if err := s.CreateTable(); err != nil {
 		logger.Log.Error("Error create tables", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := s.PromoteAdmins(); err != nil {
+		logger.Log.Error("Promote admins error", zap.Error(err))
 	}
 	// TODO: Решить проблему с миграцией; Вылетает ошибка no scheme
 	// logger.Log.Info("DB migration")
@@ -78,7 +156,7 @@ func main() {
 	// 	}
 	// }
 	s.New()
-	err := run(s)
+	err = run(&s)
 	if err != nil {
 		logger.Log.Error("Run server error", zap.Error(err))
 		log.Println("Panic run")
@@ -86,20 +164,58 @@ func main() {
 	}
 }
 
-func run(s server.Server) error {
+func run(s *server.Server) error {
 
 	r := chi.NewRouter()
 
 	r.Route("/api/user", func(r chi.Router) {
 		r.Post("/register", logger.WithLog(s.RegisterHandler))
 		r.Post("/login", logger.WithLog(s.LoginHandler))
-		r.Post("/orders", logger.WithLog(s.UploadOrderHandler))
-		r.Get("/orders", logger.WithLog(s.UnloadHandler))
-		r.Route("/balance", func(r chi.Router) {
-			r.Get("/", logger.WithLog(s.GetBalanceHandler))
-			r.Post("/withdraw", logger.WithLog(s.WriteOffBonusHandler))
+		r.Post("/login/2fa", logger.WithLog(s.LoginSecondFactorHandler))
+		r.Post("/token/refresh", logger.WithLog(s.RefreshTokenHandler))
+		r.Post("/password/reset", logger.WithLog(s.PasswordResetHandler))
+		r.Post("/password/reset/confirm", logger.WithLog(s.PasswordResetConfirmHandler))
+		r.With(s.WithAPIKey(models.ScopeOrdersWrite)).Post("/orders", logger.WithLog(s.WithIdempotency(s.UploadOrderHandler)))
+		r.Group(func(r chi.Router) {
+			r.Use(s.AuthMiddleware)
+			r.Post("/logout", logger.WithLog(s.LogoutHandler))
+			r.Get("/export", logger.WithLog(s.ExportHandler))
+			r.Delete("/", logger.WithLog(s.DeleteAccountHandler))
+			r.Post("/password", logger.WithLog(s.ChangePasswordHandler))
+			r.Route("/2fa", func(r chi.Router) {
+				r.Post("/enroll", logger.WithLog(s.TOTPEnrollHandler))
+				r.Post("/enable", logger.WithLog(s.TOTPEnableHandler))
+				r.Post("/disable", logger.WithLog(s.TOTPDisableHandler))
+			})
+			r.Get("/orders", logger.WithLog(s.UnloadHandler))
+			r.Get("/orders/{number}", logger.WithLog(s.GetOrderHandler))
+			r.Route("/balance", func(r chi.Router) {
+				r.Get("/", logger.WithLog(s.GetBalanceHandler))
+				r.Post("/withdraw", logger.WithLog(s.WithIdempotency(s.WriteOffBonusHandler)))
+				r.Get("/history", logger.WithLog(s.BalanceHistoryHandler))
+			})
+			r.Get("/withdrawals", logger.WithLog(s.WriteOffBalanceHistoryHandler))
+		})
+	})
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(s.AuthMiddleware, s.RequireRole(models.RoleAdmin))
+		r.Post("/login/unlock", logger.WithLog(s.UnlockLoginHandler))
+		r.Get("/users", logger.WithLog(s.ListUsersHandler))
+		r.Route("/api-keys", func(r chi.Router) {
+			r.Get("/", logger.WithLog(s.ListAPIKeysHandler))
+			r.Post("/", logger.WithLog(s.CreateAPIKeyHandler))
+			r.Delete("/{id}", logger.WithLog(s.RevokeAPIKeyHandler))
+		})
+		r.Route("/users/{id}", func(r chi.Router) {
+			r.Get("/orders", logger.WithLog(s.AdminUserOrdersHandler))
+			r.Get("/withdrawals", logger.WithLog(s.AdminUserWithdrawalsHandler))
+			r.Get("/balance", logger.WithLog(s.AdminUserBalanceHandler))
+			r.Post("/block", logger.WithLog(s.BlockUserHandler))
+			r.Post("/unblock", logger.WithLog(s.UnblockUserHandler))
+			r.Post("/2fa/disable", logger.WithLog(s.AdminDisableTOTPHandler))
+			r.Get("/adjustments", logger.WithLog(s.AdminUserAdjustmentsHandler))
+			r.Post("/adjustments", logger.WithLog(s.WithIdempotency(s.AdjustBalanceHandler)))
 		})
-		r.Get("/withdrawals", logger.WithLog(s.WriteOffBalanceHistoryHandler))
 	})
 	logger.Log.Info("Run server params:",
 		zap.String("flag -a:", s.Config.HostConfig.String()),
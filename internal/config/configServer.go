@@ -1,10 +1,17 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
+	"net"
+	"net/http"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/hasher"
 )
 
 const MigrationPath = "loyality-system/migrations"
@@ -18,6 +25,11 @@ type DataBaseConf struct {
 type AccrualAdrConf struct {
 	AccrualAddr string `env:"ACCRUAL_SYSTEM_ADDRESS,required"`
 }
+type AccrualWorkersConf struct {
+	Workers      int           `env:"ACCRUAL_WORKERS" envDefault:"4"`
+	PollInterval time.Duration `env:"ACCRUAL_POLL_INTERVAL" envDefault:"1s"`
+	MaxAttempts  int           `env:"ACCRUAL_MAX_ATTEMPTS" envDefault:"20"`
+}
 
 type ConfigServer struct {
 	Host string
@@ -119,7 +131,226 @@ type Config struct {
 }
 
 type ValueConfig struct {
-	ServerCfg   ServerAdrConfig
-	DataBaseDsn DataBaseConf
-	AccrualCfg  AccrualAdrConf
+	ServerCfg      ServerAdrConfig
+	DataBaseDsn    DataBaseConf
+	AccrualCfg     AccrualAdrConf
+	AccrualWorkers AccrualWorkersConf
+	JWT            JWTConf
+	Cookie         CookieConf
+	Notifier       NotifierConf
+	Password       PasswordConf
+	LoginLimit     LoginLimitConf
+	Admin          AdminConf
+	Validation     ValidationConf
+	TOTP           TOTPConf
+}
+
+// TOTPConf задает название сервиса в приложении-аутентификаторе, время, за которое
+// после пароля нужно ввести код второго фактора, и ключ шифрования секретов в базе.
+type TOTPConf struct {
+	Issuer       string        `env:"TOTP_ISSUER" envDefault:"Gophermart"`
+	ChallengeTTL time.Duration `env:"TOTP_CHALLENGE_TTL" envDefault:"5m"`
+	SecretKey    string        `env:"TOTP_SECRET_KEY"`
+}
+
+// ValidationConf задает правила для логина и пароля при регистрации и смене пароля.
+// Логин проверяется после нормализации (trim и нижний регистр). PasswordMinClasses -
+// сколько разных классов символов (строчные, заглавные, цифры, прочие) должно быть в пароле.
+type ValidationConf struct {
+	LoginMinLength     int    `env:"LOGIN_MIN_LENGTH" envDefault:"3"`
+	LoginMaxLength     int    `env:"LOGIN_MAX_LENGTH" envDefault:"64"`
+	LoginPattern       string `env:"LOGIN_PATTERN" envDefault:"^[a-z0-9._@-]+$"`
+	PasswordMinLength  int    `env:"PASSWORD_MIN_LENGTH" envDefault:"8"`
+	PasswordMaxLength  int    `env:"PASSWORD_MAX_LENGTH" envDefault:"72"`
+	PasswordMinClasses int    `env:"PASSWORD_MIN_CLASSES" envDefault:"2"`
+}
+
+const DefaultLoginPattern = "^[a-z0-9._@-]+$"
+
+func (c ValidationConf) LoginRegexp() (*regexp.Regexp, error) {
+	if c.LoginPattern == "" {
+		return regexp.Compile(DefaultLoginPattern)
+	}
+	return regexp.Compile(c.LoginPattern)
+}
+
+// LoginLimitConf задает блокировку входа после серии неудачных попыток: по логину после
+// MaxFailures ошибок и по IP после MaxIPFailures. Каждая следующая ошибка удваивает
+// блокировку, начиная с Lockout, но не больше MaxLockout. Счетчик сбрасывается,
+// если ошибок не было дольше Window. TrustedProxies - адреса или подсети (через запятую)
+// обратных прокси, которым можно верить в X-Forwarded-For.
+type LoginLimitConf struct {
+	MaxFailures    int           `env:"LOGIN_MAX_FAILURES" envDefault:"5"`
+	MaxIPFailures  int           `env:"LOGIN_MAX_IP_FAILURES" envDefault:"20"`
+	Lockout        time.Duration `env:"LOGIN_LOCKOUT" envDefault:"1m"`
+	MaxLockout     time.Duration `env:"LOGIN_MAX_LOCKOUT" envDefault:"1h"`
+	Window         time.Duration `env:"LOGIN_FAILURE_WINDOW" envDefault:"1h"`
+	TrustedProxies string        `env:"LOGIN_TRUSTED_PROXIES"`
+}
+
+func (c LoginLimitConf) TrustedProxyNets() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(c.TrustedProxies, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("invalid trusted proxy address " + strconv.Quote(item))
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// AdminConf перечисляет через запятую логины, которым выдается роль admin при старте
+// сервера. Логин должен быть уже зарегистрирован, при регистрации роль не выдается.
+type AdminConf struct {
+	Logins string `env:"ADMIN_LOGINS"`
+}
+
+func (c AdminConf) LoginList() []string {
+	var logins []string
+	for _, login := range strings.Split(c.Logins, ",") {
+		if login = strings.ToLower(strings.TrimSpace(login)); login != "" {
+			logins = append(logins, login)
+		}
+	}
+	return logins
+}
+
+// NotifierConf выбирает, куда отправлять уведомления пользователям: log или file.
+type NotifierConf struct {
+	Kind string `env:"NOTIFIER" envDefault:"log"`
+	File string `env:"NOTIFIER_FILE"`
+}
+
+// PasswordConf задает алгоритм хеширования паролей (bcrypt или argon2id) и его стоимость.
+// Хеши, полученные с другими настройками, пересчитываются при следующем входе пользователя.
+type PasswordConf struct {
+	ResetTTL      time.Duration `env:"PASSWORD_RESET_TTL" envDefault:"1h"`
+	HashAlgo      string        `env:"PASSWORD_HASH_ALGO" envDefault:"bcrypt"`
+	BcryptCost    int           `env:"PASSWORD_BCRYPT_COST" envDefault:"10"`
+	Argon2Time    uint32        `env:"PASSWORD_ARGON2_TIME" envDefault:"1"`
+	Argon2Memory  uint32        `env:"PASSWORD_ARGON2_MEMORY" envDefault:"65536"`
+	Argon2Threads uint8         `env:"PASSWORD_ARGON2_THREADS" envDefault:"4"`
+}
+
+func (c PasswordConf) HasherParams() hasher.Params {
+	return hasher.Params{
+		Algo:          c.HashAlgo,
+		BcryptCost:    c.BcryptCost,
+		Argon2Time:    c.Argon2Time,
+		Argon2Memory:  c.Argon2Memory,
+		Argon2Threads: c.Argon2Threads,
+	}
+}
+
+// CookieConf включает выдачу токенов в HttpOnly cookie. Запросы, авторизованные cookie,
+// изменяющие состояние, дополнительно проверяются по схеме double-submit (X-CSRF-Token).
+type CookieConf struct {
+	Enabled  bool   `env:"AUTH_COOKIE"`
+	Secure   bool   `env:"AUTH_COOKIE_SECURE"`
+	SameSite string `env:"AUTH_COOKIE_SAMESITE"`
+	Domain   string `env:"AUTH_COOKIE_DOMAIN"`
+}
+
+func (c CookieConf) SameSiteMode() (http.SameSite, error) {
+	switch strings.ToLower(c.SameSite) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		if !c.Secure {
+			return 0, errors.New("SameSite=None cookie requires Secure")
+		}
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, errors.New("unknown SameSite mode " + strconv.Quote(c.SameSite))
+}
+
+// JWTConf задаёт ключи подписи токенов. Ключи перечисляются парами kid:secret через запятую
+// в JWT_KEYS или JSON-файлом JWT_KEYS_FILE; подписывается активным ключом, проверяется любым
+// из перечисленных, что позволяет менять ключ без разлогина пользователей.
+type JWTConf struct {
+	Secret    string        `env:"JWT_SECRET"`
+	Keys      string        `env:"JWT_KEYS"`
+	ActiveKID string        `env:"JWT_ACTIVE_KID"`
+	KeysFile  string        `env:"JWT_KEYS_FILE"`
+	Issuer    string        `env:"JWT_ISSUER"`
+	Audience  string        `env:"JWT_AUDIENCE"`
+	TTL       time.Duration `env:"JWT_TTL"`
+	// RefreshTTL - время жизни сессии и refresh токена
+	RefreshTTL time.Duration `env:"JWT_REFRESH_TTL"`
+}
+
+const DefaultJWTKeyID = "default"
+
+type JWTKeys struct {
+	ActiveKID string
+	Keys      map[string][]byte
+}
+
+type jwtKeysFile struct {
+	ActiveKID string            `json:"active_kid"`
+	Keys      map[string]string `json:"keys"`
+}
+
+// LoadKeys собирает ключи из файла, списка или одиночного секрета - в этом порядке приоритета.
+// Пустой результат без ошибки означает, что ключи не настроены.
+func (c JWTConf) LoadKeys() (JWTKeys, error) {
+	keys := JWTKeys{ActiveKID: c.ActiveKID, Keys: make(map[string][]byte)}
+	switch {
+	case c.KeysFile != "":
+		data, err := os.ReadFile(c.KeysFile)
+		if err != nil {
+			return keys, err
+		}
+		var file jwtKeysFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return keys, err
+		}
+		for kid, secret := range file.Keys {
+			keys.Keys[kid] = []byte(secret)
+		}
+		if keys.ActiveKID == "" {
+			keys.ActiveKID = file.ActiveKID
+		}
+	case c.Keys != "":
+		for _, pair := range strings.Split(c.Keys, ",") {
+			kid, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || kid == "" || secret == "" {
+				return keys, errors.New("JWT keys must be in a form kid:secret,kid:secret")
+			}
+			keys.Keys[kid] = []byte(secret)
+			if keys.ActiveKID == "" {
+				keys.ActiveKID = kid
+			}
+		}
+	case c.Secret != "":
+		keys.Keys[DefaultJWTKeyID] = []byte(c.Secret)
+		if keys.ActiveKID == "" {
+			keys.ActiveKID = DefaultJWTKeyID
+		}
+	default:
+		return keys, nil
+	}
+	if _, ok := keys.Keys[keys.ActiveKID]; !ok {
+		return keys, errors.New("active JWT key id " + strconv.Quote(keys.ActiveKID) + " is not among configured keys")
+	}
+	return keys, nil
 }
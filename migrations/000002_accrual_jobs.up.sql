@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS accrual_jobs
+	(
+		id bigserial PRIMARY KEY,
+		order_number text NOT NULL,
+		uid integer NOT NULL,
+		attempts integer NOT NULL DEFAULT 0,
+		next_run_at timestamp with time zone NOT NULL DEFAULT now(),
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+
+CREATE UNIQUE INDEX IF NOT EXISTS accrual_jobs_order ON accrual_jobs (order_number);
+
+CREATE INDEX IF NOT EXISTS accrual_jobs_next_run ON accrual_jobs (next_run_at);
+
+INSERT INTO accrual_jobs (order_number, uid)
+	SELECT btrim(number), uid FROM orders WHERE status NOT IN ('INVALID', 'PROCESSED')
+	ON CONFLICT (order_number) DO NOTHING;
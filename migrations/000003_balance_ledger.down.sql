@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS balance_ledger;
+
+DROP FUNCTION IF EXISTS balance_ledger_immutable();
\ No newline at end of file
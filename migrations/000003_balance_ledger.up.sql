@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS balance_ledger
+	(
+		id bigserial PRIMARY KEY,
+		uid integer NOT NULL,
+		kind text NOT NULL,
+		amount numeric(5,2) NOT NULL,
+		"order" text,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+
+CREATE INDEX IF NOT EXISTS balance_ledger_uid ON balance_ledger (uid, created_at);
+
+CREATE OR REPLACE FUNCTION balance_ledger_immutable() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'balance_ledger entries are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS balance_ledger_no_update ON balance_ledger;
+
+CREATE TRIGGER balance_ledger_no_update BEFORE UPDATE ON balance_ledger
+	FOR EACH ROW EXECUTE FUNCTION balance_ledger_immutable();
+
+WITH legacy AS (
+	SELECT b.uid, b.current, coalesce((SELECT sum(w.sum) FROM withdrawals w WHERE w.uid = b.uid), 0) AS withdrawn
+	FROM user_balance b
+	WHERE NOT EXISTS (SELECT 1 FROM balance_ledger l WHERE l.uid = b.uid)
+)
+INSERT INTO balance_ledger (uid, kind, amount, "order", created_at)
+SELECT w.uid, 'withdrawal', -w.sum, btrim(w."order"), w.processed_at
+FROM withdrawals w JOIN legacy USING (uid)
+UNION ALL
+SELECT uid, 'adjustment', current + withdrawn, NULL, now()
+FROM legacy WHERE current + withdrawn <> 0;
+
+UPDATE user_balance b SET current = l.current, withdrawn = l.withdrawn
+FROM (
+	SELECT uid, sum(amount) AS current, coalesce(-sum(amount) FILTER (WHERE kind = 'withdrawal'), 0) AS withdrawn
+	FROM balance_ledger GROUP BY uid
+) l
+WHERE b.uid = l.uid;
@@ -0,0 +1,9 @@
+ALTER TABLE user_balance
+	ALTER COLUMN current TYPE numeric(5,2),
+	ALTER COLUMN withdrawn TYPE numeric(5,2);
+
+ALTER TABLE orders ALTER COLUMN accrual TYPE numeric(5,2);
+
+ALTER TABLE withdrawals ALTER COLUMN sum TYPE numeric(5,2);
+
+ALTER TABLE balance_ledger ALTER COLUMN amount TYPE numeric(5,2);
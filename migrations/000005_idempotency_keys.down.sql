@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS idempotency_keys;
+
+DROP INDEX IF EXISTS withdrawals_uid_order;
\ No newline at end of file
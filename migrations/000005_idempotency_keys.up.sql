@@ -0,0 +1,14 @@
+CREATE UNIQUE INDEX IF NOT EXISTS withdrawals_uid_order ON withdrawals (uid, "order");
+
+CREATE TABLE IF NOT EXISTS idempotency_keys
+	(
+		uid integer NOT NULL,
+		key text NOT NULL,
+		request_hash text NOT NULL,
+		status_code integer NOT NULL DEFAULT 0,
+		content_type text NOT NULL DEFAULT '',
+		body bytea,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		PRIMARY KEY (uid, key),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	);
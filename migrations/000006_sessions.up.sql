@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS sessions
+	(
+		id text PRIMARY KEY,
+		uid integer NOT NULL,
+		refresh_hash text NOT NULL,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		expires_at timestamp with time zone NOT NULL,
+		revoked_at timestamp with time zone,
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+
+CREATE INDEX IF NOT EXISTS sessions_uid ON sessions (uid);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS password_resets
+	(
+		token_hash text PRIMARY KEY,
+		uid integer NOT NULL,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		expires_at timestamp with time zone NOT NULL,
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	);
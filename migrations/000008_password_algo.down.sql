@@ -0,0 +1,4 @@
+-- хеши argon2id не помещаются в character(64), поэтому откат возможен только пока их нет
+ALTER TABLE users
+	DROP COLUMN IF EXISTS password_algo,
+	ALTER COLUMN password TYPE character(64);
@@ -0,0 +1,3 @@
+ALTER TABLE users
+	ALTER COLUMN password TYPE text USING rtrim(password),
+	ADD COLUMN IF NOT EXISTS password_algo text NOT NULL DEFAULT 'bcrypt';
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS login_attempts
+	(
+		scope text NOT NULL,
+		key text NOT NULL,
+		failures integer NOT NULL DEFAULT 0,
+		locked_until timestamp with time zone,
+		updated_at timestamp with time zone NOT NULL DEFAULT now(),
+		PRIMARY KEY (scope, key)
+	);
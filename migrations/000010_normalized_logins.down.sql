@@ -0,0 +1 @@
+ALTER TABLE users ALTER COLUMN login TYPE character(255);
\ No newline at end of file
@@ -0,0 +1,7 @@
+ALTER TABLE users ALTER COLUMN login TYPE text USING rtrim(login);
+
+-- записи, которые после нормализации совпали бы с другим пользователем, не трогаем
+UPDATE users SET login = lower(btrim(login))
+WHERE login <> lower(btrim(login)) AND NOT EXISTS (
+	SELECT 1 FROM users other WHERE other.uid <> users.uid AND lower(btrim(other.login)) = lower(btrim(users.login))
+);
@@ -0,0 +1,3 @@
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'user',
+	ADD COLUMN IF NOT EXISTS blocked boolean NOT NULL DEFAULT false;
@@ -0,0 +1,3 @@
+ALTER TABLE balance_ledger DROP COLUMN IF EXISTS adjustment_id;
+
+DROP TABLE IF EXISTS balance_adjustments;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS balance_adjustments
+	(
+		id bigserial PRIMARY KEY,
+		uid integer NOT NULL,
+		amount numeric(18,2) NOT NULL,
+		reason text NOT NULL,
+		comment text NOT NULL DEFAULT '',
+		operator_id integer NOT NULL,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE,
+		FOREIGN KEY (operator_id) REFERENCES users (uid) ON UPDATE CASCADE
+	);
+
+CREATE INDEX IF NOT EXISTS balance_adjustments_uid ON balance_adjustments (uid, created_at);
+
+ALTER TABLE balance_ledger
+	ADD COLUMN IF NOT EXISTS adjustment_id bigint REFERENCES balance_adjustments (id);
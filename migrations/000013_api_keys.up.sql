@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS api_keys
+	(
+		id text PRIMARY KEY,
+		name text NOT NULL,
+		key_hash text NOT NULL,
+		scopes text[] NOT NULL,
+		created_by integer NOT NULL,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		last_used_at timestamp with time zone,
+		revoked_at timestamp with time zone,
+		FOREIGN KEY (created_by) REFERENCES users (uid) ON UPDATE CASCADE
+	);
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS user_totp
+	(
+		uid integer PRIMARY KEY,
+		secret text NOT NULL,
+		enabled boolean NOT NULL DEFAULT false,
+		last_step bigint NOT NULL DEFAULT 0,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+
+CREATE TABLE IF NOT EXISTS totp_recovery_codes
+	(
+		uid integer NOT NULL,
+		code_hash text NOT NULL,
+		PRIMARY KEY (uid, code_hash),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+
+CREATE TABLE IF NOT EXISTS login_challenges
+	(
+		token_hash text PRIMARY KEY,
+		uid integer NOT NULL,
+		attempts integer NOT NULL DEFAULT 0,
+		expires_at timestamp with time zone NOT NULL,
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	);
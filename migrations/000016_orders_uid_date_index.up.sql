@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS orders_uid_date ON orders (uid, date, id);
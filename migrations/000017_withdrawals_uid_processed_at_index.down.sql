@@ -0,0 +1 @@
+DROP INDEX IF EXISTS withdrawals_uid_processed_at;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS withdrawals_uid_processed_at ON withdrawals (uid, processed_at, w_id);
@@ -0,0 +1 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone;
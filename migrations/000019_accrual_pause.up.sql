@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS accrual_pause
+	(
+		id boolean PRIMARY KEY DEFAULT true CHECK (id),
+		paused_until timestamp with time zone NOT NULL
+	);
@@ -0,0 +1,3 @@
+ALTER TABLE accrual_pause
+	DROP COLUMN IF EXISTS requests_per_minute,
+	DROP COLUMN IF EXISTS next_slot;
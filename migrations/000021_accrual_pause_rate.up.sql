@@ -0,0 +1,3 @@
+ALTER TABLE accrual_pause
+	ADD COLUMN IF NOT EXISTS requests_per_minute integer NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS next_slot timestamp with time zone;
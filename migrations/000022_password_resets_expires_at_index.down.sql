@@ -0,0 +1 @@
+DROP INDEX IF EXISTS password_resets_expires_at;
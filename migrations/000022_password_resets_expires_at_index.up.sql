@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS password_resets_expires_at ON password_resets (expires_at);
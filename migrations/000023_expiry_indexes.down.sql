@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS login_challenges_expires_at;
+DROP INDEX IF EXISTS sessions_expires_at;
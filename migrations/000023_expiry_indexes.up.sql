@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS sessions_expires_at ON sessions (expires_at);
+CREATE INDEX IF NOT EXISTS login_challenges_expires_at ON login_challenges (expires_at);
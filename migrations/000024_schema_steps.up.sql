@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS schema_steps
+	(
+		name text PRIMARY KEY,
+		applied_at timestamp with time zone NOT NULL DEFAULT now()
+	);
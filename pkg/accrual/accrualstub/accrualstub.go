@@ -0,0 +1,140 @@
+// Package accrualstub - поддельная система расчёта начислений для локальной разработки и тестов.
+package accrualstub
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+)
+
+// Rule описывает, как система расчёта отвечает по заказу.
+// Первые Steps ответов возвращают промежуточные статусы REGISTERED, затем PROCESSING,
+// после чего заказ переходит в конечный статус Status (по умолчанию PROCESSED) с начислением Accrual.
+type Rule struct {
+	Status  string        `json:"status"`
+	Accrual models.Points `json:"accrual"`
+	Steps   int           `json:"steps"`
+}
+
+// RateLimit включает ответы 429: каждый Every-й запрос получает отказ с Retry-After.
+type RateLimit struct {
+	Every             int `json:"every"`
+	RetryAfter        int `json:"retry_after"`
+	RequestsPerMinute int `json:"requests_per_minute"`
+}
+
+// Config - набор правил заглушки. Заказы, которых нет в Orders, получают Default,
+// а если он не задан - считаются незарегистрированными (204).
+type Config struct {
+	Orders    map[string]Rule `json:"orders"`
+	Default   *Rule           `json:"default"`
+	RateLimit RateLimit       `json:"rate_limit"`
+}
+
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, errors.Wrap(err, "Read stub config error")
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, errors.Wrap(err, "Parse stub config error")
+	}
+	return cfg, nil
+}
+
+// Handler реализует GET /api/orders/{number}, его можно отдать в httptest.NewServer.
+type Handler struct {
+	mu       sync.Mutex
+	cfg      Config
+	polls    map[string]int
+	requests int
+	router   chi.Router
+}
+
+func NewHandler(cfg Config) *Handler {
+	h := &Handler{
+		cfg:   cfg,
+		polls: make(map[string]int),
+	}
+	if h.cfg.Orders == nil {
+		h.cfg.Orders = make(map[string]Rule)
+	}
+	r := chi.NewRouter()
+	r.Get("/api/orders/{number}", h.getOrder)
+	h.router = r
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.router.ServeHTTP(w, r)
+}
+
+// SetOrder регистрирует заказ или меняет правило для него.
+func (h *Handler) SetOrder(number string, rule Rule) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cfg.Orders[number] = rule
+	delete(h.polls, number)
+}
+
+// Requests возвращает количество обработанных запросов, включая отклонённые с 429.
+func (h *Handler) Requests() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests
+}
+
+func (h *Handler) getOrder(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+
+	h.mu.Lock()
+	h.requests++
+	if limit := h.cfg.RateLimit; limit.Every > 0 && h.requests%limit.Every == 0 {
+		h.mu.Unlock()
+		w.Header().Set("Retry-After", strconv.Itoa(limit.RetryAfter))
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTooManyRequests)
+		if limit.RequestsPerMinute > 0 {
+			w.Write([]byte("No more than " + strconv.Itoa(limit.RequestsPerMinute) + " requests per minute allowed"))
+		}
+		return
+	}
+	rule, ok := h.cfg.Orders[number]
+	if !ok && h.cfg.Default != nil {
+		rule, ok = *h.cfg.Default, true
+	}
+	if !ok {
+		h.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	poll := h.polls[number]
+	h.polls[number] = poll + 1
+	h.mu.Unlock()
+
+	resp := models.AccrualModel{OrderNumber: number}
+	switch {
+	case poll < rule.Steps && poll == 0:
+		resp.Status = models.AccrualStatusRegistered
+	case poll < rule.Steps:
+		resp.Status = models.AccrualStatusProcessing
+	default:
+		resp.Status = rule.Status
+		if resp.Status == "" {
+			resp.Status = models.AccrualStatusProcessed
+		}
+		if resp.Status == models.AccrualStatusProcessed {
+			resp.Accrual = rule.Accrual
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,70 @@
+package accrualstub
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/accrual"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerTransitions(t *testing.T) {
+	h := NewHandler(Config{
+		Orders: map[string]Rule{
+			"12345678903": {Status: models.AccrualStatusProcessed, Accrual: 72998, Steps: 2},
+			"2377225624":  {Status: models.AccrualStatusInvalid},
+		},
+	})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	client := accrual.NewHTTPClient(srv.URL, srv.Client())
+	ctx := context.Background()
+
+	for _, want := range []string{
+		models.AccrualStatusRegistered,
+		models.AccrualStatusProcessing,
+		models.AccrualStatusProcessed,
+		models.AccrualStatusProcessed,
+	} {
+		order, err := client.GetOrder(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, want, order.Status)
+	}
+	order, err := client.GetOrder(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, "729.98", order.Accrual.String())
+
+	order, err = client.GetOrder(ctx, "2377225624")
+	require.NoError(t, err)
+	assert.Equal(t, models.AccrualStatusInvalid, order.Status)
+	assert.Zero(t, order.Accrual)
+
+	_, err = client.GetOrder(ctx, "79927398713")
+	assert.ErrorIs(t, err, accrual.ErrOrderNotRegistered)
+
+	h.SetOrder("79927398713", Rule{Accrual: 100 * models.Point})
+	order, err = client.GetOrder(ctx, "79927398713")
+	require.NoError(t, err)
+	assert.Equal(t, models.AccrualStatusProcessed, order.Status)
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	h := NewHandler(Config{
+		Default:   &Rule{Accrual: 10 * models.Point},
+		RateLimit: RateLimit{Every: 2, RetryAfter: 0, RequestsPerMinute: 600},
+	})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	client := accrual.NewHTTPClient(srv.URL, srv.Client())
+
+	_, err := client.GetOrder(context.Background(), "12345678903")
+	require.NoError(t, err)
+	_, err = client.GetOrder(context.Background(), "12345678903")
+	var rateErr *accrual.RateLimitError
+	require.ErrorAs(t, err, &rateErr)
+	assert.Equal(t, 600, rateErr.RequestsPerMinute)
+	assert.Equal(t, 2, h.Requests())
+}
@@ -0,0 +1,124 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrOrderNotRegistered = errors.New("order is not registered in accrual system")
+	ErrRateLimited        = errors.New("accrual system rate limit exceeded")
+	ErrServerError        = errors.New("accrual system internal error")
+)
+
+// AccrualClient получает из системы расчёта начислений статус заказа.
+type AccrualClient interface {
+	GetOrder(ctx context.Context, number string) (models.AccrualModel, error)
+}
+
+// RateLimitError возвращается при ответе 429, errors.Is(err, ErrRateLimited) для него истинно.
+type RateLimitError struct {
+	RetryAfter        time.Duration
+	RequestsPerMinute int
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrRateLimited, e.RetryAfter)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// HTTPClient ходит в систему расчёта начислений по HTTP через общий Limiter.
+type HTTPClient struct {
+	baseURL string
+	client  *http.Client
+	limiter *Limiter
+}
+
+func NewHTTPClient(baseURL string, client *http.Client) *HTTPClient {
+	if client == nil {
+		client = &http.Client{}
+	}
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	return &HTTPClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  client,
+		limiter: NewLimiter(),
+	}
+}
+
+func (c *HTTPClient) GetOrder(ctx context.Context, number string) (models.AccrualModel, error) {
+	var accrualModel models.AccrualModel
+	if err := c.limiter.Wait(ctx); err != nil {
+		return accrualModel, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/orders/"+url.PathEscape(number), nil)
+	if err != nil {
+		return accrualModel, errors.Wrap(err, "Create accrual request error")
+	}
+	response, err := c.client.Do(req)
+	if err != nil {
+		return accrualModel, errors.Wrap(err, "Accrual sys responce error")
+	}
+	defer response.Body.Close()
+
+	switch statusCode := response.StatusCode; {
+	case statusCode == http.StatusOK:
+		// Начисление читаем числом и округляем до сотых: с лишними знаками заказ иначе
+		// никогда не получил бы финальный статус
+		var body struct {
+			Order   string      `json:"order"`
+			Status  string      `json:"status"`
+			Accrual json.Number `json:"accrual"`
+		}
+		dec := json.NewDecoder(response.Body)
+		if err := dec.Decode(&body); err != nil {
+			return accrualModel, errors.Wrap(err, "Cannot parse accrual responce")
+		}
+		accrualModel.OrderNumber, accrualModel.Status = body.Order, body.Status
+		if body.Accrual != "" {
+			accrualModel.Accrual, err = models.RoundPoints(body.Accrual.String())
+			if err != nil {
+				return accrualModel, errors.Wrap(err, "Cannot parse accrual responce")
+			}
+		}
+		logger.Log.Info("Acrrual sys responce:",
+			zap.String("Order", accrualModel.OrderNumber),
+			zap.Stringer("Accrual", accrualModel.Accrual),
+			zap.String("Status", accrualModel.Status))
+		return accrualModel, nil
+	case statusCode == http.StatusNoContent:
+		return accrualModel, ErrOrderNotRegistered
+	case statusCode == http.StatusTooManyRequests:
+		body, _ := io.ReadAll(response.Body)
+		rateErr := &RateLimitError{
+			RetryAfter:        parseRetryAfter(response.Header.Get("Retry-After"), time.Now()),
+			RequestsPerMinute: parseRequestsPerMinute(string(body)),
+		}
+		logger.Log.Info("Accrual rate limit",
+			zap.Duration("RetryAfter", rateErr.RetryAfter),
+			zap.Int("RequestsPerMinute", rateErr.RequestsPerMinute))
+		c.limiter.Pause(time.Now().Add(rateErr.RetryAfter), rateErr.RequestsPerMinute)
+		return accrualModel, rateErr
+	case statusCode >= http.StatusInternalServerError:
+		return accrualModel, errors.Wrapf(ErrServerError, "status code %d", statusCode)
+	default:
+		return accrualModel, errors.Errorf("unexpected accrual status code %d", statusCode)
+	}
+}
@@ -0,0 +1,69 @@
+package accrual
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPClientGetOrder(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/orders/12345678903", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"order": "12345678903", "status": "PROCESSED", "accrual": 500}`))
+	})
+	mux.HandleFunc("/api/orders/4561261212345467", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"order": "4561261212345467", "status": "PROCESSED", "accrual": 12.345}`))
+	})
+	mux.HandleFunc("/api/orders/2377225624", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/api/orders/49927398716", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("No more than 60 requests per minute allowed"))
+	})
+	mux.HandleFunc("/api/orders/79927398713", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	client := NewHTTPClient(srv.URL, srv.Client())
+	ctx := context.Background()
+
+	order, err := client.GetOrder(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", order.Status)
+	assert.Equal(t, 500*models.Point, order.Accrual)
+
+	order, err = client.GetOrder(ctx, "4561261212345467")
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(1235), order.Accrual, "extra decimals are rounded to cents")
+
+	_, err = client.GetOrder(ctx, "2377225624")
+	assert.ErrorIs(t, err, ErrOrderNotRegistered)
+
+	_, err = client.GetOrder(ctx, "79927398713")
+	assert.ErrorIs(t, err, ErrServerError)
+
+	_, err = client.GetOrder(ctx, "49927398716")
+	assert.ErrorIs(t, err, ErrRateLimited)
+	var rateErr *RateLimitError
+	require.ErrorAs(t, err, &rateErr)
+	assert.Equal(t, time.Second, rateErr.RetryAfter)
+	assert.Equal(t, 60, rateErr.RequestsPerMinute)
+
+	// после 429 клиент ждёт окончания паузы перед следующим запросом
+	start := time.Now()
+	_, err = client.GetOrder(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
@@ -0,0 +1,105 @@
+package accrual
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRetryAfter = 60 * time.Second
+
+var rateLimitRe = regexp.MustCompile(`(?i)no more than (\d+) requests per minute`)
+
+// Limiter общий для всех воркеров ограничитель запросов к системе расчёта начислений.
+// После ответа 429 все воркеры ждут окончания паузы, а дальше идут не чаще разрешённой частоты.
+type Limiter struct {
+	mu          sync.Mutex
+	interval    time.Duration
+	next        time.Time
+	pausedUntil time.Time
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{}
+}
+
+// Wait блокирует до момента, когда можно отправить следующий запрос.
+func (l *Limiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		slot := now
+		if l.next.After(slot) {
+			slot = l.next
+		}
+		if l.pausedUntil.After(slot) {
+			slot = l.pausedUntil
+		}
+		if !slot.After(now) {
+			l.next = now.Add(l.interval)
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(slot))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Pause приостанавливает все запросы до until и, если известна, выставляет разрешённую частоту.
+func (l *Limiter) Pause(until time.Time, perMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	if perMinute > 0 {
+		l.interval = time.Minute / time.Duration(perMinute)
+	}
+}
+
+// PausedUntil возвращает момент окончания текущей паузы.
+func (l *Limiter) PausedUntil() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pausedUntil
+}
+
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return defaultRetryAfter
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
+func parseRequestsPerMinute(body string) int {
+	match := rateLimitRe.FindStringSubmatch(body)
+	if match == nil {
+		return 0
+	}
+	perMinute, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0
+	}
+	return perMinute
+}
@@ -0,0 +1,52 @@
+package accrual
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 11, 20, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{name: "seconds", header: "60", want: 60 * time.Second},
+		{name: "http date", header: "Mon, 20 Nov 2023 12:00:30 GMT", want: 30 * time.Second},
+		{name: "empty", header: "", want: defaultRetryAfter},
+		{name: "garbage", header: "soon", want: defaultRetryAfter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseRetryAfter(tt.header, now))
+		})
+	}
+}
+
+func TestParseRequestsPerMinute(t *testing.T) {
+	assert.Equal(t, 60, parseRequestsPerMinute("No more than 60 requests per minute allowed"))
+	assert.Equal(t, 0, parseRequestsPerMinute("Too Many Requests"))
+}
+
+func TestLimiterPause(t *testing.T) {
+	limiter := NewLimiter()
+	limiter.Pause(time.Now().Add(100*time.Millisecond), 600)
+
+	start := time.Now()
+	require.NoError(t, limiter.Wait(context.Background()))
+	require.NoError(t, limiter.Wait(context.Background()))
+	elapsed := time.Since(start)
+
+	// пауза 100мс плюс интервал 100мс между двумя запросами при 600 запросах в минуту
+	assert.GreaterOrEqual(t, elapsed, 200*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limiter.Pause(time.Now().Add(time.Hour), 0)
+	assert.ErrorIs(t, limiter.Wait(ctx), context.Canceled)
+}
@@ -0,0 +1,153 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgoBcrypt   = "bcrypt"
+	AlgoArgon2id = "argon2id"
+)
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var ErrUnknownAlgo = errors.New("unknown password hashing algorithm")
+
+// Params задают алгоритм и стоимость хеширования. Нулевые значения заменяются значениями по умолчанию.
+type Params struct {
+	Algo          string
+	BcryptCost    int
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+}
+
+// Hasher хеширует пароли выбранным алгоритмом и проверяет хеши любого из поддерживаемых.
+// Идентификатор алгоритма хранится рядом с хешем, поэтому смена настроек не ломает старые пароли.
+type Hasher struct {
+	params Params
+}
+
+func New(params Params) (*Hasher, error) {
+	if params.Algo == "" {
+		params.Algo = AlgoBcrypt
+	}
+	if params.BcryptCost == 0 {
+		params.BcryptCost = bcrypt.DefaultCost
+	}
+	if params.Argon2Time == 0 {
+		params.Argon2Time = 1
+	}
+	if params.Argon2Memory == 0 {
+		params.Argon2Memory = 64 * 1024
+	}
+	if params.Argon2Threads == 0 {
+		params.Argon2Threads = 4
+	}
+	switch params.Algo {
+	case AlgoBcrypt:
+		if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+			return nil, errors.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case AlgoArgon2id:
+	default:
+		return nil, errors.Wrap(ErrUnknownAlgo, params.Algo)
+	}
+	return &Hasher{params: params}, nil
+}
+
+// Hash возвращает хеш пароля и идентификатор алгоритма, которым он получен.
+func (h *Hasher) Hash(password string) (string, string, error) {
+	switch h.params.Algo {
+	case AlgoArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, h.params.Argon2Time, h.params.Argon2Memory, h.params.Argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			h.params.Argon2Memory, h.params.Argon2Time, h.params.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), AlgoArgon2id, nil
+	default:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.params.BcryptCost)
+		if err != nil {
+			return "", "", err
+		}
+		return string(hash), AlgoBcrypt, nil
+	}
+}
+
+// Verify проверяет пароль по хешу, полученному алгоритмом algo.
+func (h *Hasher) Verify(password string, hash string, algo string) (bool, error) {
+	switch algo {
+	case AlgoBcrypt, "":
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case AlgoArgon2id:
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+	return false, errors.Wrap(ErrUnknownAlgo, algo)
+}
+
+// NeedsRehash сообщает, что хеш получен не текущим алгоритмом или с другой стоимостью.
+func (h *Hasher) NeedsRehash(hash string, algo string) bool {
+	if algo == "" {
+		algo = AlgoBcrypt
+	}
+	if algo != h.params.Algo {
+		return true
+	}
+	switch algo {
+	case AlgoBcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.params.BcryptCost
+	case AlgoArgon2id:
+		params, _, _, err := decodeArgon2(hash)
+		return err != nil || params.Argon2Time != h.params.Argon2Time ||
+			params.Argon2Memory != h.params.Argon2Memory || params.Argon2Threads != h.params.Argon2Threads
+	}
+	return true
+}
+
+func decodeArgon2(hash string) (Params, []byte, []byte, error) {
+	var params Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != AlgoArgon2id {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads); err != nil {
+		return params, nil, nil, errors.Wrap(err, "invalid argon2id params")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errors.Wrap(err, "invalid argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, errors.Wrap(err, "invalid argon2id key")
+	}
+	return params, salt, key, nil
+}
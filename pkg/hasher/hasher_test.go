@@ -0,0 +1,62 @@
+package hasher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHasher(t *testing.T) {
+	tests := []struct {
+		name   string
+		params Params
+	}{
+		{name: "bcrypt", params: Params{Algo: AlgoBcrypt, BcryptCost: bcrypt.MinCost}},
+		{name: "argon2id", params: Params{Algo: AlgoArgon2id, Argon2Memory: 1024}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := New(tt.params)
+			require.NoError(t, err)
+			hash, algo, err := h.Hash("secretPass")
+			require.NoError(t, err)
+			assert.Equal(t, tt.params.Algo, algo)
+
+			ok, err := h.Verify("secretPass", hash, algo)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = h.Verify("otherPass", hash, algo)
+			require.NoError(t, err)
+			assert.False(t, ok)
+			assert.False(t, h.NeedsRehash(hash, algo))
+		})
+	}
+}
+
+func TestHasherNeedsRehash(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("secretPass"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	bcryptHasher, err := New(Params{Algo: AlgoBcrypt})
+	require.NoError(t, err)
+	assert.True(t, bcryptHasher.NeedsRehash(string(legacy), AlgoBcrypt), "cost changed")
+	ok, err := bcryptHasher.Verify("secretPass", string(legacy), AlgoBcrypt)
+	require.NoError(t, err)
+	assert.True(t, ok, "old hashes stay valid after config change")
+
+	argonHasher, err := New(Params{Algo: AlgoArgon2id, Argon2Memory: 1024})
+	require.NoError(t, err)
+	assert.True(t, argonHasher.NeedsRehash(string(legacy), AlgoBcrypt), "algorithm changed")
+	hash, algo, err := argonHasher.Hash("secretPass")
+	require.NoError(t, err)
+	stronger, err := New(Params{Algo: AlgoArgon2id, Argon2Memory: 2048})
+	require.NoError(t, err)
+	assert.True(t, stronger.NeedsRehash(hash, algo), "argon2 params changed")
+
+	_, err = New(Params{Algo: "md5"})
+	assert.ErrorIs(t, err, ErrUnknownAlgo)
+	_, err = argonHasher.Verify("secretPass", hash, "md5")
+	assert.ErrorIs(t, err, ErrUnknownAlgo)
+}
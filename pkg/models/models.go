@@ -1,26 +1,35 @@
 package models
 
+import "time"
+
 type Order struct {
-	Number     string  `json:"number"`
-	Status     string  `json:"status"`
-	Accrual    float32 `json:"accrual"`
-	UploadedAt string  `json:"uploaded_at"`
+	Number     string `json:"number"`
+	Status     string `json:"status"`
+	Accrual    Points `json:"accrual"`
+	UploadedAt string `json:"uploaded_at"`
+}
+
+// OrderDetails - заказ вместе со временем последней смены статуса и владельцем.
+type OrderDetails struct {
+	Order
+	UpdatedAt string `json:"updated_at"`
+	UserID    int    `json:"-"`
 }
 
 type Balance struct {
-	Current  float32 `json:"current"`
-	Withdraw float32 `json:"withdrawn"`
+	Current  Points `json:"current"`
+	Withdraw Points `json:"withdrawn"`
 }
 
 type WithdrawInfo struct {
-	Order       string  `json:"order"`
-	Sum         float32 `json:"sum"`
-	ProcessedAt string  `json:"processed_at"`
+	Order       string `json:"order"`
+	Sum         Points `json:"sum"`
+	ProcessedAt string `json:"processed_at"`
 }
 
 type Withdraw struct {
-	Order string  `json:"order"`
-	Sum   float32 `json:"sum"`
+	Order string `json:"order"`
+	Sum   Points `json:"sum"`
 }
 
 type AuthModel struct {
@@ -29,7 +38,314 @@ type AuthModel struct {
 }
 
 type AccrualModel struct {
-	OrderNumber string  `json:"order"`
-	Status      string  `json:"status"`
-	Accrual     float32 `json:"accrual"`
+	OrderNumber string `json:"order"`
+	Status      string `json:"status"`
+	Accrual     Points `json:"accrual"`
+}
+
+const (
+	OrderStatusNew        = "NEW"
+	OrderStatusProcessing = "PROCESSING"
+	OrderStatusInvalid    = "INVALID"
+	OrderStatusProcessed  = "PROCESSED"
+
+	AccrualStatusRegistered = "REGISTERED"
+	AccrualStatusProcessing = "PROCESSING"
+	AccrualStatusInvalid    = "INVALID"
+	AccrualStatusProcessed  = "PROCESSED"
+)
+
+type User struct {
+	ID           int
+	Login        string
+	PasswordHash string
+	PasswordAlgo string
+	Role         string
+	Blocked      bool
+	Deleted      bool
+}
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// UserInfo - пользователь в ответах административного API.
+type UserInfo struct {
+	ID      int    `json:"id"`
+	Login   string `json:"login"`
+	Role    string `json:"role"`
+	Blocked bool   `json:"blocked"`
+	Deleted bool   `json:"deleted"`
+}
+
+// UserProfile - данные пользователя в выгрузке.
+type UserProfile struct {
+	ID        int    `json:"id"`
+	Login     string `json:"login"`
+	Role      string `json:"role"`
+	TwoFactor bool   `json:"two_factor"`
+}
+
+// UserExport - выгрузка всех данных пользователя по его запросу.
+type UserExport struct {
+	Profile     UserProfile    `json:"profile"`
+	Balance     Balance        `json:"balance"`
+	Orders      []Order        `json:"orders"`
+	Withdrawals []WithdrawInfo `json:"withdrawals"`
+	History     []LedgerEntry  `json:"history"`
+	ExportedAt  string         `json:"exported_at"`
+}
+
+type AccountDeletion struct {
+	Password string `json:"password"`
+	Code     string `json:"code,omitempty"`
+}
+
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+}
+
+type PasswordResetConfirm struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors struct {
+	Errors []FieldError `json:"errors"`
+}
+
+type LoginUnlock struct {
+	Login string `json:"login"`
+	IP    string `json:"ip"`
+}
+
+// Session - сессия пользователя, к которой привязаны access и refresh токены.
+// В хранилище лежит только хеш refresh токена.
+type Session struct {
+	ID          string
+	UserID      int
+	RefreshHash string
+	ExpiresAt   time.Time
+	Revoked     bool
+}
+
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	CSRFToken    string `json:"csrf_token,omitempty"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// IdempotentResponse - сохранённый ответ на запрос с заголовком Idempotency-Key.
+// StatusCode равен нулю, пока первый запрос ещё обрабатывается.
+type IdempotentResponse struct {
+	RequestHash string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// PageCursor указывает на последнюю выданную запись: следующая страница начинается сразу после нее.
+type PageCursor struct {
+	Date time.Time
+	ID   int64
+}
+
+// OrderQuery - фильтры и страница списка заказов. Нулевые From и To означают отсутствие границы,
+// From включается в диапазон, To - нет. Нулевой Limit возвращает все заказы одной страницей.
+type OrderQuery struct {
+	Statuses []string
+	From     time.Time
+	To       time.Time
+	Desc     bool
+	Limit    int
+	After    *PageCursor
+}
+
+// OrderPage - страница заказов. Total - число заказов, подходящих под фильтры, на всех страницах;
+// Next пустой, если страница последняя.
+type OrderPage struct {
+	Orders []Order
+	Total  int
+	Next   *PageCursor
+}
+
+// WithdrawalQuery - диапазон processed_at и страница истории списаний, границы и Limit как в OrderQuery.
+type WithdrawalQuery struct {
+	From  time.Time
+	To    time.Time
+	Desc  bool
+	Limit int
+	After *PageCursor
+}
+
+// WithdrawalPage - страница списаний. Total и Sum считаются по всему диапазону, а не по странице.
+type WithdrawalPage struct {
+	Withdrawals []WithdrawInfo
+	Total       int
+	Sum         Points
+	Next        *PageCursor
+}
+
+func OrderStatusValid(status string) bool {
+	switch status {
+	case OrderStatusNew, OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed:
+		return true
+	}
+	return false
+}
+
+// AccrualJob - задача опроса системы расчёта начислений по одному заказу.
+type AccrualJob struct {
+	ID          int64
+	OrderNumber string
+	UserID      int
+	Attempts    int
+}
+
+const (
+	LedgerAccrual    = "accrual"
+	LedgerWithdrawal = "withdrawal"
+	LedgerAdjustment = "adjustment"
+)
+
+// LedgerEntry - неизменяемая проводка в журнале баллов пользователя.
+// Начисления и корректировки в плюс положительны, списания - отрицательны.
+// Reason заполняется только у ручных корректировок.
+type LedgerEntry struct {
+	Kind      string `json:"kind"`
+	Amount    Points `json:"amount"`
+	Order     string `json:"order,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// TOTP - настройка второго фактора пользователя. Пока Enabled не выставлен,
+// секрет только выдан и ждет подтверждения кодом.
+type TOTP struct {
+	UserID   int
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPCode struct {
+	Code string `json:"code"`
+}
+
+type TOTPDisable struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// LoginChallenge возвращается на вход по паролю, если у пользователя включен второй фактор.
+type LoginChallenge struct {
+	ChallengeToken string `json:"challenge_token"`
+	ExpiresIn      int    `json:"expires_in"`
+}
+
+type LoginSecondFactor struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+// Права API ключей.
+const (
+	ScopeOrdersWrite = "orders:write"
+)
+
+func APIKeyScopeValid(scope string) bool {
+	return scope == ScopeOrdersWrite
+}
+
+// APIKey - ключ внешней системы. Сам ключ не хранится, только хеш его секретной части.
+type APIKey struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	KeyHash    string   `json:"-"`
+	CreatedBy  int      `json:"created_by"`
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	Revoked    bool     `json:"revoked"`
+}
+
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// APIKeyCreated возвращается один раз при выпуске ключа, Key больше нигде не показывается.
+type APIKeyCreated struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// Коды причин ручной корректировки баланса.
+const (
+	AdjustmentAccrualError    = "accrual_error"
+	AdjustmentWithdrawalError = "withdrawal_error"
+	AdjustmentCompensation    = "compensation"
+	AdjustmentFraud           = "fraud"
+	AdjustmentOther           = "other"
+)
+
+func AdjustmentReasonValid(reason string) bool {
+	switch reason {
+	case AdjustmentAccrualError, AdjustmentWithdrawalError, AdjustmentCompensation, AdjustmentFraud, AdjustmentOther:
+		return true
+	}
+	return false
+}
+
+// AdjustmentRequest - запрос оператора на начисление (Amount > 0) или списание (Amount < 0) баллов.
+type AdjustmentRequest struct {
+	Amount  Points `json:"amount"`
+	Reason  string `json:"reason"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// BalanceAdjustment - ручная корректировка баланса, OperatorID - администратор, который ее провел.
+type BalanceAdjustment struct {
+	ID         int64  `json:"id"`
+	UserID     int    `json:"user_id"`
+	Amount     Points `json:"amount"`
+	Reason     string `json:"reason"`
+	Comment    string `json:"comment,omitempty"`
+	OperatorID int    `json:"operator_id"`
+	CreatedAt  string `json:"created_at"`
 }
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/pkg/errors"
+)
+
+// Points - количество баллов с фиксированной точностью до сотых.
+// Хранится целым числом сотых, поэтому суммы вроде 0.1+0.2 считаются точно.
+type Points int64
+
+// Point - один балл, удобно писать 500 * models.Point.
+const Point Points = 100
+
+const pointsExp = -2
+
+var ErrPointsPrecision = errors.New("points support at most two decimal places")
+
+// ParsePoints разбирает десятичную запись вида "729.98", "-10" или "1e3".
+func ParsePoints(s string) (Points, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return 0, errors.Errorf("invalid points value %q", s)
+	}
+	r.Mul(r, big.NewRat(int64(Point), 1))
+	if !r.IsInt() {
+		return 0, ErrPointsPrecision
+	}
+	if !r.Num().IsInt64() {
+		return 0, errors.Errorf("points value %q is out of range", s)
+	}
+	return Points(r.Num().Int64()), nil
+}
+
+// RoundPoints как ParsePoints, но лишние знаки округляет до сотых (половина - от нуля).
+// Нужен для ответов системы расчета: от них не отказаться, как от запроса пользователя.
+func RoundPoints(s string) (Points, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return 0, errors.Errorf("invalid points value %q", s)
+	}
+	r.Mul(r, big.NewRat(int64(Point), 1))
+	half := big.NewRat(1, 2)
+	if r.Sign() < 0 {
+		half.Neg(half)
+	}
+	r.Add(r, half)
+	n := new(big.Int).Quo(r.Num(), r.Denom())
+	if !n.IsInt64() {
+		return 0, errors.Errorf("points value %q is out of range", s)
+	}
+	return Points(n.Int64()), nil
+}
+
+// PointsFromFloat округляет значение до сотых, нужен только для флагов и конфигов.
+func PointsFromFloat(f float64) Points {
+	return Points(math.Round(f * float64(Point)))
+}
+
+func (p Points) String() string {
+	sign := ""
+	v := int64(p)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	whole, frac := v/int64(Point), v%int64(Point)
+	if frac == 0 {
+		return sign + strconv.FormatInt(whole, 10)
+	}
+	fracStr := strings.TrimRight(strconv.FormatInt(frac+int64(Point), 10)[1:], "0")
+	return sign + strconv.FormatInt(whole, 10) + "." + fracStr
+}
+
+func (p Points) MarshalJSON() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Points) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	s = strings.Trim(s, `"`)
+	v, err := ParsePoints(s)
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+// ScanNumeric позволяет pgx читать numeric без промежуточного float.
+func (p *Points) ScanNumeric(v pgtype.Numeric) error {
+	if !v.Valid {
+		*p = 0
+		return nil
+	}
+	if v.NaN || v.InfinityModifier != pgtype.Finite {
+		return errors.New("cannot scan NaN or infinity into Points")
+	}
+	n := new(big.Int).Set(v.Int)
+	exp := v.Exp - pointsExp
+	ten := big.NewInt(10)
+	if exp >= 0 {
+		n.Mul(n, new(big.Int).Exp(ten, big.NewInt(int64(exp)), nil))
+	} else {
+		var rem big.Int
+		n.QuoRem(n, new(big.Int).Exp(ten, big.NewInt(int64(-exp)), nil), &rem)
+		if rem.Sign() != 0 {
+			return ErrPointsPrecision
+		}
+	}
+	if !n.IsInt64() {
+		return errors.New("numeric value is out of Points range")
+	}
+	*p = Points(n.Int64())
+	return nil
+}
+
+func (p Points) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(int64(p)), Exp: pointsExp, Valid: true}, nil
+}
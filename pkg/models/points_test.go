@@ -0,0 +1,95 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePoints(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Points
+		wantErr bool
+	}{
+		{in: "729.98", want: 72998},
+		{in: "500", want: 500 * Point},
+		{in: "0.1", want: 10},
+		{in: "-10.5", want: -1050},
+		{in: "1e3", want: 1000 * Point},
+		{in: "1.230", want: 123},
+		{in: "0.001", wantErr: true},
+		{in: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePoints(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRoundPoints(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Points
+		wantErr bool
+	}{
+		{in: "729.98", want: 72998},
+		{in: "12.345", want: 1235},
+		{in: "12.344", want: 1234},
+		{in: "-0.005", want: -1},
+		{in: "0.001", want: 0},
+		{in: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := RoundPoints(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPointsJSON(t *testing.T) {
+	var w Withdraw
+	require.NoError(t, json.Unmarshal([]byte(`{"order": "2377225624", "sum": 0.1}`), &w))
+	sum := w.Sum + Points(20)
+	assert.Equal(t, "0.3", sum.String())
+
+	data, err := json.Marshal(Balance{Current: 50050, Withdraw: 42 * Point})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"current": 500.5, "withdrawn": 42}`, string(data))
+
+	big := Points(1_000_000_000_00)
+	data, err = json.Marshal(big)
+	require.NoError(t, err)
+	assert.Equal(t, "1000000000", string(data))
+}
+
+func TestPointsNumeric(t *testing.T) {
+	m := pgtype.NewMap()
+	for _, p := range []Points{0, 72998, -1050, 999999999999} {
+		buf, err := m.Encode(pgtype.NumericOID, pgtype.BinaryFormatCode, p, nil)
+		require.NoError(t, err)
+		var got Points
+		require.NoError(t, m.Scan(pgtype.NumericOID, pgtype.BinaryFormatCode, buf, &got))
+		assert.Equal(t, p, got)
+	}
+
+	var got Points
+	require.NoError(t, m.Scan(pgtype.NumericOID, pgtype.TextFormatCode, []byte("729.9800"), &got))
+	assert.Equal(t, Points(72998), got)
+}
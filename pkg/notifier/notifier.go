@@ -0,0 +1,67 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Message - уведомление пользователю, например со ссылкой на сброс пароля.
+type Message struct {
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// Notifier доставляет уведомления пользователям. Для локального запуска есть LogNotifier
+// и FileNotifier, в проде сюда подключается почта или SMS.
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
+
+// LogNotifier пишет уведомления в лог сервиса.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, msg Message) error {
+	logger.Log.Info("Notification", zap.String("to", msg.To), zap.String("subject", msg.Subject), zap.String("body", msg.Body))
+	return nil
+}
+
+// FileNotifier дописывает уведомления в файл, по одному JSON объекту на строку.
+type FileNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+func (n *FileNotifier) Notify(ctx context.Context, msg Message) error {
+	if msg.SentAt.IsZero() {
+		msg.SentAt = time.Now()
+	}
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	file, err := os.OpenFile(n.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "Open notifications file error")
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return errors.Wrap(err, "Write notification error")
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package notifier
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.jsonl")
+	n := NewFileNotifier(path)
+
+	require.NoError(t, n.Notify(context.Background(), Message{To: "first", Subject: "reset", Body: "token-1"}))
+	require.NoError(t, n.Notify(context.Background(), Message{To: "second", Subject: "reset", Body: "token-2"}))
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	var got []Message
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var msg Message
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &msg))
+		got = append(got, msg)
+	}
+	require.Len(t, got, 2)
+	assert.Equal(t, "first", got[0].To)
+	assert.Equal(t, "token-2", got[1].Body)
+	assert.False(t, got[1].SentAt.IsZero())
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ExportHandler отдает все данные пользователя одним JSON файлом.
+func (s *Server) ExportHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	export, err := s.exportUser(userID)
+	if err != nil {
+		logger.Log.Error("Export user error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	resp, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		logger.Log.Error("Encode export error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Content-Disposition", `attachment; filename="gophermart-export-`+strconv.Itoa(userID)+`.json"`)
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusOK)
+	res.Write(resp)
+}
+
+// DeleteAccountHandler удаляет аккаунт по паролю (и коду, если включен второй фактор).
+// Заказы и движения по счету остаются для учета, но больше не связаны с логином.
+func (s *Server) DeleteAccountHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	var body models.AccountDeletion
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Password == "" {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	user, err := s.getUserByID(userID)
+	if err != nil {
+		logger.Log.Error("Get user error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !s.matchPasswords(body.Password, user) {
+		http.Error(res, "Неверный пароль", http.StatusForbidden)
+		return
+	}
+	current, err := s.getTOTP(userID)
+	if err != nil && !errors.Is(err, errorsstorage.ErrTOTPNotExist) {
+		logger.Log.Error("Get totp error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if current.Enabled {
+		ok, err := s.checkSecondFactor(current, body.Code)
+		if err != nil {
+			logger.Log.Error("Check second factor error", zap.Error(err))
+			http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(res, "Неверный код", http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := s.clearLoginFailures(loginScopeLogin, user.Login); err != nil {
+		logger.Log.Error("Clear login failures error", zap.Error(err))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.storage.AnonymizeUser(ctx, userID); err != nil {
+		logger.Log.Error("Anonymize user error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	logger.Log.Info("Account deleted", zap.Int("uid", userID))
+	if s.cookieMode() {
+		s.clearAuthCookies(res)
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) exportUser(userID int) (models.UserExport, error) {
+	user, err := s.getUserByID(userID)
+	if err != nil {
+		return models.UserExport{}, err
+	}
+	current, err := s.getTOTP(userID)
+	if err != nil && !errors.Is(err, errorsstorage.ErrTOTPNotExist) {
+		return models.UserExport{}, err
+	}
+	export := models.UserExport{
+		Profile: models.UserProfile{
+			ID:        user.ID,
+			Login:     user.Login,
+			Role:      user.Role,
+			TwoFactor: current.Enabled,
+		},
+		Orders:      []models.Order{},
+		Withdrawals: []models.WithdrawInfo{},
+		History:     []models.LedgerEntry{},
+		ExportedAt:  time.Now().Format(time.RFC3339),
+	}
+	if export.Balance, err = s.getUserBalance(userID); err != nil {
+		return export, err
+	}
+	// пустые списки хранилище отдает ошибками, в выгрузке это просто пустые массивы
+	orders, err := s.getAllOrders(userID)
+	if err != nil && !errors.Is(err, errorsstorage.ErrOrdersNotExist) {
+		return export, err
+	}
+	if orders != nil {
+		export.Orders = orders
+	}
+	withdrawals, err := s.getWriteOffHistory(userID)
+	if err != nil && !errors.Is(err, errorsstorage.ErrWriteOffNotExist) {
+		return export, err
+	}
+	if withdrawals != nil {
+		export.Withdrawals = withdrawals
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	history, err := s.storage.GetLedger(ctx, userID)
+	if err != nil && !errors.Is(err, errorsstorage.ErrLedgerNotExist) {
+		return export, err
+	}
+	if history != nil {
+		export.History = history
+	}
+	return export, nil
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/accrual"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	accrualJobLease = time.Minute
+	// Запрос к системе расчета вместе с ожиданием лимитера должен закончиться задолго до
+	// истечения аренды, иначе задачу заберет другой воркер, пока эта еще выполняется
+	accrualRequestTimeout     = accrualJobLease / 2
+	accrualRetryBase          = time.Second
+	accrualRetryMax           = 5 * time.Minute
+	accrualDefaultMaxAttempts = 20
+)
+
+// runAccrualWorkers забирает задачи из очереди accrual_jobs и раздаёт их ограниченному пулу воркеров.
+func (s *Server) runAccrualWorkers(ctx context.Context) {
+	workers := s.Config.EnvValues.AccrualWorkers.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	pollInterval := s.Config.EnvValues.AccrualWorkers.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	jobs := make(chan models.AccrualJob)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(jobs)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				s.processAccrualJob(job)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		claimed, err := s.claimAccrualJobs(workers)
+		if err != nil {
+			logger.Log.Error("Claim accrual jobs error", zap.Error(err))
+		}
+		for _, job := range claimed {
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(claimed) == workers {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.accrualWake:
+		}
+	}
+}
+
+func (s *Server) wakeAccrualWorkers() {
+	select {
+	case s.accrualWake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) processAccrualJob(job models.AccrualJob) {
+	accrualModel, err := s.getFromAccrualSys(job.OrderNumber)
+	var rateErr *accrual.RateLimitError
+	if errors.As(err, &rateErr) {
+		// Превышение лимита - не вина заказа, попытку не засчитываем. Паузу и разрешенную частоту
+		// выставляем в базе, чтобы лимит соблюдали все реплики вместе
+		until := time.Now().Add(rateErr.RetryAfter)
+		s.pauseAccrualJobs(until, rateErr.RequestsPerMinute)
+		s.rescheduleAccrualJob(job, "", until)
+		return
+	}
+	job.Attempts++
+	if err != nil {
+		if errors.Is(err, accrual.ErrOrderNotRegistered) && job.Attempts >= s.accrualMaxAttempts() {
+			logger.Log.Info("Order is not registered in accrual system, giving up",
+				zap.String("Order", job.OrderNumber), zap.Int("Attempts", job.Attempts))
+			err = s.updateOrderAndBalance(models.AccrualModel{
+				OrderNumber: job.OrderNumber,
+				Status:      models.OrderStatusInvalid,
+			}, job.UserID)
+			if err == nil {
+				return
+			}
+		}
+		logger.Log.Error("Accrual job error", zap.String("Order", job.OrderNumber), zap.Error(err))
+		s.rescheduleAccrualJob(job, "", accrualRetryAt(job.Attempts))
+		return
+	}
+
+	accrualModel.OrderNumber = job.OrderNumber
+	switch accrualModel.Status {
+	case models.AccrualStatusProcessed, models.AccrualStatusInvalid:
+		if err := s.updateOrderAndBalance(accrualModel, job.UserID); err != nil {
+			logger.Log.Error("Accrual db update Error", zap.Error(err))
+			s.rescheduleAccrualJob(job, "", accrualRetryAt(job.Attempts))
+		}
+	default:
+		s.rescheduleAccrualJob(job, models.OrderStatusProcessing, accrualRetryAt(job.Attempts))
+	}
+}
+
+func (s *Server) accrualMaxAttempts() int {
+	if s.Config.EnvValues.AccrualWorkers.MaxAttempts <= 0 {
+		return accrualDefaultMaxAttempts
+	}
+	return s.Config.EnvValues.AccrualWorkers.MaxAttempts
+}
+
+func accrualRetryAt(attempts int) time.Time {
+	delay := accrualRetryBase
+	for i := 1; i < attempts && delay < accrualRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > accrualRetryMax {
+		delay = accrualRetryMax
+	}
+	return time.Now().Add(delay)
+}
+
+func (s *Server) getFromAccrualSys(orderNumber string) (models.AccrualModel, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), accrualRequestTimeout)
+	defer cancel()
+
+	accrualModel, err := s.accrual.GetOrder(ctx, orderNumber)
+	if err != nil {
+		return accrualModel, err
+	}
+	return accrualModel, nil
+}
+
+func (s *Server) claimAccrualJobs(limit int) ([]models.AccrualJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	jobs, err := s.storage.ClaimAccrualJobs(ctx, limit, accrualJobLease)
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *Server) rescheduleAccrualJob(job models.AccrualJob, orderStatus string, runAt time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := s.storage.RescheduleAccrualJob(ctx, job, orderStatus, runAt); err != nil {
+		logger.Log.Error("Reschedule accrual job error", zap.String("Order", job.OrderNumber), zap.Error(err))
+	}
+}
+
+func (s *Server) pauseAccrualJobs(until time.Time, perMinute int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := s.storage.PauseAccrualJobs(ctx, until, perMinute); err != nil {
+		logger.Log.Error("Pause accrual jobs error", zap.Error(err))
+	}
+}
+
+func (s *Server) updateOrderAndBalance(accrual models.AccrualModel, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	logger.Log.Debug("Update order by accrual", zap.String("Order", accrual.OrderNumber),
+		zap.String("Status", accrual.Status), zap.Int("UID", userID))
+
+	err := s.storage.UpdateByAccrual(ctx, accrual, userID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/accrual"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedAccrual отвечает по заказу заранее заданными ответами, последний повторяется.
+type scriptedAccrual struct {
+	mu        sync.Mutex
+	responses map[string][]scriptedResponse
+}
+
+type scriptedResponse struct {
+	model models.AccrualModel
+	err   error
+}
+
+func (a *scriptedAccrual) GetOrder(ctx context.Context, number string) (models.AccrualModel, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	queue := a.responses[number]
+	if len(queue) == 0 {
+		return models.AccrualModel{}, accrual.ErrOrderNotRegistered
+	}
+	resp := queue[0]
+	if len(queue) > 1 {
+		a.responses[number] = queue[1:]
+	}
+	return resp.model, resp.err
+}
+
+// newAccrualTestServer работает с отдельным хранилищем, чтобы не забирать задачи начисления других тестов.
+func newAccrualTestServer(t *testing.T, client accrual.AccrualClient) (*Server, int) {
+	var server Server
+	server.ConnStorage(storage.NewMemStorage())
+	server.ConnAccrual(client)
+	server.accrualWake = make(chan struct{}, 1)
+	server.Config.EnvValues.AccrualWorkers.MaxAttempts = 1
+
+	uid, err := server.storage.InsertUser(context.Background(), "accrual", "hash", "bcrypt")
+	require.NoError(t, err)
+	return &server, uid
+}
+
+func orderStatus(t *testing.T, server *Server, number string) string {
+	order, err := server.storage.GetOrder(context.Background(), number)
+	require.NoError(t, err)
+	return order.Status
+}
+
+func TestAccrualJobQueue(t *testing.T) {
+	processing := luhnNumber("880001")
+	unknown := luhnNumber("880002")
+	limited := luhnNumber("880003")
+	client := &scriptedAccrual{responses: map[string][]scriptedResponse{
+		processing: {{model: models.AccrualModel{Status: models.AccrualStatusProcessing}}},
+		limited: {
+			{err: &accrual.RateLimitError{}},
+			{model: models.AccrualModel{Status: models.AccrualStatusProcessed, Accrual: 7 * models.Point}},
+		},
+	}}
+	server, uid := newAccrualTestServer(t, client)
+
+	ctx := context.Background()
+	for _, number := range []string{processing, unknown, limited} {
+		require.NoError(t, server.storage.InsertOrder(ctx, uid, number))
+	}
+
+	jobs, err := server.claimAccrualJobs(10)
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+	again, err := server.claimAccrualJobs(10)
+	require.NoError(t, err)
+	assert.Empty(t, again, "claimed jobs are leased")
+
+	for _, job := range jobs {
+		server.processAccrualJob(job)
+	}
+	assert.Equal(t, models.OrderStatusProcessing, orderStatus(t, server, processing))
+	assert.Equal(t, models.OrderStatusInvalid, orderStatus(t, server, unknown), "unregistered order is final after max attempts")
+	assert.Equal(t, models.OrderStatusNew, orderStatus(t, server, limited))
+
+	// 429 возвращает задачу в очередь сразу и без потраченной попытки, PROCESSING ждет повтора
+	jobs, err = server.claimAccrualJobs(10)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, limited, jobs[0].OrderNumber)
+	assert.Equal(t, 0, jobs[0].Attempts)
+
+	server.processAccrualJob(jobs[0])
+	assert.Equal(t, models.OrderStatusProcessed, orderStatus(t, server, limited))
+	balance, err := server.getUserBalance(uid)
+	require.NoError(t, err)
+	assert.Equal(t, 7*models.Point, balance.Current)
+
+	jobs, err = server.claimAccrualJobs(10)
+	require.NoError(t, err)
+	assert.Empty(t, jobs, "final orders leave the queue")
+}
+
+func TestAccrualRateLimitPausesQueue(t *testing.T) {
+	limited := luhnNumber("882001")
+	other := luhnNumber("882002")
+	client := &scriptedAccrual{responses: map[string][]scriptedResponse{
+		limited: {{err: &accrual.RateLimitError{RetryAfter: time.Hour}}},
+	}}
+	server, uid := newAccrualTestServer(t, client)
+
+	ctx := context.Background()
+	require.NoError(t, server.storage.InsertOrder(ctx, uid, limited))
+	jobs, err := server.claimAccrualJobs(10)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	server.processAccrualJob(jobs[0])
+
+	require.NoError(t, server.storage.InsertOrder(ctx, uid, other))
+	jobs, err = server.claimAccrualJobs(10)
+	require.NoError(t, err)
+	assert.Empty(t, jobs, "new jobs wait for the pause as well")
+}
+
+func TestAccrualWorkerPool(t *testing.T) {
+	client := &scriptedAccrual{responses: map[string][]scriptedResponse{}}
+	var numbers []string
+	for i := 0; i < 5; i++ {
+		number := luhnNumber("88100" + strconv.Itoa(i))
+		numbers = append(numbers, number)
+		client.responses[number] = []scriptedResponse{
+			{model: models.AccrualModel{Status: models.AccrualStatusProcessed, Accrual: models.Point}},
+		}
+	}
+	server, uid := newAccrualTestServer(t, client)
+	server.Config.EnvValues.AccrualWorkers.Workers = 2
+	server.Config.EnvValues.AccrualWorkers.PollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.runAccrualWorkers(ctx)
+		close(done)
+	}()
+
+	for _, number := range numbers {
+		require.NoError(t, server.storage.InsertOrder(context.Background(), uid, number))
+		server.wakeAccrualWorkers()
+	}
+	require.Eventually(t, func() bool {
+		balance, err := server.getUserBalance(uid)
+		return err == nil && balance.Current == 5*models.Point
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, number := range numbers {
+		assert.Equal(t, models.OrderStatusProcessed, orderStatus(t, server, number))
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers did not stop after cancel")
+	}
+}
+
+func TestAccrualMaxAttemptsDefault(t *testing.T) {
+	var server Server
+	assert.Equal(t, accrualDefaultMaxAttempts, server.accrualMaxAttempts(), "unset limit must not give up after one answer")
+	server.Config.EnvValues.AccrualWorkers.MaxAttempts = 3
+	assert.Equal(t, 3, server.accrualMaxAttempts())
+	assert.Less(t, accrualRequestTimeout, accrualJobLease)
+}
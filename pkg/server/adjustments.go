@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const maxAdjustmentCommentLength = 500
+
+// AdjustBalanceHandler начисляет или списывает баллы пользователю вручную.
+// Оператором записывается администратор, выполнивший запрос.
+func (s *Server) AdjustBalanceHandler(res http.ResponseWriter, req *http.Request) {
+	operatorID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	user, ok := s.adminTarget(res, req)
+	if !ok {
+		return
+	}
+	// Баланс удаленного аккаунта больше некому использовать, корректировки на нем только путают учет
+	if user.Deleted {
+		http.Error(res, "Аккаунт удален", http.StatusConflict)
+		return
+	}
+	userID := user.ID
+
+	var adjustment models.AdjustmentRequest
+	if err := json.NewDecoder(req.Body).Decode(&adjustment); err != nil {
+		logger.Log.Error("Cannot parse req body", zap.Error(err))
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	adjustment.Comment = strings.TrimSpace(adjustment.Comment)
+	var errs []models.FieldError
+	if adjustment.Amount == 0 {
+		errs = append(errs, models.FieldError{Field: "amount", Message: "сумма корректировки не может быть нулевой"})
+	}
+	if !models.AdjustmentReasonValid(adjustment.Reason) {
+		errs = append(errs, models.FieldError{Field: "reason", Message: "неизвестный код причины"})
+	}
+	if adjustment.Reason == models.AdjustmentOther && adjustment.Comment == "" {
+		errs = append(errs, models.FieldError{Field: "comment", Message: "для причины other нужен комментарий"})
+	}
+	if utf8.RuneCountInString(adjustment.Comment) > maxAdjustmentCommentLength {
+		errs = append(errs, models.FieldError{Field: "comment", Message: "комментарий слишком длинный"})
+	}
+	if len(errs) != 0 {
+		writeValidationErrors(res, errs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	saved, err := s.storage.InsertBalanceAdjustment(ctx, models.BalanceAdjustment{
+		UserID:     userID,
+		Amount:     adjustment.Amount,
+		Reason:     adjustment.Reason,
+		Comment:    adjustment.Comment,
+		OperatorID: operatorID,
+	})
+	if err != nil {
+		if errors.Is(err, errorsstorage.ErrInsufficientFunds) {
+			http.Error(res, "Недостаточно средств", http.StatusPaymentRequired)
+			return
+		}
+		logger.Log.Error("Balance adjustment error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	logger.Log.Info("Balance adjusted",
+		zap.Int("uid", userID),
+		zap.Int("operator", operatorID),
+		zap.Stringer("amount", saved.Amount),
+		zap.String("reason", saved.Reason))
+	writeJSON(res, saved)
+}
+
+func (s *Server) AdminUserAdjustmentsHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := s.adminTargetUser(res, req)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	adjustments, err := s.storage.GetBalanceAdjustments(ctx, userID)
+	if err != nil {
+		logger.Log.Error("Get balance adjustments error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, adjustments)
+}
+
+// BalanceHistoryHandler отдает пользователю все движения по его счету: начисления,
+// списания и корректировки с кодом причины.
+func (s *Server) BalanceHistoryHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	entries, err := s.storage.GetLedger(ctx, userID)
+	if err != nil {
+		if errors.Is(err, errorsstorage.ErrLedgerNotExist) {
+			http.Error(res, "Нет данных для ответа", http.StatusNoContent)
+			return
+		}
+		logger.Log.Error("Get ledger error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, entries)
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultUsersLimit = 50
+	maxUsersLimit     = 500
+)
+
+// RequireRole пускает дальше только незаблокированных пользователей с ролью role.
+// Должен стоять после AuthMiddleware: роль читается из хранилища на каждый запрос,
+// поэтому снятие роли действует сразу, без перевыпуска токенов.
+func (s *Server) RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			userID, ok := UserIDFromContext(req.Context())
+			if !ok {
+				http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+				return
+			}
+			user, err := s.getUserByID(userID)
+			if err != nil {
+				if errors.Is(err, errorsstorage.ErrUserNotExists) {
+					http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+					return
+				}
+				logger.Log.Error("Get user role error", zap.Error(err))
+				http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+				return
+			}
+			if user.Blocked || user.Role != role {
+				http.Error(res, "Доступ запрещен", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(res, req)
+		})
+	}
+}
+
+func (s *Server) ListUsersHandler(res http.ResponseWriter, req *http.Request) {
+	limit, offset, ok := pageParams(req, defaultUsersLimit, maxUsersLimit)
+	if !ok {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	users, err := s.storage.ListUsers(ctx, limit, offset)
+	if err != nil {
+		logger.Log.Error("List users error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, users)
+}
+
+func (s *Server) AdminUserOrdersHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := s.adminTargetUser(res, req)
+	if !ok {
+		return
+	}
+	orders, err := s.getAllOrders(userID)
+	if err != nil {
+		if errors.Is(err, errorsstorage.ErrOrdersNotExist) {
+			http.Error(res, "Нет данных для ответа", http.StatusNoContent)
+			return
+		}
+		logger.Log.Error("Error when get order data from db", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, orders)
+}
+
+func (s *Server) AdminUserWithdrawalsHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := s.adminTargetUser(res, req)
+	if !ok {
+		return
+	}
+	history, err := s.getWriteOffHistory(userID)
+	if err != nil {
+		if errors.Is(err, errorsstorage.ErrWriteOffNotExist) {
+			http.Error(res, "нет ни одного списания", http.StatusNoContent)
+			return
+		}
+		logger.Log.Error("get history error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, history)
+}
+
+func (s *Server) AdminUserBalanceHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := s.adminTargetUser(res, req)
+	if !ok {
+		return
+	}
+	balance, err := s.getUserBalance(userID)
+	if err != nil {
+		logger.Log.Error("Get balance error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, balance)
+}
+
+func (s *Server) BlockUserHandler(res http.ResponseWriter, req *http.Request) {
+	s.setUserBlocked(res, req, true)
+}
+
+func (s *Server) UnblockUserHandler(res http.ResponseWriter, req *http.Request) {
+	s.setUserBlocked(res, req, false)
+}
+
+// setUserBlocked меняет признак блокировки; при блокировке все сессии пользователя
+// отзываются, так что выданные ему токены перестают действовать.
+func (s *Server) setUserBlocked(res http.ResponseWriter, req *http.Request, blocked bool) {
+	userID, ok := s.adminTargetUser(res, req)
+	if !ok {
+		return
+	}
+	if adminID, _ := UserIDFromContext(req.Context()); blocked && adminID == userID {
+		http.Error(res, "Нельзя заблокировать самого себя", http.StatusConflict)
+		return
+	}
+	if user, err := s.getUserByID(userID); err == nil && user.Deleted {
+		http.Error(res, "Аккаунт удален", http.StatusConflict)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.storage.SetUserBlocked(ctx, userID, blocked); err != nil {
+		logger.Log.Error("Set user blocked error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		if err := s.storage.RevokeUserSessions(ctx, userID, ""); err != nil {
+			logger.Log.Error("Revoke user sessions error", zap.Error(err))
+			http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+	}
+	logger.Log.Info("User block changed", zap.Int("uid", userID), zap.Bool("blocked", blocked))
+	res.WriteHeader(http.StatusOK)
+}
+
+// UnlockLoginHandler снимает блокировку входа по логину и/или IP.
+func (s *Server) UnlockLoginHandler(res http.ResponseWriter, req *http.Request) {
+	var unlock models.LoginUnlock
+	if err := json.NewDecoder(req.Body).Decode(&unlock); err != nil || (unlock.Login == "" && unlock.IP == "") {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	for scope, key := range map[string]string{loginScopeLogin: unlock.Login, loginScopeIP: unlock.IP} {
+		if key == "" {
+			continue
+		}
+		if err := s.clearLoginFailures(scope, key); err != nil {
+			logger.Log.Error("Unlock login error", zap.Error(err))
+			http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		logger.Log.Info("Login unlocked", zap.String("scope", scope), zap.String("key", key))
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+// PromoteAdmins выдает роль admin пользователям из ADMIN_LOGINS, которые уже зарегистрированы.
+// При регистрации роль не выдается: иначе незанятый логин из списка мог бы забрать кто угодно.
+func (s *Server) PromoteAdmins() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, login := range s.Config.EnvValues.Admin.LoginList() {
+		user, err := s.storage.GetUserByLogin(ctx, login)
+		if err != nil {
+			if errors.Is(err, errorsstorage.ErrUserNotExists) {
+				continue
+			}
+			return err
+		}
+		if user.Role == models.RoleAdmin {
+			continue
+		}
+		if err := s.storage.SetUserRole(ctx, user.ID, models.RoleAdmin); err != nil {
+			return err
+		}
+		logger.Log.Info("User promoted to admin", zap.String("login", login))
+	}
+	return nil
+}
+
+// adminTargetUser разбирает {id} из пути и проверяет, что такой пользователь есть.
+// При ошибке ответ уже записан.
+func (s *Server) adminTargetUser(res http.ResponseWriter, req *http.Request) (int, bool) {
+	user, ok := s.adminTarget(res, req)
+	return user.ID, ok
+}
+
+// adminTarget загружает пользователя из {id} в пути; при ошибке ответ уже записан.
+func (s *Server) adminTarget(res http.ResponseWriter, req *http.Request) (models.User, bool) {
+	userID, err := strconv.Atoi(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return models.User{ID: -1}, false
+	}
+	user, err := s.getUserByID(userID)
+	if err != nil {
+		if errors.Is(err, errorsstorage.ErrUserNotExists) {
+			http.Error(res, "Пользователь не найден", http.StatusNotFound)
+			return models.User{ID: -1}, false
+		}
+		logger.Log.Error("Get user error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return models.User{ID: -1}, false
+	}
+	return user, true
+}
+
+// pageParams читает limit и offset из query; отсутствующие значения заменяются умолчаниями.
+func pageParams(req *http.Request, defaultLimit int, maxLimit int) (int, int, bool) {
+	limit, offset := defaultLimit, 0
+	if v := req.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxLimit {
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if v := req.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
+
+func writeJSON(res http.ResponseWriter, v any) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		logger.Log.Error("Encode response error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(resp)
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	APIKeyHeader     = "X-API-Key"
+	APIKeyUserHeader = "X-User-ID"
+)
+
+// WithAPIKey пускает к эндпоинту внешние системы по ключу с правом scope: ключ передается
+// в заголовке X-API-Key вида <id>.<secret>, а пользователь, от имени которого выполняется
+// запрос, - в X-User-ID. Запросы без X-API-Key проходят обычную проверку AuthMiddleware.
+func (s *Server) WithAPIKey(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		auth := s.AuthMiddleware(next)
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			header := req.Header.Get(APIKeyHeader)
+			if header == "" {
+				auth.ServeHTTP(res, req)
+				return
+			}
+			key, err := s.checkAPIKey(header)
+			if err != nil {
+				if errors.Is(err, errorsstorage.ErrAPIKeyNotExist) {
+					http.Error(res, "Неверный API ключ", http.StatusUnauthorized)
+					return
+				}
+				logger.Log.Error("Check api key error", zap.Error(err))
+				http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+				return
+			}
+			if !key.HasScope(scope) {
+				http.Error(res, "Недостаточно прав API ключа", http.StatusForbidden)
+				return
+			}
+			userID, err := strconv.Atoi(req.Header.Get(APIKeyUserHeader))
+			if err != nil {
+				http.Error(res, "Не указан пользователь", http.StatusBadRequest)
+				return
+			}
+			user, err := s.getUserByID(userID)
+			if err != nil {
+				if errors.Is(err, errorsstorage.ErrUserNotExists) {
+					http.Error(res, "Пользователь не найден", http.StatusNotFound)
+					return
+				}
+				logger.Log.Error("Get user error", zap.Error(err))
+				http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+				return
+			}
+			if user.Blocked {
+				http.Error(res, "Аккаунт заблокирован", http.StatusForbidden)
+				return
+			}
+			logger.Log.Info("Request by api key", zap.String("key", key.ID), zap.Int("uid", userID))
+			next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), userIDKey, userID)))
+		})
+	}
+}
+
+func (s *Server) CreateAPIKeyHandler(res http.ResponseWriter, req *http.Request) {
+	operatorID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	var body models.APIKeyRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		logger.Log.Error("Cannot parse req body", zap.Error(err))
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	var errs []models.FieldError
+	if body.Name == "" {
+		errs = append(errs, models.FieldError{Field: "name", Message: "название ключа обязательно"})
+	}
+	if len(body.Scopes) == 0 {
+		errs = append(errs, models.FieldError{Field: "scopes", Message: "нужно указать хотя бы одно право"})
+	}
+	for _, scope := range body.Scopes {
+		if !models.APIKeyScopeValid(scope) {
+			errs = append(errs, models.FieldError{Field: "scopes", Message: "неизвестное право " + strconv.Quote(scope)})
+		}
+	}
+	if len(errs) != 0 {
+		writeValidationErrors(res, errs)
+		return
+	}
+
+	id, err := newAPIKeyID()
+	if err != nil {
+		logger.Log.Error("Generate api key error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	secret, err := newSecretToken()
+	if err != nil {
+		logger.Log.Error("Generate api key error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key, err := s.storage.CreateAPIKey(ctx, models.APIKey{
+		ID:        id,
+		Name:      body.Name,
+		Scopes:    body.Scopes,
+		KeyHash:   hashSecretToken(secret),
+		CreatedBy: operatorID,
+	})
+	if err != nil {
+		logger.Log.Error("Create api key error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	logger.Log.Info("API key created", zap.String("key", key.ID), zap.Int("operator", operatorID))
+	resp, err := json.Marshal(models.APIKeyCreated{APIKey: key, Key: id + "." + secret})
+	if err != nil {
+		logger.Log.Error("Encode api key error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusCreated)
+	res.Write(resp)
+}
+
+func (s *Server) ListAPIKeysHandler(res http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	keys, err := s.storage.ListAPIKeys(ctx)
+	if err != nil {
+		logger.Log.Error("List api keys error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, keys)
+}
+
+func (s *Server) RevokeAPIKeyHandler(res http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	id := chi.URLParam(req, "id")
+	if err := s.storage.RevokeAPIKey(ctx, id); err != nil {
+		if errors.Is(err, errorsstorage.ErrAPIKeyNotExist) {
+			http.Error(res, "API ключ не найден", http.StatusNotFound)
+			return
+		}
+		logger.Log.Error("Revoke api key error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	logger.Log.Info("API key revoked", zap.String("key", id))
+	res.WriteHeader(http.StatusOK)
+}
+
+// checkAPIKey проверяет ключ вида <id>.<secret> и отмечает время его использования.
+func (s *Server) checkAPIKey(header string) (models.APIKey, error) {
+	id, secret, ok := strings.Cut(header, ".")
+	if !ok || id == "" || secret == "" {
+		return models.APIKey{}, errorsstorage.ErrAPIKeyNotExist
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key, err := s.storage.GetAPIKey(ctx, id)
+	if err != nil {
+		return key, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecretToken(secret)), []byte(key.KeyHash)) != 1 {
+		return key, errorsstorage.ErrAPIKeyNotExist
+	}
+	if err := s.storage.TouchAPIKey(ctx, id, time.Now()); err != nil {
+		logger.Log.Error("Touch api key error", zap.Error(err))
+	}
+	return key, nil
+}
+
+func newAPIKeyID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return "gm" + hex.EncodeToString(id), nil
+}
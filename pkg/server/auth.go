@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// AuthCookieName - имя cookie, в которой клиент может передать access токен.
+const AuthCookieName = "access_token"
+
+type ctxKey int
+
+const (
+	userIDKey ctxKey = iota
+	sessionIDKey
+)
+
+var errUnauthorized = errors.New("user unauthorized")
+
+// AuthMiddleware проверяет access токен из заголовка Authorization (Bearer или без префикса)
+// или из cookie и кладет id пользователя и сессии в контекст запроса.
+func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		token, fromCookie := tokenFromRequest(req)
+		userID, sessionID, err := s.authenticate(token)
+		if err != nil {
+			if !errors.Is(err, errUnauthorized) {
+				logger.Log.Error("Authenticate error", zap.Error(err))
+				http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+				return
+			}
+			http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+			return
+		}
+		// cookie браузер отправит и с чужого сайта, поэтому изменяющие запросы
+		// по cookie должны нести CSRF токен
+		if fromCookie && !safeMethod(req.Method) && !csrfValid(req) {
+			http.Error(res, "Неверный CSRF токен", http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(req.Context(), userIDKey, userID)
+		ctx = context.WithValue(ctx, sessionIDKey, sessionID)
+		next.ServeHTTP(res, req.WithContext(ctx))
+	})
+}
+
+// UserIDFromContext возвращает id пользователя, положенный в контекст AuthMiddleware.
+func UserIDFromContext(ctx context.Context) (int, bool) {
+	userID, ok := ctx.Value(userIDKey).(int)
+	return userID, ok
+}
+
+func sessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := ctx.Value(sessionIDKey).(string)
+	return sessionID
+}
+
+// tokenFromRequest возвращает токен и признак того, что он взят из cookie.
+func tokenFromRequest(req *http.Request) (string, bool) {
+	if header := strings.TrimSpace(req.Header.Get("Authorization")); header != "" {
+		if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+			return strings.TrimSpace(header[len("Bearer "):]), false
+		}
+		return header, false
+	}
+	if cookie, err := req.Cookie(AuthCookieName); err == nil {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// authenticate возвращает id пользователя и сессии, если токен валиден и его сессия не отозвана.
+func (s *Server) authenticate(tokenString string) (int, string, error) {
+	if tokenString == "" {
+		return -1, "", errUnauthorized
+	}
+	claim, err := s.parseJWTToken(tokenString)
+	if err != nil {
+		return -1, "", errUnauthorized
+	}
+	userID, err := strconv.Atoi(claim.UserID)
+	if err != nil || claim.SessionID == "" {
+		// токены без сессии нельзя отозвать, поэтому не принимаем их
+		return -1, "", errUnauthorized
+	}
+	session, err := s.getSession(claim.SessionID)
+	if err != nil {
+		if errors.Is(err, errorsstorage.ErrSessionNotExist) {
+			return -1, "", errUnauthorized
+		}
+		return -1, "", err
+	}
+	if session.UserID != userID {
+		return -1, "", errUnauthorized
+	}
+	return userID, claim.SessionID, nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/Dorrrke/loyality-system.git/internal/config"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+
+	var server Server
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Post("/api/user/register", server.RegisterHandler)
+	r.With(server.AuthMiddleware).Get("/api/user/whoami", func(res http.ResponseWriter, req *http.Request) {
+		userID, ok := UserIDFromContext(req.Context())
+		require.True(t, ok)
+		res.Write([]byte(strconv.Itoa(userID)))
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	var tokens models.TokenPair
+	respRegister, err := resty.New().R().
+		SetBody(`{"login": "middleware", "password": "middlewarePass"}`).
+		SetResult(&tokens).
+		Post(srv.URL + "/api/user/register")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, respRegister.StatusCode())
+	claim, err := server.parseJWTToken(tokens.AccessToken)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		code   int
+	}{
+		{name: "Test auth #1 raw header", header: tokens.AccessToken, code: http.StatusOK},
+		{name: "Test auth #2 bearer header", header: "Bearer " + tokens.AccessToken, code: http.StatusOK},
+		{name: "Test auth #3 cookie", cookie: tokens.AccessToken, code: http.StatusOK},
+		{name: "Test auth #4 no token", code: http.StatusUnauthorized},
+		{name: "Test auth #5 broken token", header: "Bearer broken", code: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := resty.New().R()
+			if tt.header != "" {
+				req.SetHeader("Authorization", tt.header)
+			}
+			if tt.cookie != "" {
+				req.SetCookie(&http.Cookie{Name: AuthCookieName, Value: tt.cookie})
+			}
+			resp, err := req.Get(srv.URL + "/api/user/whoami")
+			require.NoError(t, err)
+			assert.Equal(t, tt.code, resp.StatusCode())
+			if tt.code == http.StatusOK {
+				assert.Equal(t, claim.UserID, resp.String())
+			}
+		})
+	}
+}
+
+func TestCookieAuthMode(t *testing.T) {
+
+	var server Server
+	server.Config.EnvValues.Cookie = config.CookieConf{Enabled: true, SameSite: "strict"}
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Route("/api/user", func(r chi.Router) {
+		r.Post("/register", server.RegisterHandler)
+		r.Post("/token/refresh", server.RefreshTokenHandler)
+		r.With(server.AuthMiddleware).Post("/logout", server.LogoutHandler)
+		r.With(server.AuthMiddleware).Get("/balance", server.GetBalanceHandler)
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// клиент хранит cookie между запросами, как браузер
+	client := resty.New()
+	var tokens models.TokenPair
+	respRegister, err := client.R().
+		SetBody(`{"login": "cookies", "password": "cookiesPass"}`).
+		SetResult(&tokens).
+		Post(srv.URL + "/api/user/register")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, respRegister.StatusCode())
+	assert.Empty(t, tokens.RefreshToken, "refresh token must be available only in HttpOnly cookie")
+	require.NotEmpty(t, tokens.CSRFToken)
+	cookies := map[string]*http.Cookie{}
+	for _, c := range respRegister.Cookies() {
+		cookies[c.Name] = c
+	}
+	require.Contains(t, cookies, AuthCookieName)
+	assert.True(t, cookies[AuthCookieName].HttpOnly)
+	assert.Equal(t, http.SameSiteStrictMode, cookies[AuthCookieName].SameSite)
+	assert.True(t, cookies[RefreshCookieName].HttpOnly)
+	assert.False(t, cookies[CSRFCookieName].HttpOnly)
+
+	resp, err := client.R().Get(srv.URL + "/api/user/balance")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	resp, err = client.R().Post(srv.URL + "/api/user/token/refresh")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode(), "refresh by cookie without CSRF token")
+
+	var refreshed models.TokenPair
+	resp, err = client.R().
+		SetHeader(CSRFHeader, tokens.CSRFToken).
+		SetResult(&refreshed).
+		Post(srv.URL + "/api/user/token/refresh")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.NotEqual(t, tokens.CSRFToken, refreshed.CSRFToken)
+
+	resp, err = client.R().
+		SetHeader(CSRFHeader, tokens.CSRFToken).
+		Post(srv.URL + "/api/user/logout")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode(), "logout with stale CSRF token")
+
+	resp, err = client.R().
+		SetHeader(CSRFHeader, refreshed.CSRFToken).
+		Post(srv.URL + "/api/user/logout")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	resp, err = client.R().Get(srv.URL + "/api/user/balance")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+}
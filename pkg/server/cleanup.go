@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage"
+	"go.uber.org/zap"
+)
+
+const cleanupInterval = time.Hour
+
+// runCleanup периодически удаляет из хранилища записи с истекшим сроком хранения.
+func (s *Server) runCleanup(ctx context.Context) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	for {
+		s.deleteExpired()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) deleteExpired() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := s.storage.DeleteExpiredIdempotencyKeys(ctx, time.Now().Add(-storage.IdempotencyKeyTTL)); err != nil {
+		logger.Log.Error("Delete expired idempotency keys error", zap.Error(err))
+	}
+	if err := s.storage.DeleteExpiredSessions(ctx); err != nil {
+		logger.Log.Error("Delete expired sessions error", zap.Error(err))
+	}
+	if err := s.storage.DeleteExpiredLoginChallenges(ctx); err != nil {
+		logger.Log.Error("Delete expired login challenges error", zap.Error(err))
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+)
+
+const (
+	// RefreshCookieName - cookie с refresh токеном, отправляется только на эндпоинт обновления токенов.
+	RefreshCookieName = "refresh_token"
+	// CSRFCookieName - cookie с CSRF токеном, доступная скрипту клиента.
+	CSRFCookieName = "csrf_token"
+	CSRFHeader     = "X-CSRF-Token"
+
+	refreshCookiePath = "/api/user/token"
+)
+
+func (s *Server) cookieMode() bool {
+	return s.Config.EnvValues.Cookie.Enabled
+}
+
+// setAuthCookies кладет токены в HttpOnly cookie и выдает новый CSRF токен.
+// Refresh токен в cookie режиме в тело ответа не попадает.
+func (s *Server) setAuthCookies(res http.ResponseWriter, tokens *models.TokenPair) error {
+	csrf := make([]byte, 32)
+	if _, err := rand.Read(csrf); err != nil {
+		return err
+	}
+	tokens.CSRFToken = base64.RawURLEncoding.EncodeToString(csrf)
+
+	http.SetCookie(res, s.authCookie(AuthCookieName, tokens.AccessToken, "/", int(s.jwtTTL().Seconds()), true))
+	http.SetCookie(res, s.authCookie(RefreshCookieName, tokens.RefreshToken, refreshCookiePath, int(s.refreshTTL().Seconds()), true))
+	http.SetCookie(res, s.authCookie(CSRFCookieName, tokens.CSRFToken, "/", int(s.refreshTTL().Seconds()), false))
+	tokens.RefreshToken = ""
+	return nil
+}
+
+func (s *Server) clearAuthCookies(res http.ResponseWriter) {
+	http.SetCookie(res, s.authCookie(AuthCookieName, "", "/", -1, true))
+	http.SetCookie(res, s.authCookie(RefreshCookieName, "", refreshCookiePath, -1, true))
+	http.SetCookie(res, s.authCookie(CSRFCookieName, "", "/", -1, false))
+}
+
+func (s *Server) authCookie(name string, value string, path string, maxAge int, httpOnly bool) *http.Cookie {
+	// режим проверен при старте, здесь ошибка невозможна
+	sameSite, _ := s.Config.EnvValues.Cookie.SameSiteMode()
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   s.Config.EnvValues.Cookie.Domain,
+		MaxAge:   maxAge,
+		Secure:   s.Config.EnvValues.Cookie.Secure,
+		HttpOnly: httpOnly,
+		SameSite: sameSite,
+	}
+}
+
+// csrfValid сверяет заголовок X-CSRF-Token с cookie csrf_token (double-submit).
+func csrfValid(req *http.Request) bool {
+	header := req.Header.Get(CSRFHeader)
+	cookie, err := req.Cookie(CSRFCookieName)
+	if header == "" || err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"go.uber.org/zap"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotencyReplayHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	maxIdempotentRequestBody = 1 << 20
+)
+
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(statusCode int) {
+	if r.status == 0 {
+		r.status = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// WithIdempotency сохраняет ответ на запрос с заголовком Idempotency-Key и на повтор
+// с тем же ключом отдаёт его же, не выполняя запрос второй раз.
+func (s *Server) WithIdempotency(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			h(res, req)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(res, "Слишком длинный Idempotency-Key", http.StatusBadRequest)
+			return
+		}
+		uid, ok := UserIDFromContext(req.Context())
+		if !ok {
+			// Без пользователя ключ не к кому привязать, обработчик сам ответит 401
+			h(res, req)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxIdempotentRequestBody+1))
+		if err != nil {
+			logger.Log.Error("Read from request error", zap.Error(err))
+			http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxIdempotentRequestBody {
+			http.Error(res, "Слишком большой запрос", http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		stored, reserved, err := s.reserveIdempotencyKey(uid, key, requestHash)
+		if err != nil {
+			logger.Log.Error("Reserve idempotency key error", zap.Error(err))
+			http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		if !reserved {
+			replayIdempotentResponse(res, stored, requestHash)
+			return
+		}
+
+		saved := false
+		defer func() {
+			// Запрос не выполнен, упал или ответ не сохранился: ключ освобождаем, иначе повторы
+			// с ним получали бы 409 до истечения срока хранения
+			p := recover()
+			if !saved {
+				if err := s.deleteIdempotencyKey(uid, key); err != nil {
+					logger.Log.Error("Delete idempotency key error", zap.Error(err))
+				}
+			}
+			if p != nil {
+				panic(p)
+			}
+		}()
+
+		rec := &idempotencyRecorder{ResponseWriter: res}
+		h(rec, req)
+
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			return
+		}
+		err = s.completeIdempotencyKey(uid, key, models.IdempotentResponse{
+			StatusCode:  rec.status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		})
+		if err != nil {
+			logger.Log.Error("Save idempotent response error", zap.Error(err))
+			return
+		}
+		saved = true
+	}
+}
+
+func replayIdempotentResponse(res http.ResponseWriter, stored models.IdempotentResponse, requestHash string) {
+	if stored.RequestHash != requestHash {
+		http.Error(res, "Idempotency-Key уже использован для другого запроса", http.StatusUnprocessableEntity)
+		return
+	}
+	if stored.StatusCode == 0 {
+		http.Error(res, "Запрос с этим Idempotency-Key ещё обрабатывается", http.StatusConflict)
+		return
+	}
+	if stored.ContentType != "" {
+		res.Header().Set("Content-Type", stored.ContentType)
+	}
+	res.Header().Set(idempotencyReplayHeader, "true")
+	res.WriteHeader(stored.StatusCode)
+	res.Write(stored.Body)
+}
+
+func (s *Server) reserveIdempotencyKey(uid int, key string, requestHash string) (models.IdempotentResponse, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.storage.ReserveIdempotencyKey(ctx, uid, key, requestHash)
+}
+
+func (s *Server) completeIdempotencyKey(uid int, key string, resp models.IdempotentResponse) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.storage.CompleteIdempotencyKey(ctx, uid, key, resp)
+}
+
+func (s *Server) deleteIdempotencyKey(uid int, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.storage.DeleteIdempotencyKey(ctx, uid, key)
+}
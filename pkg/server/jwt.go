@@ -0,0 +1,125 @@
+package server
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/config"
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultJWTTTL     = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+type Claims struct {
+	jwt.RegisteredClaims
+	UserID    string
+	SessionID string `json:"sid,omitempty"`
+}
+
+// jwtKeys загружает ключи подписи при первом обращении. Если ключи не настроены,
+// генерируется случайный секрет: токены не переживут перезапуск и не подойдут другим
+// репликам, поэтому с базой данных сервис без ключей не запускается.
+func (s *Server) jwtKeys() (config.JWTKeys, error) {
+	s.jwtOnce.Do(func() {
+		s.jwtKeyRing, s.jwtErr = s.Config.EnvValues.JWT.LoadKeys()
+		if s.jwtErr != nil || len(s.jwtKeyRing.Keys) != 0 {
+			return
+		}
+		logger.Log.Warn("JWT keys are not configured, using random secret; tokens will not survive restart and are not accepted by other instances")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			s.jwtErr = err
+			return
+		}
+		s.jwtKeyRing = config.JWTKeys{
+			ActiveKID: config.DefaultJWTKeyID,
+			Keys:      map[string][]byte{config.DefaultJWTKeyID: secret},
+		}
+	})
+	return s.jwtKeyRing, s.jwtErr
+}
+
+func (s *Server) jwtTTL() time.Duration {
+	if s.Config.EnvValues.JWT.TTL > 0 {
+		return s.Config.EnvValues.JWT.TTL
+	}
+	return defaultJWTTTL
+}
+
+func (s *Server) refreshTTL() time.Duration {
+	if s.Config.EnvValues.JWT.RefreshTTL > 0 {
+		return s.Config.EnvValues.JWT.RefreshTTL
+	}
+	return defaultRefreshTTL
+}
+
+func (s *Server) createJWTToken(uuid string, sessionID string) (string, error) {
+	keys, err := s.jwtKeys()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.Config.EnvValues.JWT.Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.jwtTTL())),
+		},
+		UserID:    uuid,
+		SessionID: sessionID,
+	}
+	if aud := s.Config.EnvValues.JWT.Audience; aud != "" {
+		claims.Audience = jwt.ClaimStrings{aud}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = keys.ActiveKID
+
+	tokenString, err := token.SignedString(keys.Keys[keys.ActiveKID])
+	if err != nil {
+		return "", err
+	}
+	return tokenString, nil
+}
+
+// parseJWTToken проверяет подпись и стандартные поля токена, не обращаясь к хранилищу.
+func (s *Server) parseJWTToken(tokenString string) (*Claims, error) {
+	claim := &Claims{}
+	keys, err := s.jwtKeys()
+	if err != nil {
+		logger.Log.Error("Load JWT keys error", zap.Error(err))
+		return nil, err
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, claim, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			// токены, выпущенные до появления kid, проверяем активным ключом
+			kid = keys.ActiveKID
+		}
+		key, ok := keys.Keys[kid]
+		if !ok {
+			return nil, errors.Errorf("unknown JWT key id %q", kid)
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if iss := s.Config.EnvValues.JWT.Issuer; iss != "" && !claim.VerifyIssuer(iss, true) {
+		return nil, errors.New("unexpected token issuer")
+	}
+	if aud := s.Config.EnvValues.JWT.Audience; aud != "" && !claim.VerifyAudience(aud, true) {
+		return nil, errors.New("unexpected token audience")
+	}
+	return claim, nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTKeyRotation(t *testing.T) {
+	var old Server
+	old.Config.EnvValues.JWT = config.JWTConf{Keys: "2023-10:old-secret", Issuer: "gophermart", Audience: "gophermart"}
+	oldToken, err := old.createJWTToken("42", "sid")
+	require.NoError(t, err)
+
+	var rotated Server
+	rotated.Config.EnvValues.JWT = config.JWTConf{
+		Keys:      "2023-11:new-secret,2023-10:old-secret",
+		ActiveKID: "2023-11",
+		Issuer:    "gophermart",
+		Audience:  "gophermart",
+	}
+	newToken, err := rotated.createJWTToken("42", "sid")
+	require.NoError(t, err)
+	assert.Equal(t, "42", tokenUID(&rotated, oldToken), "token signed with previous key must stay valid")
+	assert.Equal(t, "42", tokenUID(&rotated, newToken))
+
+	var retired Server
+	retired.Config.EnvValues.JWT = config.JWTConf{Keys: "2023-11:new-secret", Issuer: "gophermart", Audience: "gophermart"}
+	assert.Empty(t, tokenUID(&retired, oldToken), "token signed with removed key must be rejected")
+	assert.Equal(t, "42", tokenUID(&retired, newToken))
+}
+
+func TestJWTClaimsValidation(t *testing.T) {
+	var issuer Server
+	issuer.Config.EnvValues.JWT = config.JWTConf{Secret: "secret", Issuer: "other", Audience: "gophermart"}
+	otherIssuer, err := issuer.createJWTToken("42", "sid")
+	require.NoError(t, err)
+
+	var audience Server
+	audience.Config.EnvValues.JWT = config.JWTConf{Secret: "secret", Issuer: "gophermart", Audience: "admin"}
+	otherAudience, err := audience.createJWTToken("42", "sid")
+	require.NoError(t, err)
+
+	var expired Server
+	expired.Config.EnvValues.JWT = config.JWTConf{Secret: "secret", Issuer: "gophermart", Audience: "gophermart", TTL: time.Nanosecond}
+	expiredToken, err := expired.createJWTToken("42", "sid")
+	require.NoError(t, err)
+
+	var server Server
+	server.Config.EnvValues.JWT = config.JWTConf{Secret: "secret", Issuer: "gophermart", Audience: "gophermart"}
+	valid, err := server.createJWTToken("42", "sid")
+	require.NoError(t, err)
+
+	assert.Equal(t, "42", tokenUID(&server, valid))
+	assert.Empty(t, tokenUID(&server, otherIssuer))
+	assert.Empty(t, tokenUID(&server, otherAudience))
+	assert.Empty(t, tokenUID(&server, expiredToken))
+	assert.Empty(t, tokenUID(&server, "not a token"))
+}
+
+// tokenUID проверяет только сам токен, без обращения к сессиям в хранилище.
+func tokenUID(s *Server, token string) string {
+	claim, err := s.parseJWTToken(token)
+	if err != nil {
+		return ""
+	}
+	return claim.UserID
+}
+
+func TestJWTConfLoadKeys(t *testing.T) {
+	_, err := config.JWTConf{Keys: "broken"}.LoadKeys()
+	assert.Error(t, err)
+	_, err = config.JWTConf{Keys: "a:1", ActiveKID: "b"}.LoadKeys()
+	assert.Error(t, err)
+
+	keys, err := config.JWTConf{}.LoadKeys()
+	require.NoError(t, err)
+	assert.Empty(t, keys.Keys)
+}
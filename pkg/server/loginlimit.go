@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	loginScopeLogin = "login"
+	loginScopeIP    = "ip"
+
+	defaultLoginMaxFailures   = 5
+	defaultLoginMaxIPFailures = 20
+	defaultLoginLockout       = time.Minute
+	defaultLoginMaxLockout    = time.Hour
+	defaultLoginFailureWindow = time.Hour
+)
+
+// loginRetryAfter возвращает, сколько еще действует блокировка входа по логину или IP.
+func (s *Server) loginRetryAfter(login string, ip string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wait time.Duration
+	for _, k := range [][2]string{{loginScopeLogin, login}, {loginScopeIP, ip}} {
+		until, err := s.storage.GetLoginLock(ctx, k[0], k[1])
+		if err != nil {
+			return 0, err
+		}
+		if d := time.Until(until); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure учитывает неудачную попытку и при превышении порога
+// блокирует логин или IP на время, удваивающееся с каждой следующей ошибкой.
+func (s *Server) recordLoginFailure(login string, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conf := s.Config.EnvValues.LoginLimit
+	thresholds := map[string]int{
+		loginScopeLogin: positiveOr(conf.MaxFailures, defaultLoginMaxFailures),
+		loginScopeIP:    positiveOr(conf.MaxIPFailures, defaultLoginMaxIPFailures),
+	}
+	window := conf.Window
+	if window <= 0 {
+		window = defaultLoginFailureWindow
+	}
+	for _, k := range [][2]string{{loginScopeLogin, login}, {loginScopeIP, ip}} {
+		failures, err := s.storage.RecordLoginFailure(ctx, k[0], k[1], window)
+		if err != nil {
+			logger.Log.Error("Record login failure error", zap.Error(err))
+			continue
+		}
+		if failures < thresholds[k[0]] {
+			continue
+		}
+		lockout := s.loginLockout(failures - thresholds[k[0]])
+		logger.Log.Warn("Login locked", zap.String("scope", k[0]), zap.String("key", k[1]),
+			zap.Int("failures", failures), zap.Duration("lockout", lockout))
+		if err := s.storage.LockLogin(ctx, k[0], k[1], time.Now().Add(lockout)); err != nil {
+			logger.Log.Error("Lock login error", zap.Error(err))
+		}
+	}
+}
+
+func (s *Server) clearLoginFailures(scope string, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.storage.ClearLoginFailures(ctx, scope, key)
+}
+
+func (s *Server) loginLockout(extraFailures int) time.Duration {
+	base := s.Config.EnvValues.LoginLimit.Lockout
+	if base <= 0 {
+		base = defaultLoginLockout
+	}
+	max := s.Config.EnvValues.LoginLimit.MaxLockout
+	if max <= 0 {
+		max = defaultLoginMaxLockout
+	}
+	lockout := float64(base) * math.Pow(2, float64(extraFailures))
+	if lockout > float64(max) {
+		return max
+	}
+	return time.Duration(lockout)
+}
+
+func writeRetryAfter(res http.ResponseWriter, wait time.Duration) {
+	res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(res, "Слишком много неудачных попыток входа, повторите позже", http.StatusTooManyRequests)
+}
+
+// clientIP берет адрес соединения. X-Forwarded-For учитывается, только если соединение
+// пришло от доверенного прокси из LOGIN_TRUSTED_PROXIES: иначе блокировку по IP легко обойти,
+// а за прокси без этой настройки все клиенты делили бы один адрес. Заголовок читается справа
+// налево, и берется первый адрес, не принадлежащий доверенным прокси.
+func (s *Server) clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	trusted, err := s.Config.EnvValues.LoginLimit.TrustedProxyNets()
+	if err != nil {
+		logger.Log.Error("Invalid trusted proxies", zap.Error(err))
+		return host
+	}
+	if !isTrustedProxy(host, trusted) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		host = addr
+		if !isTrustedProxy(addr, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrustedProxy(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func positiveOr(value int, def int) int {
+	if value > 0 {
+		return value
+	}
+	return def
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+
+	TotalCountHeader = "X-Total-Count"
+	TotalSumHeader   = "X-Total-Sum"
+	NextCursorHeader = "X-Next-Cursor"
+)
+
+var errInvalidQuery = errors.New("invalid query")
+
+// encodeCursor упаковывает позицию в непрозрачную для клиента строку вида base64(<время>|<id>).
+func encodeCursor(cursor *models.PageCursor) string {
+	if cursor == nil {
+		return ""
+	}
+	raw := cursor.Date.UTC().Format(time.RFC3339Nano) + "|" + strconv.FormatInt(cursor.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(value string) (*models.PageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errInvalidQuery
+	}
+	date, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, errInvalidQuery
+	}
+	cursor := &models.PageCursor{}
+	if cursor.Date, err = time.Parse(time.RFC3339Nano, date); err != nil {
+		return nil, errInvalidQuery
+	}
+	if cursor.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, errInvalidQuery
+	}
+	return cursor, nil
+}
+
+// pageQuery - общие для списков параметры: limit, cursor, sort (asc|desc), from и to в RFC3339.
+// Без limit и cursor список отдается целиком, как до появления страниц, чтобы не ломать
+// существующих клиентов; нулевой limit означает отсутствие ограничения.
+type pageQuery struct {
+	limit int
+	after *models.PageCursor
+	desc  bool
+	from  time.Time
+	to    time.Time
+}
+
+func parsePageQuery(values url.Values) (pageQuery, error) {
+	query := pageQuery{}
+	if values.Get("cursor") != "" {
+		query.limit = defaultPageLimit
+	}
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxPageLimit {
+			return query, errInvalidQuery
+		}
+		query.limit = n
+	}
+	if v := values.Get("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil {
+			return query, err
+		}
+		query.after = cursor
+	}
+	switch values.Get("sort") {
+	case "", "asc":
+	case "desc":
+		query.desc = true
+	default:
+		return query, errInvalidQuery
+	}
+	var err error
+	if query.from, err = parseTimeParam(values.Get("from")); err != nil {
+		return query, err
+	}
+	if query.to, err = parseTimeParam(values.Get("to")); err != nil {
+		return query, err
+	}
+	if !query.from.IsZero() && !query.to.IsZero() && !query.from.Before(query.to) {
+		return query, errInvalidQuery
+	}
+	return query, nil
+}
+
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errInvalidQuery
+	}
+	return t, nil
+}
+
+func parseOrderQuery(values url.Values) (models.OrderQuery, error) {
+	page, err := parsePageQuery(values)
+	if err != nil {
+		return models.OrderQuery{}, err
+	}
+	query := models.OrderQuery{From: page.from, To: page.to, Desc: page.desc, Limit: page.limit, After: page.after}
+	if v := values.Get("status"); v != "" {
+		for _, status := range strings.Split(v, ",") {
+			status = strings.ToUpper(strings.TrimSpace(status))
+			if !models.OrderStatusValid(status) {
+				return query, errInvalidQuery
+			}
+			query.Statuses = append(query.Statuses, status)
+		}
+	}
+	return query, nil
+}
+
+func parseWithdrawalQuery(values url.Values) (models.WithdrawalQuery, error) {
+	page, err := parsePageQuery(values)
+	if err != nil {
+		return models.WithdrawalQuery{}, err
+	}
+	return models.WithdrawalQuery{From: page.from, To: page.to, Desc: page.desc, Limit: page.limit, After: page.after}, nil
+}
+
+func writePageHeaders(res http.ResponseWriter, total int, next *models.PageCursor) {
+	res.Header().Set(TotalCountHeader, strconv.Itoa(total))
+	if next != nil {
+		res.Header().Set(NextCursorHeader, encodeCursor(next))
+	}
+}
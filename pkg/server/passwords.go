@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/notifier"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const defaultPasswordResetTTL = time.Hour
+
+func (s *Server) ChangePasswordHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	var change models.PasswordChange
+	if err := json.NewDecoder(req.Body).Decode(&change); err != nil || change.NewPassword == "" {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.getUserByID(userID)
+	if err != nil {
+		logger.Log.Error("Get user error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !s.matchPasswords(change.CurrentPassword, user) {
+		http.Error(res, "Неверный текущий пароль", http.StatusForbidden)
+		return
+	}
+	if errs := s.validatePassword("new_password", change.NewPassword, user.Login); len(errs) != 0 {
+		writeValidationErrors(res, errs)
+		return
+	}
+	// текущая сессия остается, остальные устройства придется залогинить заново
+	if err := s.setPassword(userID, change.NewPassword, sessionIDFromContext(req.Context())); err != nil {
+		logger.Log.Error("Change password error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+// PasswordResetHandler отправляет токен сброса пароля через notifier. Ответ не зависит
+// от того, существует ли логин, чтобы по нему нельзя было перебирать пользователей: токен
+// создается и отправляется уже после ответа, поэтому и время ответа одинаковое.
+func (s *Server) PasswordResetHandler(res http.ResponseWriter, req *http.Request) {
+	var reset models.PasswordResetRequest
+	if err := json.NewDecoder(req.Body).Decode(&reset); err != nil || reset.Login == "" {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	go func(login string) {
+		if err := s.requestPasswordReset(login); err != nil && !errors.Is(err, errorsstorage.ErrUserNotExists) {
+			logger.Log.Error("Password reset error", zap.Error(err))
+		}
+	}(normalizeLogin(reset.Login))
+	res.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) PasswordResetConfirmHandler(res http.ResponseWriter, req *http.Request) {
+	var confirm models.PasswordResetConfirm
+	if err := json.NewDecoder(req.Body).Decode(&confirm); err != nil || confirm.Token == "" || confirm.NewPassword == "" {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	// проверяем до использования токена, чтобы слабый пароль не сжигал его
+	if errs := s.validatePassword("new_password", confirm.NewPassword, ""); len(errs) != 0 {
+		writeValidationErrors(res, errs)
+		return
+	}
+
+	userID, err := s.consumePasswordReset(confirm.Token)
+	if err != nil {
+		if errors.Is(err, errorsstorage.ErrResetTokenNotExist) {
+			http.Error(res, "Недействительный токен сброса пароля", http.StatusBadRequest)
+			return
+		}
+		logger.Log.Error("Consume password reset error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if err := s.setPassword(userID, confirm.NewPassword, ""); err != nil {
+		logger.Log.Error("Reset password error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getUserByID(userID int) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.storage.GetUserByID(ctx, userID)
+}
+
+// setPassword меняет пароль и отзывает все сессии пользователя, кроме keepSessionID.
+func (s *Server) setPassword(userID int, password string, keepSessionID string) error {
+	hash, algo, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.storage.ChangePassword(ctx, userID, hash, algo, keepSessionID)
+}
+
+func (s *Server) requestPasswordReset(login string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := s.storage.GetUserByLogin(ctx, login)
+	if err != nil {
+		return err
+	}
+	userID := user.ID
+	token, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+	if err := s.storage.CreatePasswordReset(ctx, userID, hashSecretToken(token), time.Now().Add(s.passwordResetTTL())); err != nil {
+		return err
+	}
+	return s.notify().Notify(ctx, notifier.Message{
+		To:      login,
+		Subject: "Сброс пароля",
+		Body:    "Токен для сброса пароля: " + token,
+	})
+}
+
+func (s *Server) consumePasswordReset(token string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.storage.ConsumePasswordReset(ctx, hashSecretToken(token))
+}
+
+func (s *Server) passwordResetTTL() time.Duration {
+	if s.Config.EnvValues.Password.ResetTTL > 0 {
+		return s.Config.EnvValues.Password.ResetTTL
+	}
+	return defaultPasswordResetTTL
+}
+
+func (s *Server) notify() notifier.Notifier {
+	if s.notifier == nil {
+		return notifier.LogNotifier{}
+	}
+	return s.notifier
+}
@@ -3,38 +3,37 @@ package server
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
-	"log"
 	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Dorrrke/loyality-system.git/internal/config"
 	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/accrual"
+	"github.com/Dorrrke/loyality-system.git/pkg/hasher"
 	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/notifier"
 	"github.com/Dorrrke/loyality-system.git/pkg/storage"
 	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
-	"github.com/golang-jwt/jwt/v4"
-	"github.com/google/uuid"
+	"github.com/go-chi/chi/v5"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/bcrypt"
 )
 
-const SecretKey = "SecretFurinaNotFokalors333"
-
 type Server struct {
-	storage storage.Storage
-	Config  config.Config
-	client  *http.Client
-}
-
-type Claims struct {
-	jwt.RegisteredClaims
-	UserID string
+	storage     storage.Storage
+	accrual     accrual.AccrualClient
+	Config      config.Config
+	accrualWake chan struct{}
+	notifier    notifier.Notifier
+
+	jwtOnce    sync.Once
+	jwtKeyRing config.JWTKeys
+	jwtErr     error
 }
 
 func (s *Server) RegisterHandler(res http.ResponseWriter, req *http.Request) {
@@ -47,8 +46,15 @@ func (s *Server) RegisterHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	salt := uuid.New().String()
-	pass, err := s.hashPassword(authModel.Password)
+	authModel.Login = normalizeLogin(authModel.Login)
+	errs := s.validateLogin(authModel.Login)
+	errs = append(errs, s.validatePassword("password", authModel.Password, authModel.Login)...)
+	if len(errs) != 0 {
+		writeValidationErrors(res, errs)
+		return
+	}
+
+	pass, algo, err := s.hashPassword(authModel.Password)
 	if err != nil {
 		logger.Log.Error("Hashing pass error", zap.Error(err))
 		http.Error(res, "Внутренняя ошибка серевера", http.StatusInternalServerError)
@@ -56,7 +62,7 @@ func (s *Server) RegisterHandler(res http.ResponseWriter, req *http.Request) {
 	}
 	authModel.Password = pass
 
-	uid, err := s.saveUser(authModel, salt)
+	uid, err := s.saveUser(authModel, algo)
 	if err != nil { // После сохранения, нужно достовать uid пользователя
 		if errors.Is(err, errorsstorage.ErrLoginCOnflict) {
 			http.Error(res, "Логин занят", http.StatusConflict)
@@ -66,15 +72,8 @@ func (s *Server) RegisterHandler(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, "Внутренняя ошибка серевера", http.StatusInternalServerError)
 		return
 	}
-	token, err := createJWTToken(uid)
-	if err != nil {
-		logger.Log.Info("cannot create token", zap.Error(err))
-	}
-	res.Header().Add("Authorization", token)
-
-	// Так же надо сразу логинить пользователя, тобишь отправлть куку или в Header поле заносить userID
-	res.WriteHeader(http.StatusOK)
-
+	// Сразу логиним пользователя: создаем сессию и отдаем пару токенов
+	s.writeTokens(res, uid)
 }
 
 func (s *Server) LoginHandler(res http.ResponseWriter, req *http.Request) {
@@ -88,31 +87,55 @@ func (s *Server) LoginHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	rawLogin := authModel.Login
+	authModel.Login = normalizeLogin(authModel.Login)
+	ip := s.clientIP(req)
+	wait, err := s.loginRetryAfter(authModel.Login, ip)
+	if err != nil {
+		logger.Log.Error("Check login lock error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка серевера", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeRetryAfter(res, wait)
+		return
+	}
+
 	uid, err := s.getUser(authModel)
+	if isWrongCredentials(err) && rawLogin != authModel.Login {
+		// Старые логины, совпавшие после нормализации с другим пользователем, хранятся как были
+		uid, err = s.getUser(models.AuthModel{Login: rawLogin, Password: authModel.Password})
+	}
 	if err != nil {
-		if errors.Is(err, errorsstorage.ErrUserNotExists) || err.Error() == "Password does not correct" {
+		if isWrongCredentials(err) {
 			logger.Log.Error("User not exist", zap.Error(err))
+			s.recordLoginFailure(authModel.Login, ip)
 			http.Error(res, "Неверная пара логин/пароль", http.StatusUnauthorized)
 			return
 		}
+		if errors.Is(err, errorsstorage.ErrUserBlocked) {
+			http.Error(res, "Аккаунт заблокирован", http.StatusForbidden)
+			return
+		}
 		logger.Log.Error("Check info from db error", zap.Error(err))
 		http.Error(res, "Внутренняя ошибка серевера", http.StatusInternalServerError)
 		return
 	}
-	token, err := createJWTToken(fmt.Sprint(uid))
-	if err != nil {
-		logger.Log.Info("cannot create token", zap.Error(err))
+	// Со вторым фактором ошибки сбрасываются только после верного кода
+	if s.writeLoginChallenge(res, uid) {
+		return
 	}
-	res.Header().Add("Authorization", token)
-	res.WriteHeader(http.StatusOK)
+	// Счетчик по IP не сбрасываем: иначе его обнулял бы вход в собственный аккаунт
+	if err := s.clearLoginFailures(loginScopeLogin, authModel.Login); err != nil {
+		logger.Log.Error("Clear login failures error", zap.Error(err))
+	}
+	s.writeTokens(res, uid)
 }
 
 func (s *Server) UploadOrderHandler(res http.ResponseWriter, req *http.Request) {
-	//проверка аунтификации пользователя
-	token := req.Header.Get("Authorization")
-	userID := getUID(token)
-	if userID == "" {
-		http.Error(res, "User unauth", http.StatusUnauthorized)
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
 		return
 	}
 	orderNum, err := io.ReadAll(req.Body)
@@ -131,14 +154,13 @@ func (s *Server) UploadOrderHandler(res http.ResponseWriter, req *http.Request)
 	uid, err := s.checkOrder(string(orderNum))
 	if err != nil {
 		if errors.Is(err, errorsstorage.ErrOrderNotExist) {
-			logger.Log.Info("UserID", zap.String("UID from toketn", userID), zap.String("UserId from db", uid))
 			err = s.uploadOrder(string(orderNum), userID)
 			if err != nil {
 				logger.Log.Error("Insert order err - ", zap.Error(err))
 				http.Error(res, "Внутренняя ошибка серевера", http.StatusInternalServerError)
 				return
 			}
-			go s.getFromAccrualSys(string(orderNum), userID) // TODO асинхронность
+			s.wakeAccrualWorkers()
 			res.WriteHeader(http.StatusAccepted)
 			return
 		}
@@ -155,38 +177,50 @@ func (s *Server) UploadOrderHandler(res http.ResponseWriter, req *http.Request)
 }
 
 func (s *Server) UnloadHandler(res http.ResponseWriter, req *http.Request) {
-	token := req.Header.Get("Authorization")
-	userID := getUID(token)
-	if userID == "" {
-		http.Error(res, "User unauth", http.StatusUnauthorized)
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	// Заказы отдаются постранично и без параметров, чтобы не грузить список в память целиком
+	s.listOrders(res, req, userID)
+}
+
+// GetOrderHandler отдает один заказ пользователя по номеру.
+func (s *Server) GetOrderHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	number := chi.URLParam(req, "number")
+	if !orderNumberValid(number) {
+		http.Error(res, "Неверный формат номера заказа", http.StatusUnprocessableEntity)
 		return
 	}
-	orders, err := s.getAllOrders(userID)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	order, err := s.storage.GetOrder(ctx, number)
 	if err != nil {
-		if errors.Is(err, errorsstorage.ErrOrdersNotExist) {
-			logger.Log.Error("User havnt orders")
-			http.Error(res, "Нет данных для ответа", http.StatusNoContent)
+		if errors.Is(err, errorsstorage.ErrOrderNotExist) {
+			http.Error(res, "Заказ не найден", http.StatusNotFound)
 			return
 		}
-		logger.Log.Error("Error when get order data from db", zap.Error(err))
-		http.Error(res, "Внутренняя ошибка серевера", http.StatusInternalServerError)
+		logger.Log.Error("Get order error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
 		return
 	}
-	logger.Log.Info("unload orders:", zap.Any("orders", orders))
-	res.Header().Set("Content-Type", "application/json")
-	enc := json.NewEncoder(res)
-	if err := enc.Encode(orders); err != nil {
-		logger.Log.Error("Encode orders error", zap.Error(err))
-		http.Error(res, "Внутренняя ошибка", http.StatusInternalServerError)
+	if order.UserID != userID {
+		http.Error(res, "Заказ загружен другим пользователем", http.StatusForbidden)
 		return
 	}
+	writeJSON(res, order)
 }
 
 func (s *Server) GetBalanceHandler(res http.ResponseWriter, req *http.Request) {
-	token := req.Header.Get("Authorization")
-	userID := getUID(token)
-	if userID == "" {
-		http.Error(res, "User unauth", http.StatusUnauthorized)
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
 		return
 	}
 	balance, err := s.getUserBalance(userID)
@@ -205,10 +239,9 @@ func (s *Server) GetBalanceHandler(res http.ResponseWriter, req *http.Request) {
 }
 
 func (s *Server) WriteOffBonusHandler(res http.ResponseWriter, req *http.Request) {
-	token := req.Header.Get("Authorization")
-	userID := getUID(token)
-	if userID == "" {
-		http.Error(res, "User unauth", http.StatusUnauthorized)
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
 		return
 	}
 
@@ -221,15 +254,23 @@ func (s *Server) WriteOffBonusHandler(res http.ResponseWriter, req *http.Request
 		return
 	}
 
+	if withdraw.Sum <= 0 {
+		http.Error(res, "Неверная сумма списания", http.StatusBadRequest)
+		return
+	}
 	if !orderNumberValid(withdraw.Order) {
 		http.Error(res, "Неверный номер заказа", http.StatusUnprocessableEntity)
 		return
 	}
 	if err := s.writeOffBonuces(withdraw, userID); err != nil {
-		if err.Error() == "insufficient fund" {
+		if errors.Is(err, errorsstorage.ErrInsufficientFunds) {
 			http.Error(res, "Недостаточно средств", http.StatusPaymentRequired)
 			return
 		}
+		if errors.Is(err, errorsstorage.ErrWithdrawalConflict) {
+			http.Error(res, "Списание по этому заказу уже выполнено", http.StatusConflict)
+			return
+		}
 		logger.Log.Error("write off error", zap.Error(err))
 		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
 		return
@@ -238,118 +279,22 @@ func (s *Server) WriteOffBonusHandler(res http.ResponseWriter, req *http.Request
 }
 
 func (s *Server) WriteOffBalanceHistoryHandler(res http.ResponseWriter, req *http.Request) {
-	token := req.Header.Get("Authorization")
-	userID := getUID(token)
-	if userID == "" {
-		http.Error(res, "User unauth", http.StatusUnauthorized)
-		return
-	}
-	history, err := s.getWriteOffHistory(userID)
-	if err != nil {
-		if errors.Is(err, errorsstorage.ErrWriteOffNotExist) {
-			logger.Log.Error("User havnt write off")
-			http.Error(res, "нет ни одного списания", http.StatusNoContent)
-			return
-		}
-		logger.Log.Error("get history error", zap.Error(err))
-		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
-		return
-	}
-	res.Header().Set("Content-Type", "application/json")
-	enc := json.NewEncoder(res)
-	if err := enc.Encode(history); err != nil {
-		logger.Log.Error("Encode orders error", zap.Error(err))
-		http.Error(res, "Внутренняя ошибка", http.StatusInternalServerError)
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
 		return
 	}
+	// История отдается постранично и без параметров, чтобы не грузить ее в память целиком
+	s.listWithdrawals(res, req, userID)
 }
 
-func (s *Server) getFromAccrualSys(orderNumber string, userID string) error {
-	response, err := s.client.Get("http://" + s.Config.AccrualConfig.String() + "/api/orders/" + orderNumber)
-	if err != nil {
-		logger.Log.Error("Accrual sys responce error", zap.Error(err))
-		return err
-	}
-	defer response.Body.Close()
-	statusCode := response.StatusCode
-	if statusCode == 200 {
-		logger.Log.Info("Accrual system response", zap.Int("StatusCode", statusCode))
-		var accrualModel models.AccrualModel
-		dec := json.NewDecoder(response.Body)
-		if err := dec.Decode(&accrualModel); err != nil {
-			logger.Log.Error("Cannot parse req body", zap.Error(err))
-			return err
-		}
-		logger.Log.Info("Acrrual sys responce:",
-			zap.String("Order", accrualModel.OrderNumber),
-			zap.Float32("Accrual", accrualModel.Accrual),
-			zap.String("Status", accrualModel.Status))
-		logger.Log.Info("1 User ID", zap.String("UID", userID))
-		if err := s.updateOrderAndBalance(accrualModel, userID); err != nil {
-			logger.Log.Error("Accrual db update Error", zap.Error(err))
-			return err
-		}
-		return nil
-	}
-	if statusCode == 204 {
-		logger.Log.Info("Accrual", zap.Int("StatusCode", statusCode))
-		return errors.New("Заказ не зарегестрирован")
-	}
-	if statusCode == 429 {
-		logger.Log.Info("Accrual", zap.Int("StatusCode", statusCode))
-		time.Sleep(5 * time.Second)
-		s.getFromAccrualSys(orderNumber, userID)
-	}
-	log.Print(statusCode)
-	return nil
-}
-
-func (s *Server) updateOrdersByAccrual() {
-	for {
-		flag := true
-		orders, err := s.GetAllDetOrders()
-		if err != nil {
-			logger.Log.Error("Err", zap.Error(err))
-			if errors.Is(err, errorsstorage.ErrOrderNotExist) {
-				flag = false
-			}
-		}
-		if flag {
-			for _, v := range orders {
-				orderNum := v
-				go func() error {
-					uID, err := s.checkOrder(orderNum)
-					if err != nil {
-						return err
-					}
-					err = s.getFromAccrualSys(orderNum, uID)
-					if err != nil {
-						return err
-					}
-					return nil
-				}()
-			}
-		}
-		time.Sleep(5 * time.Second)
-	}
-}
-func (s *Server) GetAllDetOrders() ([]string, error) {
+func (s *Server) saveUser(user models.AuthModel, passAlgo string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	orders, err := s.storage.GetNoTerminateOrders(ctx)
+	uid, err := s.storage.InsertUser(ctx, user.Login, user.Password, passAlgo)
 	if err != nil {
-		return nil, err
-	}
-	return orders, nil
-}
-func (s *Server) saveUser(user models.AuthModel, salt string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	uid, err := s.storage.InsertUser(ctx, user.Login, user.Password)
-	if err != nil {
-		return "", err
+		return -1, err
 	}
-
 	return uid, nil
 }
 
@@ -357,27 +302,39 @@ func (s *Server) getUser(user models.AuthModel) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	uid, pass, err := s.storage.GetUserByLogin(ctx, user.Login, user.Password)
+	stored, err := s.storage.GetUserByLogin(ctx, user.Login)
 	if err != nil {
 		return -1, err
 	}
-	if !s.matchPasswords(user.Password, pass) {
+	if !s.matchPasswords(user.Password, stored) {
 		return -1, errors.New("Password does not correct")
 	}
+	// О блокировке сообщаем только после проверки пароля, чтобы не раскрывать ее подбором
+	if stored.Blocked {
+		return -1, errorsstorage.ErrUserBlocked
+	}
+	// Пароль верный, значит можно пересчитать хеш по текущим настройкам
+	if h, err := s.passwordHasher(); err == nil && h.NeedsRehash(stored.PasswordHash, stored.PasswordAlgo) {
+		pass, algo, err := h.Hash(user.Password)
+		if err == nil {
+			err = s.storage.UpdatePassword(ctx, stored.ID, pass, algo)
+		}
+		if err != nil {
+			logger.Log.Error("Rehash password error", zap.Error(err))
+		}
+	}
 
-	return uid, nil
+	return stored.ID, nil
+}
+
+func isWrongCredentials(err error) bool {
+	return err != nil && (errors.Is(err, errorsstorage.ErrUserNotExists) || err.Error() == "Password does not correct")
 }
 
-func (s *Server) getUserBalance(userID string) (models.Balance, error) {
+func (s *Server) getUserBalance(userID int) (models.Balance, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	uid, err := strconv.Atoi(userID)
-	if err != nil {
-		logger.Log.Error("str to int err", zap.Error(err))
-		return models.Balance{Current: 0,
-			Withdraw: 0}, err
-	}
-	balance, err := s.storage.GetUserBalance(ctx, uid)
+	balance, err := s.storage.GetUserBalance(ctx, userID)
 	if err != nil {
 		return models.Balance{Current: 0,
 			Withdraw: 0}, err
@@ -385,68 +342,83 @@ func (s *Server) getUserBalance(userID string) (models.Balance, error) {
 	return balance, nil
 }
 
-func (s *Server) getAllOrders(userID string) ([]models.Order, error) {
+// listOrders отдает страницу заказов по фильтрам status, from, to, sort, limit и cursor.
+func (s *Server) listOrders(res http.ResponseWriter, req *http.Request, userID int) {
+	query, err := parseOrderQuery(req.URL.Query())
+	if err != nil {
+		http.Error(res, "Неверные параметры запроса", http.StatusBadRequest)
+		return
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-
-	orders, err := s.storage.GetAllOrders(ctx, userID)
+	page, err := s.storage.ListOrders(ctx, userID, query)
 	if err != nil {
-		return nil, err
+		logger.Log.Error("List orders error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка серевера", http.StatusInternalServerError)
+		return
 	}
-
-	return orders, nil
+	writePageHeaders(res, page.Total, page.Next)
+	if len(page.Orders) == 0 {
+		http.Error(res, "Нет данных для ответа", http.StatusNoContent)
+		return
+	}
+	writeJSON(res, page.Orders)
 }
 
-func (s *Server) getWriteOffHistory(userID string) ([]models.WithdrawInfo, error) {
+// listWithdrawals отдает страницу списаний за период from-to. Тело ответа остается массивом
+// списаний, как в спецификации, поэтому количество и сумма списаний за весь период
+// возвращаются в заголовках X-Total-Count и X-Total-Sum.
+func (s *Server) listWithdrawals(res http.ResponseWriter, req *http.Request, userID int) {
+	query, err := parseWithdrawalQuery(req.URL.Query())
+	if err != nil {
+		http.Error(res, "Неверные параметры запроса", http.StatusBadRequest)
+		return
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-
-	uid, err := strconv.Atoi(userID)
+	page, err := s.storage.ListWithdrawals(ctx, userID, query)
 	if err != nil {
-		logger.Log.Error("str to int err", zap.Error(err))
-		return nil, err
+		logger.Log.Error("List withdrawals error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
 	}
-
-	history, err := s.storage.GetUsersWithdrawls(ctx, uid)
-	if err != nil {
-		return nil, err
+	writePageHeaders(res, page.Total, page.Next)
+	res.Header().Set(TotalSumHeader, page.Sum.String())
+	if len(page.Withdrawals) == 0 {
+		http.Error(res, "нет ни одного списания", http.StatusNoContent)
+		return
 	}
-	return history, nil
+	writeJSON(res, page.Withdrawals)
 }
 
-func (s *Server) updateOrderAndBalance(accrual models.AccrualModel, userID string) error {
+func (s *Server) getAllOrders(userID int) ([]models.Order, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	logger.Log.Info("2 User ID", zap.String("UID", userID))
 
-	err := s.storage.UpdateByAccrual(ctx, accrual, userID)
+	orders, err := s.storage.GetAllOrders(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
-}
 
-func (s *Server) writeOffBonuces(withdraw models.Withdraw, userID string) error {
-	balance, err := s.getUserBalance(userID)
-	if err != nil {
-		return err
-	}
+	return orders, nil
+}
 
-	if balance.Current-withdraw.Sum < 0 {
-		return errors.New("insufficient fund")
-	}
+func (s *Server) getWriteOffHistory(userID int) ([]models.WithdrawInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	uid, err := strconv.Atoi(userID)
+	history, err := s.storage.GetUsersWithdrawls(ctx, userID)
 	if err != nil {
-		logger.Log.Error("str to int err", zap.Error(err))
-		return err
+		return nil, err
 	}
-	current := balance.Current - withdraw.Sum
+	return history, nil
+}
 
+func (s *Server) writeOffBonuces(withdraw models.Withdraw, userID int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	err = s.storage.InsertWriteOffBonuces(ctx, withdraw, current, uid)
+	err := s.storage.InsertWriteOffBonuces(ctx, withdraw, userID)
 	if err != nil {
 		return err
 	}
@@ -482,69 +454,44 @@ func orderNumberValid(number string) bool {
 	return math.Mod(float64(sum), 10) == 0
 }
 
-func createJWTToken(uuid string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 3)),
-		},
-		UserID: uuid,
-	})
-
-	tokenString, err := token.SignedString([]byte(SecretKey))
-	if err != nil {
-		return "", err
-	}
-	return tokenString, nil
+func (s *Server) passwordHasher() (*hasher.Hasher, error) {
+	return hasher.New(s.Config.EnvValues.Password.HasherParams())
 }
 
-func getUID(tokenString string) string {
-	claim := &Claims{}
-
-	token, err := jwt.ParseWithClaims(tokenString, claim, func(t *jwt.Token) (interface{}, error) {
-		return []byte(SecretKey), nil
-	})
+// hashPassword возвращает хеш пароля и идентификатор алгоритма для хранения рядом с ним.
+func (s *Server) hashPassword(pass string) (string, string, error) {
+	h, err := s.passwordHasher()
 	if err != nil {
-		return ""
-	}
-
-	if !token.Valid {
-		return ""
+		return ``, ``, err
 	}
-	logger.Log.Info("Decode token:", zap.String("UserID:", claim.UserID))
-	return claim.UserID
+	return h.Hash(pass)
 }
 
-func (s *Server) hashPassword(pass string) (string, error) {
-
-	hashedPassword, err := bcrypt.
-		GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+func (s *Server) matchPasswords(currentPass string, user models.User) bool {
+	h, err := s.passwordHasher()
 	if err != nil {
-		return ``, err
+		logger.Log.Error("Password hasher error", zap.Error(err))
+		return false
 	}
-
-	return string(hashedPassword), nil
-}
-
-func (s *Server) matchPasswords(currentPass string, passFromDB string) bool {
-	{
-		err := bcrypt.CompareHashAndPassword(
-			[]byte(passFromDB), []byte(currentPass))
-		return err == nil
+	ok, err := h.Verify(currentPass, user.PasswordHash, user.PasswordAlgo)
+	if err != nil {
+		logger.Log.Error("Verify password error", zap.Error(err))
 	}
+	return ok
 }
 
-func (s *Server) checkOrder(order string) (string, error) {
+func (s *Server) checkOrder(order string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	userID, err := s.storage.CheckOrder(ctx, order)
 	if err != nil {
-		return "", err
+		return -1, err
 	}
 	return userID, nil
 }
 
-func (s *Server) uploadOrder(order string, uid string) error {
+func (s *Server) uploadOrder(order string, uid int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -586,7 +533,25 @@ func (s *Server) ConnStorage(stor storage.Storage) {
 	s.storage = stor
 }
 
+func (s *Server) ConnAccrual(client accrual.AccrualClient) {
+	s.accrual = client
+}
+
+func (s *Server) ConnNotifier(n notifier.Notifier) {
+	s.notifier = n
+}
+
 func (s *Server) New() {
-	s.client = &http.Client{}
-	go s.updateOrdersByAccrual()
+	if s.accrual == nil {
+		s.accrual = accrual.NewHTTPClient(s.Config.AccrualConfig.String(), &http.Client{Timeout: 10 * time.Second})
+	}
+	if s.notifier == nil && s.Config.EnvValues.Notifier.Kind == "file" {
+		s.notifier = notifier.NewFileNotifier(s.Config.EnvValues.Notifier.File)
+	}
+	if s.notifier == nil {
+		s.notifier = notifier.LogNotifier{}
+	}
+	s.accrualWake = make(chan struct{}, 1)
+	go s.runAccrualWorkers(context.Background())
+	go s.runCleanup(context.Background())
 }
@@ -2,33 +2,104 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
-
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/config"
+	"github.com/Dorrrke/loyality-system.git/pkg/accrual"
+	"github.com/Dorrrke/loyality-system.git/pkg/accrual/accrualstub"
+	"github.com/Dorrrke/loyality-system.git/pkg/hasher"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/notifier"
 	"github.com/Dorrrke/loyality-system.git/pkg/storage"
+	"github.com/Dorrrke/loyality-system.git/pkg/totp"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-resty/resty/v2"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var db = flag.String("db", "", "DataBase url")
 var accrualAddr = flag.String("r", "", "address and port accrual")
 
-func TestRegisterHandler(t *testing.T) {
+var memStorage = storage.NewMemStorage()
 
-	var server Server
-	server.Config.AccrualConfig.Set(*accrualAddr)
-	conn, err := pgxpool.New(context.Background(), *db)
-	if err != nil {
-		panic(err)
+// connTestStorage подключает базу из флага -db, а без него - общее для всех тестов хранилище в памяти.
+func connTestStorage(t *testing.T, server *Server) {
+	if *db == "" {
+		server.ConnStorage(memStorage)
+		return
 	}
+	conn, err := pgxpool.New(context.Background(), *db)
+	require.NoError(t, err)
+	t.Cleanup(conn.Close)
 	server.ConnStorage(&storage.DataBaseStorage{DB: conn})
-	defer conn.Close()
+}
+
+// newTestServer подключает тестовое хранилище, создает таблицы и поднимает HTTP сервер с маршрутами из routes.
+func newTestServer(t *testing.T, server *Server, routes func(r chi.Router)) *httptest.Server {
+	connTestStorage(t, server)
+	require.NoError(t, server.CreateTable())
+
+	r := chi.NewRouter()
+	routes(r)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// registerTestUser регистрирует пользователя с паролем login+"Pass1" и возвращает его access токен и uid.
+func registerTestUser(t *testing.T, server *Server, srvURL string, login string) (string, int) {
+	resp, err := resty.New().R().
+		SetBody(models.AuthModel{Login: login, Password: login + "Pass1"}).
+		Post(srvURL + "/api/user/register")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	token := resp.Header().Get("Authorization")
+	uid, err := strconv.Atoi(tokenUID(server, token))
+	require.NoError(t, err)
+	return token, uid
+}
+
+// processTestAccrualJobs синхронно прогоняет готовые задачи начисления через систему расчёта.
+func processTestAccrualJobs(t *testing.T, server *Server) {
+	jobs, err := server.claimAccrualJobs(100)
+	require.NoError(t, err)
+	for _, job := range jobs {
+		server.processAccrualJob(job)
+	}
+}
+
+// connTestAccrual подключает систему расчёта из флага -r, а без него - встроенную заглушку.
+func connTestAccrual(t *testing.T, server *Server) {
+	if *accrualAddr != "" {
+		server.Config.AccrualConfig.Set(*accrualAddr)
+		return
+	}
+	stub := httptest.NewServer(accrualstub.NewHandler(accrualstub.Config{
+		Default: &accrualstub.Rule{Accrual: 500 * models.Point},
+	}))
+	t.Cleanup(stub.Close)
+	server.ConnAccrual(accrual.NewHTTPClient(stub.URL, stub.Client()))
+}
+
+func TestRegisterHandler(t *testing.T) {
+
+	var server Server
+	connTestAccrual(t, &server)
+	connTestStorage(t, &server)
 
 	if err := server.CreateTable(); err != nil {
 		panic(err)
@@ -120,13 +191,8 @@ func TestRegisterHandler(t *testing.T) {
 func TestLoginHandler(t *testing.T) {
 
 	var server Server
-	server.Config.AccrualConfig.Set(*accrualAddr)
-	conn, err := pgxpool.New(context.Background(), *db)
-	if err != nil {
-		panic(err)
-	}
-	server.ConnStorage(&storage.DataBaseStorage{DB: conn})
-	defer conn.Close()
+	connTestAccrual(t, &server)
+	connTestStorage(t, &server)
 
 	if err := server.CreateTable(); err != nil {
 		panic(err)
@@ -201,21 +267,16 @@ func TestLoginHandler(t *testing.T) {
 func TestUploadOrderHandler(t *testing.T) {
 
 	var server Server
-	server.Config.AccrualConfig.Set(*accrualAddr)
-	conn, err := pgxpool.New(context.Background(), *db)
-	if err != nil {
-		panic(err)
-	}
-	server.ConnStorage(&storage.DataBaseStorage{DB: conn})
-	defer conn.Close()
+	connTestAccrual(t, &server)
+	connTestStorage(t, &server)
 
-	err = server.CreateTable()
+	err := server.CreateTable()
 	require.NoError(t, err)
 
 	r := chi.NewRouter()
 
 	r.Route("/api/user", func(r chi.Router) {
-		r.Post("/orders", server.UploadOrderHandler)
+		r.With(server.AuthMiddleware).Post("/orders", server.UploadOrderHandler)
 		r.Post("/login", server.LoginHandler)
 	})
 	srv := httptest.NewServer(r)
@@ -317,14 +378,8 @@ func TestUploadOrderHandler(t *testing.T) {
 func TestGetBalanceHandler(t *testing.T) {
 
 	var server Server
-	server.Config.AccrualConfig.Set(*accrualAddr)
-	conn, err := pgxpool.New(context.Background(), *db)
-	if err != nil {
-		panic(err)
-	}
-
-	server.ConnStorage(&storage.DataBaseStorage{DB: conn})
-	defer conn.Close()
+	connTestAccrual(t, &server)
+	connTestStorage(t, &server)
 
 	if err := server.CreateTable(); err != nil {
 		panic(err)
@@ -333,7 +388,7 @@ func TestGetBalanceHandler(t *testing.T) {
 	r := chi.NewRouter()
 
 	r.Route("/api/user", func(r chi.Router) {
-		r.Get("/balance", server.GetBalanceHandler)
+		r.With(server.AuthMiddleware).Get("/balance", server.GetBalanceHandler)
 		r.Post("/login", server.LoginHandler)
 	})
 	srv := httptest.NewServer(r)
@@ -409,26 +464,22 @@ func TestGetBalanceHandler(t *testing.T) {
 func TestWriteOffBonusHandler(t *testing.T) {
 
 	var server Server
-	server.Config.AccrualConfig.Set(*accrualAddr)
-	conn, err := pgxpool.New(context.Background(), *db)
-	if err != nil {
-		panic(err)
-	}
-
-	server.ConnStorage(&storage.DataBaseStorage{DB: conn})
-	defer conn.Close()
+	connTestAccrual(t, &server)
+	connTestStorage(t, &server)
 
 	if err := server.CreateTable(); err != nil {
 		panic(err)
 	}
+	// начисляем баллы за загруженные ранее заказы, чтобы было что списывать
+	processTestAccrualJobs(t, &server)
 
 	r := chi.NewRouter()
 
 	r.Route("/api/user", func(r chi.Router) {
 		r.Post("/login", server.LoginHandler)
 		r.Route("/balance", func(r chi.Router) {
-			r.Get("/", server.GetBalanceHandler)
-			r.Post("/withdraw", server.WriteOffBonusHandler)
+			r.With(server.AuthMiddleware).Get("/", server.GetBalanceHandler)
+			r.With(server.AuthMiddleware).Post("/withdraw", server.WriteOffBonusHandler)
 		})
 	})
 	srv := httptest.NewServer(r)
@@ -538,14 +589,8 @@ func TestWriteOffBonusHandler(t *testing.T) {
 func TestWriteOffBalanceHistoryHandler(t *testing.T) {
 
 	var server Server
-	server.Config.AccrualConfig.Set(*accrualAddr)
-	conn, err := pgxpool.New(context.Background(), *db)
-	if err != nil {
-		panic(err)
-	}
-
-	server.ConnStorage(&storage.DataBaseStorage{DB: conn})
-	defer conn.Close()
+	connTestAccrual(t, &server)
+	connTestStorage(t, &server)
 
 	if err := server.CreateTable(); err != nil {
 		panic(err)
@@ -556,10 +601,10 @@ func TestWriteOffBalanceHistoryHandler(t *testing.T) {
 	r.Route("/api/user", func(r chi.Router) {
 		r.Post("/login", server.LoginHandler)
 		r.Route("/balance", func(r chi.Router) {
-			r.Get("/", server.GetBalanceHandler)
-			r.Post("/withdraw", server.WriteOffBonusHandler)
+			r.With(server.AuthMiddleware).Get("/", server.GetBalanceHandler)
+			r.With(server.AuthMiddleware).Post("/withdraw", server.WriteOffBonusHandler)
 		})
-		r.Get("/withdrawals", server.WriteOffBalanceHistoryHandler)
+		r.With(server.AuthMiddleware).Get("/withdrawals", server.WriteOffBalanceHistoryHandler)
 	})
 	srv := httptest.NewServer(r)
 
@@ -647,14 +692,8 @@ func TestWriteOffBalanceHistoryHandler(t *testing.T) {
 func TestUnloadHandler(t *testing.T) {
 
 	var server Server
-	server.Config.AccrualConfig.Set(*accrualAddr)
-	conn, err := pgxpool.New(context.Background(), *db)
-	if err != nil {
-		panic(err)
-	}
-
-	server.ConnStorage(&storage.DataBaseStorage{DB: conn})
-	defer conn.Close()
+	connTestAccrual(t, &server)
+	connTestStorage(t, &server)
 
 	if err := server.CreateTable(); err != nil {
 		panic(err)
@@ -664,7 +703,7 @@ func TestUnloadHandler(t *testing.T) {
 
 	r.Route("/api/user", func(r chi.Router) {
 		r.Post("/login", server.LoginHandler)
-		r.Get("/orders", server.UnloadHandler)
+		r.With(server.AuthMiddleware).Get("/orders", server.UnloadHandler)
 	})
 	srv := httptest.NewServer(r)
 
@@ -749,6 +788,1288 @@ func TestUnloadHandler(t *testing.T) {
 	}
 }
 
+func TestWriteOffBonusConcurrent(t *testing.T) {
+
+	var server Server
+	connTestAccrual(t, &server)
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Route("/api/user", func(r chi.Router) {
+		r.Post("/register", server.RegisterHandler)
+		r.With(server.AuthMiddleware).Post("/orders", server.UploadOrderHandler)
+		r.With(server.AuthMiddleware).Get("/balance", server.GetBalanceHandler)
+		r.With(server.AuthMiddleware).Post("/balance/withdraw", server.WriteOffBonusHandler)
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	respRegister, err := resty.New().R().
+		SetBody(`{"login": "concurrent", "password": "concurrentPass"}`).
+		Post(srv.URL + "/api/user/register")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, respRegister.StatusCode())
+	auth := respRegister.Header().Get("Authorization")
+
+	respUpload, err := resty.New().R().
+		SetHeader("Authorization", auth).
+		SetBody(luhnNumber("7000000001")).
+		Post(srv.URL + "/api/user/orders")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, respUpload.StatusCode())
+	// заглушка начисляет 500 баллов, этого хватает ровно на пять списаний по 100
+	processTestAccrualJobs(t, &server)
+
+	const requests = 10
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := resty.New().R().
+				SetHeader("Authorization", auth).
+				SetBody(fmt.Sprintf(`{"order": "%s", "sum": 100}`, luhnNumber(fmt.Sprintf("710000000%d", i)))).
+				Post(srv.URL + "/api/user/balance/withdraw")
+			if assert.NoError(t, err) {
+				codes <- resp.StatusCode()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	count := make(map[int]int)
+	for code := range codes {
+		count[code]++
+	}
+	assert.Equal(t, 5, count[http.StatusOK])
+	assert.Equal(t, 5, count[http.StatusPaymentRequired])
+
+	var balance struct {
+		Current  models.Points `json:"current"`
+		Withdraw models.Points `json:"withdrawn"`
+	}
+	_, err = resty.New().R().
+		SetHeader("Authorization", auth).
+		SetResult(&balance).
+		Get(srv.URL + "/api/user/balance")
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(0), balance.Current)
+	assert.Equal(t, 500*models.Point, balance.Withdraw)
+}
+
+func TestWriteOffIdempotency(t *testing.T) {
+
+	var server Server
+	connTestAccrual(t, &server)
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Route("/api/user", func(r chi.Router) {
+		r.Post("/register", server.RegisterHandler)
+		r.With(server.AuthMiddleware).Post("/orders", server.WithIdempotency(server.UploadOrderHandler))
+		r.With(server.AuthMiddleware).Get("/balance", server.GetBalanceHandler)
+		r.With(server.AuthMiddleware).Post("/balance/withdraw", server.WithIdempotency(server.WriteOffBonusHandler))
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	respRegister, err := resty.New().R().
+		SetBody(`{"login": "idempotent", "password": "idempotentPass"}`).
+		Post(srv.URL + "/api/user/register")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, respRegister.StatusCode())
+	auth := respRegister.Header().Get("Authorization")
+
+	respUpload, err := resty.New().R().
+		SetHeader("Authorization", auth).
+		SetHeader("Idempotency-Key", "upload-1").
+		SetBody(luhnNumber("7200000001")).
+		Post(srv.URL + "/api/user/orders")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, respUpload.StatusCode())
+	processTestAccrualJobs(t, &server)
+
+	withdrawBody := fmt.Sprintf(`{"order": "%s", "sum": 100}`, luhnNumber("7300000001"))
+
+	type want struct {
+		code     int
+		replayed string
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		body string
+		want want
+	}{
+		{
+			name: "Test idempotent withdraw #1",
+			key:  "withdraw-1",
+			body: withdrawBody,
+			want: want{code: http.StatusOK},
+		},
+		{
+			name: "Test idempotent withdraw #2 replay",
+			key:  "withdraw-1",
+			body: withdrawBody,
+			want: want{code: http.StatusOK, replayed: "true"},
+		},
+		{
+			name: "Test idempotent withdraw #3 key reused with other body",
+			key:  "withdraw-1",
+			body: fmt.Sprintf(`{"order": "%s", "sum": 50}`, luhnNumber("7300000002")),
+			want: want{code: http.StatusUnprocessableEntity},
+		},
+		{
+			name: "Test idempotent withdraw #4 same order without key",
+			body: withdrawBody,
+			want: want{code: http.StatusConflict},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := resty.New().R().
+				SetHeader("Authorization", auth).
+				SetBody(tt.body)
+			if tt.key != "" {
+				req.SetHeader("Idempotency-Key", tt.key)
+			}
+			resp, err := req.Post(srv.URL + "/api/user/balance/withdraw")
+			assert.NoError(t, err, "error making HTTP request")
+			assert.Equal(t, tt.want.code, resp.StatusCode())
+			assert.Equal(t, tt.want.replayed, resp.Header().Get("Idempotent-Replayed"))
+		})
+	}
+
+	var balance models.Balance
+	_, err = resty.New().R().
+		SetHeader("Authorization", auth).
+		SetResult(&balance).
+		Get(srv.URL + "/api/user/balance")
+	require.NoError(t, err)
+	assert.Equal(t, 400*models.Point, balance.Current)
+}
+
+func TestIdempotencyKeyReleasedOnPanic(t *testing.T) {
+
+	var server Server
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	uid, err := server.storage.InsertUser(context.Background(), "panicky", "hash", "bcrypt")
+	require.NoError(t, err)
+
+	calls := 0
+	handler := server.WithIdempotency(func(res http.ResponseWriter, req *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		res.WriteHeader(http.StatusOK)
+	})
+	call := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(`{}`))
+		req.Header.Set("Idempotency-Key", "panic-1")
+		req = req.WithContext(context.WithValue(req.Context(), userIDKey, uid))
+		res := httptest.NewRecorder()
+		handler(res, req)
+		return res
+	}
+
+	assert.Panics(t, func() { call() })
+	assert.Equal(t, http.StatusOK, call().Code, "key is released after panic")
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, "true", call().Header().Get("Idempotent-Replayed"))
+}
+
+func TestRefreshTokenHandler(t *testing.T) {
+
+	var server Server
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Route("/api/user", func(r chi.Router) {
+		r.Post("/register", server.RegisterHandler)
+		r.Post("/login", server.LoginHandler)
+		r.Post("/token/refresh", server.RefreshTokenHandler)
+		r.With(server.AuthMiddleware).Post("/logout", server.LogoutHandler)
+		r.With(server.AuthMiddleware).Get("/balance", server.GetBalanceHandler)
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	var first models.TokenPair
+	respRegister, err := resty.New().R().
+		SetBody(`{"login": "refresher", "password": "refresherPass"}`).
+		SetResult(&first).
+		Post(srv.URL + "/api/user/register")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, respRegister.StatusCode())
+	assert.Equal(t, respRegister.Header().Get("Authorization"), first.AccessToken)
+	assert.NotEmpty(t, first.RefreshToken)
+	assert.Equal(t, 900, first.ExpiresIn)
+
+	refresh := func(token string, result *models.TokenPair) int {
+		resp, err := resty.New().R().
+			SetBody(models.RefreshRequest{RefreshToken: token}).
+			SetResult(result).
+			Post(srv.URL + "/api/user/token/refresh")
+		require.NoError(t, err)
+		return resp.StatusCode()
+	}
+	balance := func(token string) int {
+		resp, err := resty.New().R().
+			SetHeader("Authorization", token).
+			Get(srv.URL + "/api/user/balance")
+		require.NoError(t, err)
+		return resp.StatusCode()
+	}
+
+	var second models.TokenPair
+	require.Equal(t, http.StatusOK, refresh(first.RefreshToken, &second))
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assert.Equal(t, http.StatusOK, balance(second.AccessToken))
+	assert.Equal(t, http.StatusUnauthorized, refresh("garbage", &models.TokenPair{}))
+
+	// повторное использование старого refresh токена отзывает сессию целиком
+	assert.Equal(t, http.StatusUnauthorized, refresh(first.RefreshToken, &models.TokenPair{}))
+	assert.Equal(t, http.StatusUnauthorized, refresh(second.RefreshToken, &models.TokenPair{}))
+	assert.Equal(t, http.StatusUnauthorized, balance(second.AccessToken))
+
+	var login models.TokenPair
+	respLogin, err := resty.New().R().
+		SetBody(`{"login": "refresher", "password": "refresherPass"}`).
+		SetResult(&login).
+		Post(srv.URL + "/api/user/login")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, respLogin.StatusCode())
+	assert.Equal(t, http.StatusOK, balance(login.AccessToken))
+
+	respLogout, err := resty.New().R().
+		SetHeader("Authorization", login.AccessToken).
+		Post(srv.URL + "/api/user/logout")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, respLogout.StatusCode())
+	assert.Equal(t, http.StatusUnauthorized, balance(login.AccessToken))
+	assert.Equal(t, http.StatusUnauthorized, refresh(login.RefreshToken, &models.TokenPair{}))
+}
+
+func TestLoginRehashPassword(t *testing.T) {
+
+	var server Server
+	server.Config.EnvValues.Password = config.PasswordConf{HashAlgo: hasher.AlgoBcrypt, BcryptCost: bcrypt.MinCost}
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Route("/api/user", func(r chi.Router) {
+		r.Post("/register", server.RegisterHandler)
+		r.Post("/login", server.LoginHandler)
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	body := `{"login": "rehash", "password": "rehashPass"}`
+	respRegister, err := resty.New().R().SetBody(body).Post(srv.URL + "/api/user/register")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, respRegister.StatusCode())
+
+	// переходим на argon2id: старый хеш должен обновиться при первом успешном входе
+	server.Config.EnvValues.Password = config.PasswordConf{HashAlgo: hasher.AlgoArgon2id, Argon2Memory: 1024}
+	respWrong, err := resty.New().R().SetBody(`{"login": "rehash", "password": "wrongPass"}`).Post(srv.URL + "/api/user/login")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, respWrong.StatusCode())
+	user, err := server.storage.GetUserByLogin(context.Background(), "rehash")
+	require.NoError(t, err)
+	assert.Equal(t, hasher.AlgoBcrypt, user.PasswordAlgo, "failed login must not touch the hash")
+
+	for i := 0; i < 2; i++ {
+		respLogin, err := resty.New().R().SetBody(body).Post(srv.URL + "/api/user/login")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, respLogin.StatusCode())
+	}
+	user, err = server.storage.GetUserByLogin(context.Background(), "rehash")
+	require.NoError(t, err)
+	assert.Equal(t, hasher.AlgoArgon2id, user.PasswordAlgo)
+	assert.True(t, strings.HasPrefix(user.PasswordHash, "$argon2id$"))
+}
+
+func TestLoginNotNormalizedLegacyLogin(t *testing.T) {
+
+	var server Server
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Route("/api/user", func(r chi.Router) {
+		r.Post("/register", server.RegisterHandler)
+		r.Post("/login", server.LoginHandler)
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	respRegister, err := resty.New().R().SetBody(`{"login": "legacy", "password": "legacyNewPass"}`).Post(srv.URL + "/api/user/register")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, respRegister.StatusCode())
+	newUID := tokenUID(&server, respRegister.Header().Get("Authorization"))
+
+	// так остается логин, который при миграции совпал бы с уже нормализованным
+	h, err := server.passwordHasher()
+	require.NoError(t, err)
+	pass, algo, err := h.Hash("legacyOldPass")
+	require.NoError(t, err)
+	oldUID, err := server.storage.InsertUser(context.Background(), "Legacy", pass, algo)
+	require.NoError(t, err)
+
+	login := func(body string) *resty.Response {
+		resp, err := resty.New().R().SetBody(body).Post(srv.URL + "/api/user/login")
+		require.NoError(t, err)
+		return resp
+	}
+	resp := login(`{"login": "Legacy", "password": "legacyOldPass"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, strconv.Itoa(oldUID), tokenUID(&server, resp.Header().Get("Authorization")))
+
+	resp = login(`{"login": "Legacy", "password": "legacyNewPass"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, newUID, tokenUID(&server, resp.Header().Get("Authorization")))
+
+	assert.Equal(t, http.StatusUnauthorized, login(`{"login": "legacy", "password": "legacyOldPass"}`).StatusCode())
+}
+
+func TestLoginLockout(t *testing.T) {
+
+	var server Server
+	server.Config.EnvValues.LoginLimit = config.LoginLimitConf{MaxFailures: 2, MaxIPFailures: 4, Lockout: time.Minute}
+	server.Config.EnvValues.Admin.Logins = "lockadmin"
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Post("/api/user/register", server.RegisterHandler)
+	r.Post("/api/user/login", server.LoginHandler)
+	r.With(server.AuthMiddleware, server.RequireRole(models.RoleAdmin)).Post("/api/admin/login/unlock", server.UnlockLoginHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	// неудачные входы из других тестов тоже пришли с 127.0.0.1
+	require.NoError(t, server.clearLoginFailures(loginScopeIP, "127.0.0.1"))
+
+	login := func(name string, password string) *resty.Response {
+		resp, err := resty.New().R().
+			SetBody(models.AuthModel{Login: name, Password: password}).
+			Post(srv.URL + "/api/user/login")
+		require.NoError(t, err)
+		return resp
+	}
+	unlock := func(token string, body models.LoginUnlock) int {
+		resp, err := resty.New().R().
+			SetHeader("Authorization", token).
+			SetBody(body).
+			Post(srv.URL + "/api/admin/login/unlock")
+		require.NoError(t, err)
+		return resp.StatusCode()
+	}
+
+	respRegister, err := resty.New().R().
+		SetBody(`{"login": "locked", "password": "lockedPass"}`).
+		Post(srv.URL + "/api/user/register")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, respRegister.StatusCode())
+	userToken := respRegister.Header().Get("Authorization")
+	respAdmin, err := resty.New().R().
+		SetBody(`{"login": "lockadmin", "password": "adminPass1"}`).
+		Post(srv.URL + "/api/user/register")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, respAdmin.StatusCode())
+	adminToken := respAdmin.Header().Get("Authorization")
+	require.NoError(t, server.PromoteAdmins())
+
+	assert.Equal(t, http.StatusUnauthorized, login("locked", "wrongPass").StatusCode())
+	assert.Equal(t, http.StatusUnauthorized, login("locked", "wrongPass").StatusCode())
+	resp := login("locked", "lockedPass")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode(), "correct password is rejected while locked")
+	assert.Equal(t, "60", resp.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusUnauthorized, unlock("", models.LoginUnlock{Login: "locked"}))
+	assert.Equal(t, http.StatusForbidden, unlock(userToken, models.LoginUnlock{Login: "locked"}))
+	assert.Equal(t, http.StatusOK, unlock(adminToken, models.LoginUnlock{Login: "locked"}))
+	assert.Equal(t, http.StatusOK, login("locked", "lockedPass").StatusCode())
+
+	// перебор разных логинов с одного адреса блокирует сам адрес
+	assert.Equal(t, http.StatusUnauthorized, login("ghost1", "wrongPass").StatusCode())
+	assert.Equal(t, http.StatusUnauthorized, login("ghost2", "wrongPass").StatusCode())
+	assert.Equal(t, http.StatusTooManyRequests, login("locked", "lockedPass").StatusCode())
+	assert.Equal(t, http.StatusOK, unlock(adminToken, models.LoginUnlock{IP: "127.0.0.1"}))
+	assert.Equal(t, http.StatusOK, login("locked", "lockedPass").StatusCode())
+}
+
+func TestAdminAPI(t *testing.T) {
+
+	var server Server
+	server.Config.EnvValues.Admin.Logins = "root,latecomer"
+	srv := newTestServer(t, &server, func(r chi.Router) {
+		r.Post("/api/user/register", server.RegisterHandler)
+		r.Post("/api/user/login", server.LoginHandler)
+		r.With(server.AuthMiddleware).Get("/api/user/balance", server.GetBalanceHandler)
+		r.Route("/api/admin", func(r chi.Router) {
+			r.Use(server.AuthMiddleware, server.RequireRole(models.RoleAdmin))
+			r.Get("/users", server.ListUsersHandler)
+			r.Get("/users/{id}/orders", server.AdminUserOrdersHandler)
+			r.Get("/users/{id}/withdrawals", server.AdminUserWithdrawalsHandler)
+			r.Get("/users/{id}/balance", server.AdminUserBalanceHandler)
+			r.Post("/users/{id}/block", server.BlockUserHandler)
+			r.Post("/users/{id}/unblock", server.UnblockUserHandler)
+		})
+	})
+
+	call := func(method string, token string, path string) *resty.Response {
+		resp, err := resty.New().R().
+			SetHeader("Authorization", token).
+			Execute(method, srv.URL+path)
+		require.NoError(t, err)
+		return resp
+	}
+
+	adminToken, adminID := registerTestUser(t, &server, srv.URL, "root")
+	require.NoError(t, server.PromoteAdmins())
+	userToken, userID := registerTestUser(t, &server, srv.URL, "customer")
+	// логин из ADMIN_LOGINS, зарегистрированный после старта, остается обычным пользователем
+	lateToken, _ := registerTestUser(t, &server, srv.URL, "latecomer")
+	userPath := "/api/admin/users/" + strconv.Itoa(userID)
+
+	assert.Equal(t, http.StatusForbidden, call(http.MethodGet, userToken, "/api/admin/users").StatusCode())
+
+	resp := call(http.MethodGet, adminToken, "/api/admin/users")
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	var users []models.UserInfo
+	require.NoError(t, json.Unmarshal(resp.Body(), &users))
+	roles := map[string]string{}
+	for _, u := range users {
+		roles[u.Login] = u.Role
+	}
+	assert.Equal(t, models.RoleAdmin, roles["root"])
+	assert.Equal(t, models.RoleUser, roles["customer"])
+	assert.Equal(t, models.RoleUser, roles["latecomer"])
+	assert.Equal(t, http.StatusForbidden, call(http.MethodGet, lateToken, "/api/admin/users").StatusCode())
+
+	resp = call(http.MethodGet, adminToken, "/api/admin/users?limit=1")
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.NoError(t, json.Unmarshal(resp.Body(), &users))
+	assert.Len(t, users, 1)
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodGet, adminToken, "/api/admin/users?limit=0").StatusCode())
+
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, adminToken, userPath+"/balance").StatusCode())
+	assert.Equal(t, http.StatusNoContent, call(http.MethodGet, adminToken, userPath+"/orders").StatusCode())
+	assert.Equal(t, http.StatusNoContent, call(http.MethodGet, adminToken, userPath+"/withdrawals").StatusCode())
+	assert.Equal(t, http.StatusNotFound, call(http.MethodGet, adminToken, "/api/admin/users/999999/balance").StatusCode())
+	assert.Equal(t, http.StatusConflict, call(http.MethodPost, adminToken, "/api/admin/users/"+strconv.Itoa(adminID)+"/block").StatusCode())
+
+	// блокировка отзывает сессии и запрещает вход
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, adminToken, userPath+"/block").StatusCode())
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, userToken, "/api/user/balance").StatusCode())
+	login := func() int {
+		resp, err := resty.New().R().
+			SetBody(models.AuthModel{Login: "customer", Password: "customerPass1"}).
+			Post(srv.URL + "/api/user/login")
+		require.NoError(t, err)
+		return resp.StatusCode()
+	}
+	assert.Equal(t, http.StatusForbidden, login())
+
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, adminToken, userPath+"/unblock").StatusCode())
+	assert.Equal(t, http.StatusOK, login())
+}
+
+func TestBalanceAdjustments(t *testing.T) {
+
+	var server Server
+	server.Config.EnvValues.Admin.Logins = "operator"
+	srv := newTestServer(t, &server, func(r chi.Router) {
+		r.Post("/api/user/register", server.RegisterHandler)
+		r.With(server.AuthMiddleware).Get("/api/user/balance", server.GetBalanceHandler)
+		r.With(server.AuthMiddleware).Get("/api/user/balance/history", server.BalanceHistoryHandler)
+		r.Route("/api/admin", func(r chi.Router) {
+			r.Use(server.AuthMiddleware, server.RequireRole(models.RoleAdmin))
+			r.Get("/users/{id}/adjustments", server.AdminUserAdjustmentsHandler)
+			r.Post("/users/{id}/adjustments", server.AdjustBalanceHandler)
+		})
+	})
+
+	adminToken, adminID := registerTestUser(t, &server, srv.URL, "operator")
+	require.NoError(t, server.PromoteAdmins())
+	userToken, userID := registerTestUser(t, &server, srv.URL, "holder")
+	path := srv.URL + "/api/admin/users/" + strconv.Itoa(userID) + "/adjustments"
+
+	adjust := func(token string, body string) *resty.Response {
+		resp, err := resty.New().R().
+			SetHeader("Authorization", token).
+			SetHeader("Content-Type", "application/json").
+			SetBody(body).
+			Post(path)
+		require.NoError(t, err)
+		return resp
+	}
+
+	assert.Equal(t, http.StatusForbidden, adjust(userToken, `{"amount": 100, "reason": "accrual_error"}`).StatusCode())
+	assert.Equal(t, http.StatusBadRequest, adjust(adminToken, `{"amount": 100}`).StatusCode())
+	assert.Equal(t, http.StatusBadRequest, adjust(adminToken, `{"amount": 0, "reason": "accrual_error"}`).StatusCode())
+	assert.Equal(t, http.StatusBadRequest, adjust(adminToken, `{"amount": 10, "reason": "other"}`).StatusCode())
+	assert.Equal(t, http.StatusPaymentRequired, adjust(adminToken, `{"amount": -1, "reason": "fraud"}`).StatusCode())
+
+	resp := adjust(adminToken, `{"amount": 100.5, "reason": "accrual_error", "comment": "missed accrual"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	var saved models.BalanceAdjustment
+	require.NoError(t, json.Unmarshal(resp.Body(), &saved))
+	assert.Equal(t, adminID, saved.OperatorID)
+	assert.Equal(t, userID, saved.UserID)
+	assert.Equal(t, models.Points(10050), saved.Amount)
+	require.Equal(t, http.StatusOK, adjust(adminToken, `{"amount": -0.5, "reason": "compensation"}`).StatusCode())
+
+	resp, err := resty.New().R().SetHeader("Authorization", userToken).Get(srv.URL + "/api/user/balance")
+	require.NoError(t, err)
+	var balance models.Balance
+	require.NoError(t, json.Unmarshal(resp.Body(), &balance))
+	assert.Equal(t, 100*models.Point, balance.Current)
+	assert.Equal(t, models.Points(0), balance.Withdraw, "adjustments are not withdrawals")
+
+	resp, err = resty.New().R().SetHeader("Authorization", userToken).Get(srv.URL + "/api/user/balance/history")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	var history []models.LedgerEntry
+	require.NoError(t, json.Unmarshal(resp.Body(), &history))
+	require.Len(t, history, 2)
+	assert.Equal(t, models.LedgerAdjustment, history[0].Kind)
+	assert.Equal(t, models.AdjustmentAccrualError, history[0].Reason)
+	assert.Equal(t, models.AdjustmentCompensation, history[1].Reason)
+
+	resp, err = resty.New().R().SetHeader("Authorization", adminToken).Get(path)
+	require.NoError(t, err)
+	var adjustments []models.BalanceAdjustment
+	require.NoError(t, json.Unmarshal(resp.Body(), &adjustments))
+	require.Len(t, adjustments, 2)
+	assert.Equal(t, "missed accrual", adjustments[0].Comment)
+
+	resp, err = resty.New().R().SetHeader("Authorization", adminToken).Get(srv.URL + "/api/user/balance/history")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	require.NoError(t, server.storage.AnonymizeUser(context.Background(), userID))
+	assert.Equal(t, http.StatusConflict, adjust(adminToken, `{"amount": 10, "reason": "compensation"}`).StatusCode(),
+		"deleted account balance is frozen")
+}
+
+func TestAPIKeys(t *testing.T) {
+
+	var server Server
+	server.Config.EnvValues.Admin.Logins = "keymaster"
+	srv := newTestServer(t, &server, func(r chi.Router) {
+		r.Post("/api/user/register", server.RegisterHandler)
+		r.With(server.WithAPIKey(models.ScopeOrdersWrite)).Post("/api/user/orders", server.UploadOrderHandler)
+		r.With(server.AuthMiddleware).Get("/api/user/orders", server.UnloadHandler)
+		r.Route("/api/admin/api-keys", func(r chi.Router) {
+			r.Use(server.AuthMiddleware, server.RequireRole(models.RoleAdmin))
+			r.Get("/", server.ListAPIKeysHandler)
+			r.Post("/", server.CreateAPIKeyHandler)
+			r.Delete("/{id}", server.RevokeAPIKeyHandler)
+		})
+	})
+
+	adminToken, _ := registerTestUser(t, &server, srv.URL, "keymaster")
+	require.NoError(t, server.PromoteAdmins())
+	userToken, userID := registerTestUser(t, &server, srv.URL, "shopper")
+
+	createKey := func(token string, body string) *resty.Response {
+		resp, err := resty.New().R().
+			SetHeader("Authorization", token).
+			SetHeader("Content-Type", "application/json").
+			SetBody(body).
+			Post(srv.URL + "/api/admin/api-keys")
+		require.NoError(t, err)
+		return resp
+	}
+	upload := func(key string, user string, number string) int {
+		resp, err := resty.New().R().
+			SetHeader(APIKeyHeader, key).
+			SetHeader(APIKeyUserHeader, user).
+			SetBody(number).
+			Post(srv.URL + "/api/user/orders")
+		require.NoError(t, err)
+		return resp.StatusCode()
+	}
+
+	assert.Equal(t, http.StatusForbidden, createKey(userToken, `{"name": "shop", "scopes": ["orders:write"]}`).StatusCode())
+	assert.Equal(t, http.StatusBadRequest, createKey(adminToken, `{"name": "shop", "scopes": ["orders:delete"]}`).StatusCode())
+	assert.Equal(t, http.StatusBadRequest, createKey(adminToken, `{"name": "", "scopes": ["orders:write"]}`).StatusCode())
+
+	resp := createKey(adminToken, `{"name": "shop", "scopes": ["orders:write"]}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode())
+	var created models.APIKeyCreated
+	require.NoError(t, json.Unmarshal(resp.Body(), &created))
+	require.NotEmpty(t, created.Key)
+	assert.True(t, strings.HasPrefix(created.Key, created.ID+"."))
+
+	user := strconv.Itoa(userID)
+	assert.Equal(t, http.StatusUnauthorized, upload(created.ID+".wrong", user, luhnNumber("7700001")))
+	assert.Equal(t, http.StatusBadRequest, upload(created.Key, "", luhnNumber("7700001")))
+	assert.Equal(t, http.StatusNotFound, upload(created.Key, "999999", luhnNumber("7700001")))
+	assert.Equal(t, http.StatusAccepted, upload(created.Key, user, luhnNumber("7700001")))
+
+	resp, err := resty.New().R().SetHeader("Authorization", userToken).Get(srv.URL + "/api/user/orders")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Contains(t, string(resp.Body()), luhnNumber("7700001"), "order is uploaded for the target user")
+
+	resp, err = resty.New().R().SetHeader("Authorization", adminToken).Get(srv.URL + "/api/admin/api-keys")
+	require.NoError(t, err)
+	var keys []models.APIKey
+	require.NoError(t, json.Unmarshal(resp.Body(), &keys))
+	require.Len(t, keys, 1)
+	assert.NotEmpty(t, keys[0].LastUsedAt)
+	assert.NotContains(t, string(resp.Body()), created.Key)
+
+	resp, err = resty.New().R().SetHeader("Authorization", adminToken).Delete(srv.URL + "/api/admin/api-keys/" + created.ID)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, http.StatusUnauthorized, upload(created.Key, user, luhnNumber("7700002")))
+
+	resp, err = resty.New().R().SetHeader("Authorization", adminToken).Delete(srv.URL + "/api/admin/api-keys/" + created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+
+	var server Server
+	server.Config.EnvValues.LoginLimit = config.LoginLimitConf{MaxFailures: maxLoginChallengeAttempts + 2, Lockout: time.Minute}
+	server.Config.EnvValues.TOTP.SecretKey = "totp-test-key"
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Route("/api/user", func(r chi.Router) {
+		r.Post("/register", server.RegisterHandler)
+		r.Post("/login", server.LoginHandler)
+		r.Post("/login/2fa", server.LoginSecondFactorHandler)
+		r.Group(func(r chi.Router) {
+			r.Use(server.AuthMiddleware)
+			r.Post("/2fa/enroll", server.TOTPEnrollHandler)
+			r.Post("/2fa/enable", server.TOTPEnableHandler)
+			r.Post("/2fa/disable", server.TOTPDisableHandler)
+		})
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	require.NoError(t, server.clearLoginFailures(loginScopeIP, "127.0.0.1"))
+
+	respRegister, err := resty.New().R().
+		SetBody(`{"login": "twofactor", "password": "twofactorPass1"}`).
+		Post(srv.URL + "/api/user/register")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, respRegister.StatusCode())
+	token := respRegister.Header().Get("Authorization")
+
+	post := func(path string, body any) *resty.Response {
+		resp, err := resty.New().R().
+			SetHeader("Authorization", token).
+			SetBody(body).
+			Post(srv.URL + path)
+		require.NoError(t, err)
+		return resp
+	}
+	login := func() *resty.Response {
+		resp, err := resty.New().R().
+			SetBody(`{"login": "twofactor", "password": "twofactorPass1"}`).
+			Post(srv.URL + "/api/user/login")
+		require.NoError(t, err)
+		return resp
+	}
+	challenge := func() string {
+		resp := login()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode())
+		assert.Empty(t, resp.Header().Get("Authorization"), "no tokens before the second factor")
+		var c models.LoginChallenge
+		require.NoError(t, json.Unmarshal(resp.Body(), &c))
+		require.NotEmpty(t, c.ChallengeToken)
+		return c.ChallengeToken
+	}
+	secondFactor := func(challengeToken string, code string) int {
+		return post("/api/user/login/2fa", models.LoginSecondFactor{ChallengeToken: challengeToken, Code: code}).StatusCode()
+	}
+
+	assert.Equal(t, http.StatusConflict, post("/api/user/2fa/enable", models.TOTPCode{Code: "123456"}).StatusCode())
+	resp := post("/api/user/2fa/enroll", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	var enrollment models.TOTPEnrollment
+	require.NoError(t, json.Unmarshal(resp.Body(), &enrollment))
+	assert.Contains(t, enrollment.URI, "otpauth://totp/")
+	user, err := server.storage.GetUserByLogin(context.Background(), "twofactor")
+	require.NoError(t, err)
+	stored, err := server.storage.GetTOTP(context.Background(), user.ID)
+	require.NoError(t, err)
+	assert.NotContains(t, stored.Secret, enrollment.Secret, "secret is encrypted at rest")
+	assert.Equal(t, http.StatusOK, login().StatusCode(), "second factor is off until confirmed")
+
+	now := time.Now()
+	code, err := totp.Code(enrollment.Secret, now)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, post("/api/user/2fa/enable", models.TOTPCode{Code: "000000x"}).StatusCode())
+	resp = post("/api/user/2fa/enable", models.TOTPCode{Code: code})
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	var recovery models.RecoveryCodes
+	require.NoError(t, json.Unmarshal(resp.Body(), &recovery))
+	require.Len(t, recovery.Codes, 10)
+	assert.Equal(t, http.StatusConflict, post("/api/user/2fa/enroll", nil).StatusCode())
+
+	c := challenge()
+	assert.Equal(t, http.StatusUnauthorized, secondFactor(c, code), "code used for enabling is not accepted again")
+	next, err := totp.Code(enrollment.Secret, now.Add(totp.Period*time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, secondFactor(c, next))
+	assert.Equal(t, http.StatusUnauthorized, secondFactor(c, next), "challenge is single use")
+
+	c = challenge()
+	assert.Equal(t, http.StatusOK, secondFactor(c, strings.ToUpper(recovery.Codes[0])))
+	c = challenge()
+	assert.Equal(t, http.StatusUnauthorized, secondFactor(c, recovery.Codes[0]), "recovery code is single use")
+
+	for i := 1; i < maxLoginChallengeAttempts; i++ {
+		assert.Equal(t, http.StatusUnauthorized, secondFactor(c, "wrong"))
+	}
+	assert.Equal(t, http.StatusUnauthorized, secondFactor(c, recovery.Codes[1]), "challenge is dropped after too many attempts")
+
+	// неверные коды копятся в блокировке входа, новый challenge счетчик не сбрасывает
+	c = challenge()
+	assert.Equal(t, http.StatusUnauthorized, secondFactor(c, "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, secondFactor(c, "wrong"))
+	assert.Equal(t, http.StatusTooManyRequests, secondFactor(c, recovery.Codes[1]))
+	assert.Equal(t, http.StatusTooManyRequests, login().StatusCode())
+	require.NoError(t, server.clearLoginFailures(loginScopeLogin, "twofactor"))
+
+	// через сессию пароль и коды подбираются с той же блокировкой
+	for i := 0; i < maxLoginChallengeAttempts+2; i++ {
+		assert.Equal(t, http.StatusForbidden, post("/api/user/2fa/disable", models.TOTPDisable{Password: "wrongPass", Code: recovery.Codes[1]}).StatusCode())
+	}
+	assert.Equal(t, http.StatusTooManyRequests, post("/api/user/2fa/disable", models.TOTPDisable{Password: "twofactorPass1", Code: recovery.Codes[1]}).StatusCode())
+	require.NoError(t, server.clearLoginFailures(loginScopeLogin, "twofactor"))
+	assert.Equal(t, http.StatusOK, post("/api/user/2fa/disable", models.TOTPDisable{Password: "twofactorPass1", Code: recovery.Codes[1]}).StatusCode())
+	assert.Equal(t, http.StatusOK, login().StatusCode())
+}
+
+func TestAccountExportAndDeletion(t *testing.T) {
+
+	var server Server
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Route("/api/user", func(r chi.Router) {
+		r.Post("/register", server.RegisterHandler)
+		r.Post("/login", server.LoginHandler)
+		r.Group(func(r chi.Router) {
+			r.Use(server.AuthMiddleware)
+			r.Get("/export", server.ExportHandler)
+			r.Delete("/", server.DeleteAccountHandler)
+		})
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	require.NoError(t, server.clearLoginFailures(loginScopeIP, "127.0.0.1"))
+
+	register := func() *resty.Response {
+		resp, err := resty.New().R().
+			SetBody(`{"login": "leaving", "password": "leavingPass1"}`).
+			Post(srv.URL + "/api/user/register")
+		require.NoError(t, err)
+		return resp
+	}
+	respRegister := register()
+	require.Equal(t, http.StatusOK, respRegister.StatusCode())
+	token := respRegister.Header().Get("Authorization")
+	userID, err := strconv.Atoi(tokenUID(&server, token))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	_, err = server.storage.InsertBalanceAdjustment(ctx, models.BalanceAdjustment{
+		UserID: userID, Amount: 10 * models.Point, Reason: models.AdjustmentCompensation, OperatorID: userID,
+	})
+	require.NoError(t, err)
+
+	resp, err := resty.New().R().SetHeader("Authorization", token).Get(srv.URL + "/api/user/export")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Contains(t, resp.Header().Get("Content-Disposition"), "attachment")
+	var export models.UserExport
+	require.NoError(t, json.Unmarshal(resp.Body(), &export))
+	assert.Equal(t, "leaving", export.Profile.Login)
+	assert.Equal(t, 10*models.Point, export.Balance.Current)
+	assert.NotNil(t, export.Orders)
+	assert.Empty(t, export.Orders)
+	assert.Len(t, export.History, 1)
+
+	deleteAccount := func(password string) int {
+		resp, err := resty.New().R().
+			SetHeader("Authorization", token).
+			SetBody(models.AccountDeletion{Password: password}).
+			Delete(srv.URL + "/api/user")
+		require.NoError(t, err)
+		return resp.StatusCode()
+	}
+	assert.Equal(t, http.StatusForbidden, deleteAccount("wrongPass"))
+	assert.Equal(t, http.StatusOK, deleteAccount("leavingPass1"))
+	assert.Equal(t, http.StatusUnauthorized, deleteAccount("leavingPass1"), "sessions are revoked")
+
+	resp, err = resty.New().R().
+		SetBody(`{"login": "leaving", "password": "leavingPass1"}`).
+		Post(srv.URL + "/api/user/login")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	user, err := server.getUserByID(userID)
+	require.NoError(t, err)
+	assert.True(t, user.Deleted)
+	assert.NotEqual(t, "leaving", user.Login)
+	history, err := server.storage.GetLedger(ctx, userID)
+	require.NoError(t, err)
+	assert.Len(t, history, 1, "financial records are kept")
+
+	assert.Equal(t, http.StatusOK, register().StatusCode(), "login is free again")
+}
+
+func TestOrdersPagination(t *testing.T) {
+
+	var server Server
+	srv := newTestServer(t, &server, func(r chi.Router) {
+		r.Post("/api/user/register", server.RegisterHandler)
+		r.With(server.AuthMiddleware).Get("/api/user/orders", server.UnloadHandler)
+	})
+
+	token, userID := registerTestUser(t, &server, srv.URL, "pager")
+
+	ctx := context.Background()
+	var numbers []string
+	for i := 0; i < 5; i++ {
+		number := luhnNumber("99100" + strconv.Itoa(i))
+		numbers = append(numbers, number)
+		require.NoError(t, server.storage.InsertOrder(ctx, userID, number))
+	}
+	for _, number := range numbers[:2] {
+		require.NoError(t, server.storage.UpdateByAccrual(ctx, models.AccrualModel{
+			OrderNumber: number, Status: models.OrderStatusProcessed, Accrual: models.Point,
+		}, userID))
+	}
+
+	list := func(query string) ([]string, *resty.Response) {
+		resp, err := resty.New().R().SetHeader("Authorization", token).Get(srv.URL + "/api/user/orders" + query)
+		require.NoError(t, err)
+		var orders []models.Order
+		if resp.StatusCode() == http.StatusOK {
+			require.NoError(t, json.Unmarshal(resp.Body(), &orders))
+		}
+		var got []string
+		for _, o := range orders {
+			got = append(got, o.Number)
+		}
+		return got, resp
+	}
+
+	all, resp := list("")
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, numbers, all, "no params return the first page")
+	assert.Equal(t, "5", resp.Header().Get(TotalCountHeader))
+	assert.Empty(t, resp.Header().Get(NextCursorHeader))
+
+	var paged []string
+	query := "?limit=2"
+	for pages := 0; query != ""; pages++ {
+		require.Less(t, pages, 5)
+		got, resp := list(query)
+		require.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.Equal(t, "5", resp.Header().Get(TotalCountHeader))
+		paged = append(paged, got...)
+		query = ""
+		if next := resp.Header().Get(NextCursorHeader); next != "" {
+			query = "?limit=2&cursor=" + next
+		}
+	}
+	assert.Equal(t, numbers, paged)
+
+	desc, _ := list("?sort=desc&limit=3")
+	assert.Equal(t, []string{numbers[4], numbers[3], numbers[2]}, desc)
+
+	processed, resp := list("?status=processed")
+	assert.Equal(t, numbers[:2], processed)
+	assert.Equal(t, "2", resp.Header().Get(TotalCountHeader))
+	assert.Empty(t, resp.Header().Get(NextCursorHeader))
+
+	from := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	_, resp = list("?from=" + from)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	assert.Equal(t, "0", resp.Header().Get(TotalCountHeader))
+
+	for _, bad := range []string{"?limit=0", "?status=LOST", "?sort=up", "?cursor=%21", "?from=yesterday"} {
+		_, resp = list(bad)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode(), bad)
+	}
+}
+
+func TestWithdrawalsPagination(t *testing.T) {
+
+	var server Server
+	srv := newTestServer(t, &server, func(r chi.Router) {
+		r.Post("/api/user/register", server.RegisterHandler)
+		r.With(server.AuthMiddleware).Get("/api/user/withdrawals", server.WriteOffBalanceHistoryHandler)
+	})
+
+	token, userID := registerTestUser(t, &server, srv.URL, "spender")
+
+	ctx := context.Background()
+	_, err := server.storage.InsertBalanceAdjustment(ctx, models.BalanceAdjustment{
+		UserID: userID, Amount: 100 * models.Point, Reason: models.AdjustmentCompensation, OperatorID: userID,
+	})
+	require.NoError(t, err)
+	var numbers []string
+	for i := 0; i < 5; i++ {
+		number := luhnNumber("99200" + strconv.Itoa(i))
+		numbers = append(numbers, number)
+		require.NoError(t, server.storage.InsertWriteOffBonuces(ctx, models.Withdraw{
+			Order: number, Sum: models.Points(i+1) * models.Point,
+		}, userID))
+	}
+
+	list := func(query string) ([]string, *resty.Response) {
+		resp, err := resty.New().R().SetHeader("Authorization", token).Get(srv.URL + "/api/user/withdrawals" + query)
+		require.NoError(t, err)
+		var withdrawals []models.WithdrawInfo
+		if resp.StatusCode() == http.StatusOK {
+			require.NoError(t, json.Unmarshal(resp.Body(), &withdrawals))
+		}
+		var got []string
+		for _, w := range withdrawals {
+			got = append(got, w.Order)
+		}
+		return got, resp
+	}
+
+	all, resp := list("")
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, numbers, all, "no params return the first page")
+	assert.Equal(t, "5", resp.Header().Get(TotalCountHeader))
+	assert.Equal(t, "15", resp.Header().Get(TotalSumHeader))
+	assert.Empty(t, resp.Header().Get(NextCursorHeader))
+
+	var paged []string
+	query := "?limit=2"
+	for pages := 0; query != ""; pages++ {
+		require.Less(t, pages, 5)
+		got, resp := list(query)
+		require.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.Equal(t, "5", resp.Header().Get(TotalCountHeader))
+		assert.Equal(t, "15", resp.Header().Get(TotalSumHeader))
+		paged = append(paged, got...)
+		query = ""
+		if next := resp.Header().Get(NextCursorHeader); next != "" {
+			query = "?limit=2&cursor=" + next
+		}
+	}
+	assert.Equal(t, numbers, paged)
+
+	desc, _ := list("?sort=desc&limit=2")
+	assert.Equal(t, []string{numbers[4], numbers[3]}, desc)
+
+	from := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	_, resp = list("?from=" + from)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	assert.Equal(t, "0", resp.Header().Get(TotalCountHeader))
+	assert.Equal(t, "0", resp.Header().Get(TotalSumHeader))
+
+	for _, bad := range []string{"?limit=0", "?sort=up", "?cursor=%21", "?to=tomorrow"} {
+		_, resp = list(bad)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode(), bad)
+	}
+}
+
+func TestGetOrderHandler(t *testing.T) {
+
+	var server Server
+	srv := newTestServer(t, &server, func(r chi.Router) {
+		r.Post("/api/user/register", server.RegisterHandler)
+		r.With(server.AuthMiddleware).Get("/api/user/orders/{number}", server.GetOrderHandler)
+	})
+
+	owner, userID := registerTestUser(t, &server, srv.URL, "lookupowner")
+	stranger, _ := registerTestUser(t, &server, srv.URL, "lookupstranger")
+
+	ctx := context.Background()
+	number := luhnNumber("993001")
+	require.NoError(t, server.storage.InsertOrder(ctx, userID, number))
+	require.NoError(t, server.storage.UpdateByAccrual(ctx, models.AccrualModel{
+		OrderNumber: number, Status: models.OrderStatusProcessed, Accrual: 5 * models.Point,
+	}, userID))
+
+	get := func(token string, number string) *resty.Response {
+		resp, err := resty.New().R().SetHeader("Authorization", token).Get(srv.URL + "/api/user/orders/" + number)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get(owner, number)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	var order models.OrderDetails
+	require.NoError(t, json.Unmarshal(resp.Body(), &order))
+	assert.Equal(t, number, order.Number)
+	assert.Equal(t, models.OrderStatusProcessed, order.Status)
+	assert.Equal(t, 5*models.Point, order.Accrual)
+	assert.NotEmpty(t, order.UploadedAt)
+	assert.NotEmpty(t, order.UpdatedAt)
+
+	assert.Equal(t, http.StatusForbidden, get(stranger, number).StatusCode())
+	assert.Equal(t, http.StatusNotFound, get(owner, luhnNumber("993002")).StatusCode())
+	assert.Equal(t, http.StatusUnprocessableEntity, get(owner, "12345").StatusCode())
+}
+
+func TestClientIP(t *testing.T) {
+	var server Server
+	request := func(remote string, forwarded string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/login", nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return req
+	}
+
+	assert.Equal(t, "10.0.0.5", server.clientIP(request("10.0.0.5:4000", "203.0.113.7")), "header is ignored by default")
+
+	server.Config.EnvValues.LoginLimit.TrustedProxies = "10.0.0.0/8, 192.168.1.1"
+	assert.Equal(t, "203.0.113.7", server.clientIP(request("10.0.0.5:4000", "203.0.113.7")))
+	assert.Equal(t, "203.0.113.7", server.clientIP(request("10.0.0.5:4000", "198.51.100.1, 203.0.113.7, 192.168.1.1")),
+		"spoofed left entries are skipped")
+	assert.Equal(t, "198.51.100.9", server.clientIP(request("198.51.100.9:4000", "203.0.113.7")), "untrusted peer")
+	assert.Equal(t, "10.0.0.5", server.clientIP(request("10.0.0.5:4000", "")))
+}
+
+func TestRegisterValidation(t *testing.T) {
+
+	var server Server
+	connTestStorage(t, &server)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Post("/api/user/register", server.RegisterHandler)
+	r.Post("/api/user/login", server.LoginHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	type want struct {
+		code   int
+		fields []string
+	}
+	tests := []struct {
+		name    string
+		request string
+		auth    models.AuthModel
+		want    want
+	}{
+		{
+			name:    "Test validation #1 empty fields",
+			request: "/api/user/register",
+			auth:    models.AuthModel{},
+			want:    want{code: http.StatusBadRequest, fields: []string{"login", "password", "password"}},
+		},
+		{
+			name:    "Test validation #2 weak password and bad charset",
+			request: "/api/user/register",
+			auth:    models.AuthModel{Login: "bad login", Password: "password"},
+			want:    want{code: http.StatusBadRequest, fields: []string{"login", "password"}},
+		},
+		{
+			name:    "Test validation #3 password equals login",
+			request: "/api/user/register",
+			auth:    models.AuthModel{Login: "sameuser1", Password: "SameUser1"},
+			want:    want{code: http.StatusBadRequest, fields: []string{"password"}},
+		},
+		{
+			name:    "Test validation #4 login is normalised",
+			request: "/api/user/register",
+			auth:    models.AuthModel{Login: "  Norm.User  ", Password: "normPass1"},
+			want:    want{code: http.StatusOK},
+		},
+		{
+			name:    "Test validation #5 case variant collides",
+			request: "/api/user/register",
+			auth:    models.AuthModel{Login: "NORM.USER", Password: "normPass1"},
+			want:    want{code: http.StatusConflict},
+		},
+		{
+			name:    "Test validation #6 login with other case",
+			request: "/api/user/login",
+			auth:    models.AuthModel{Login: "norm.user ", Password: "normPass1"},
+			want:    want{code: http.StatusOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result models.ValidationErrors
+			resp, err := resty.New().R().
+				SetBody(tt.auth).
+				SetError(&result).
+				Post(srv.URL + tt.request)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.code, resp.StatusCode())
+			var fields []string
+			for _, e := range result.Errors {
+				assert.NotEmpty(t, e.Message)
+				fields = append(fields, e.Field)
+			}
+			assert.Equal(t, tt.want.fields, fields)
+		})
+	}
+}
+
+type testNotifier struct {
+	mu       sync.Mutex
+	messages []notifier.Message
+}
+
+func (n *testNotifier) Notify(ctx context.Context, msg notifier.Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, msg)
+	return nil
+}
+
+func (n *testNotifier) sent() []notifier.Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]notifier.Message(nil), n.messages...)
+}
+
+func TestPasswordChangeAndReset(t *testing.T) {
+
+	var server Server
+	connTestStorage(t, &server)
+	sink := &testNotifier{}
+	server.ConnNotifier(sink)
+
+	err := server.CreateTable()
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+
+	r.Route("/api/user", func(r chi.Router) {
+		r.Post("/register", server.RegisterHandler)
+		r.Post("/login", server.LoginHandler)
+		r.Post("/password/reset", server.PasswordResetHandler)
+		r.Post("/password/reset/confirm", server.PasswordResetConfirmHandler)
+		r.With(server.AuthMiddleware).Post("/password", server.ChangePasswordHandler)
+		r.With(server.AuthMiddleware).Get("/balance", server.GetBalanceHandler)
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	post := func(path string, token string, body interface{}) int {
+		req := resty.New().R().SetBody(body)
+		if token != "" {
+			req.SetHeader("Authorization", token)
+		}
+		resp, err := req.Post(srv.URL + path)
+		require.NoError(t, err)
+		return resp.StatusCode()
+	}
+	login := func(password string) string {
+		resp, err := resty.New().R().
+			SetBody(models.AuthModel{Login: "passwords", Password: password}).
+			Post(srv.URL + "/api/user/login")
+		require.NoError(t, err)
+		return resp.Header().Get("Authorization")
+	}
+	balance := func(token string) int {
+		resp, err := resty.New().R().
+			SetHeader("Authorization", token).
+			Get(srv.URL + "/api/user/balance")
+		require.NoError(t, err)
+		return resp.StatusCode()
+	}
+
+	require.Equal(t, http.StatusOK, post("/api/user/register", "", `{"login": "passwords", "password": "firstPass"}`))
+	current := login("firstPass")
+	other := login("firstPass")
+	require.NotEmpty(t, other)
+
+	assert.Equal(t, http.StatusForbidden, post("/api/user/password", current,
+		models.PasswordChange{CurrentPassword: "wrongPass", NewPassword: "secondPass"}))
+	assert.Equal(t, http.StatusOK, post("/api/user/password", current,
+		models.PasswordChange{CurrentPassword: "firstPass", NewPassword: "secondPass"}))
+	assert.Equal(t, http.StatusOK, balance(current), "session that changed password stays active")
+	assert.Equal(t, http.StatusUnauthorized, balance(other), "other sessions are revoked")
+	assert.Empty(t, login("firstPass"))
+	assert.NotEmpty(t, login("secondPass"))
+
+	// токен отправляется после ответа, поэтому письма ждем
+	assert.Equal(t, http.StatusAccepted, post("/api/user/password/reset", "", models.PasswordResetRequest{Login: "nobody"}))
+	assert.Equal(t, http.StatusAccepted, post("/api/user/password/reset", "", models.PasswordResetRequest{Login: "passwords"}))
+	require.Eventually(t, func() bool { return len(sink.sent()) > 0 }, 5*time.Second, 10*time.Millisecond)
+	messages := sink.sent()
+	require.Len(t, messages, 1, "unknown login gets no message")
+	assert.Equal(t, "passwords", messages[0].To)
+	token := messages[0].Body[strings.LastIndex(messages[0].Body, " ")+1:]
+
+	assert.Equal(t, http.StatusBadRequest, post("/api/user/password/reset/confirm", "",
+		models.PasswordResetConfirm{Token: "wrong", NewPassword: "thirdPass"}))
+	assert.Equal(t, http.StatusOK, post("/api/user/password/reset/confirm", "",
+		models.PasswordResetConfirm{Token: token, NewPassword: "thirdPass"}))
+	assert.Equal(t, http.StatusBadRequest, post("/api/user/password/reset/confirm", "",
+		models.PasswordResetConfirm{Token: token, NewPassword: "fourthPass"}), "reset token is single use")
+	assert.Equal(t, http.StatusUnauthorized, balance(current), "reset revokes every session")
+	assert.Empty(t, login("secondPass"))
+	assert.NotEmpty(t, login("thirdPass"))
+}
+
+// luhnNumber дописывает к префиксу контрольную цифру по алгоритму Луна.
+func luhnNumber(prefix string) string {
+	for digit := 0; digit <= 9; digit++ {
+		number := prefix + strconv.Itoa(digit)
+		if orderNumberValid(number) {
+			return number
+		}
+	}
+	return prefix
+}
+
 // var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 // func randSeq(n int) string {
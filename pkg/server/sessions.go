@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+func (s *Server) RefreshTokenHandler(res http.ResponseWriter, req *http.Request) {
+	var body models.RefreshRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	refreshToken := body.RefreshToken
+	if cookie, err := req.Cookie(RefreshCookieName); err == nil && refreshToken == "" {
+		if !csrfValid(req) {
+			http.Error(res, "Неверный CSRF токен", http.StatusForbidden)
+			return
+		}
+		refreshToken = cookie.Value
+	}
+	if refreshToken == "" {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.rotateTokens(refreshToken)
+	if err != nil {
+		if errors.Is(err, errInvalidRefreshToken) {
+			if s.cookieMode() {
+				s.clearAuthCookies(res)
+			}
+			http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+			return
+		}
+		logger.Log.Error("Refresh token error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	s.writeTokenPair(res, tokens)
+}
+
+func (s *Server) LogoutHandler(res http.ResponseWriter, req *http.Request) {
+	sessionID := sessionIDFromContext(req.Context())
+	if sessionID == "" {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	if err := s.revokeSession(sessionID); err != nil {
+		logger.Log.Error("Revoke session error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if s.cookieMode() {
+		s.clearAuthCookies(res)
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+// writeTokens открывает новую сессию пользователя и отдает токены
+// в заголовке Authorization и в теле ответа.
+func (s *Server) writeTokens(res http.ResponseWriter, uid int) {
+	tokens, err := s.createSession(uid)
+	if err != nil {
+		logger.Log.Error("Create session error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	s.writeTokenPair(res, tokens)
+}
+
+func (s *Server) writeTokenPair(res http.ResponseWriter, tokens models.TokenPair) {
+	if s.cookieMode() {
+		if err := s.setAuthCookies(res, &tokens); err != nil {
+			logger.Log.Error("Cannot set auth cookies", zap.Error(err))
+			http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+	}
+	resp, err := json.Marshal(tokens)
+	if err != nil {
+		logger.Log.Error("Cannot encode tokens", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Add("Authorization", tokens.AccessToken)
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusOK)
+	res.Write(resp)
+}
+
+func (s *Server) createSession(userID int) (models.TokenPair, error) {
+	secret, err := newSecretToken()
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	session := models.Session{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		RefreshHash: hashSecretToken(secret),
+		ExpiresAt:   time.Now().Add(s.refreshTTL()),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.storage.CreateSession(ctx, session); err != nil {
+		return models.TokenPair{}, err
+	}
+	return s.tokenPair(userID, session.ID, secret)
+}
+
+// rotateTokens выдает новую пару токенов по refresh токену вида <sid>.<secret>.
+// Старый refresh токен после этого недействителен; если его предъявят снова,
+// считаем, что он украден, и отзываем всю сессию.
+func (s *Server) rotateTokens(refreshToken string) (models.TokenPair, error) {
+	sessionID, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok || sessionID == "" || secret == "" {
+		return models.TokenPair{}, errInvalidRefreshToken
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	session, err := s.storage.GetSession(ctx, sessionID)
+	if err != nil {
+		if errors.Is(err, errorsstorage.ErrSessionNotExist) {
+			return models.TokenPair{}, errInvalidRefreshToken
+		}
+		return models.TokenPair{}, err
+	}
+
+	newSecret, err := newSecretToken()
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	err = s.storage.RotateSession(ctx, sessionID, hashSecretToken(secret), hashSecretToken(newSecret), time.Now().Add(s.refreshTTL()))
+	if err != nil {
+		if errors.Is(err, errorsstorage.ErrSessionNotExist) {
+			logger.Log.Warn("Refresh token reuse detected, revoking session", zap.String("sid", sessionID))
+			if err := s.storage.RevokeSession(ctx, sessionID); err != nil {
+				return models.TokenPair{}, err
+			}
+			return models.TokenPair{}, errInvalidRefreshToken
+		}
+		return models.TokenPair{}, err
+	}
+	return s.tokenPair(session.UserID, sessionID, newSecret)
+}
+
+func (s *Server) tokenPair(userID int, sessionID string, secret string) (models.TokenPair, error) {
+	access, err := s.createJWTToken(strconv.Itoa(userID), sessionID)
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	return models.TokenPair{
+		AccessToken:  access,
+		RefreshToken: sessionID + "." + secret,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.jwtTTL().Seconds()),
+	}, nil
+}
+
+func (s *Server) getSession(sessionID string) (models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.storage.GetSession(ctx, sessionID)
+}
+
+func (s *Server) revokeSession(sessionID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.storage.RevokeSession(ctx, sessionID)
+}
+
+func newSecretToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func hashSecretToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
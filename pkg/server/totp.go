@@ -0,0 +1,441 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/Dorrrke/loyality-system.git/pkg/totp"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTOTPIssuer         = "Gophermart"
+	defaultLoginChallengeTTL  = 5 * time.Minute
+	maxLoginChallengeAttempts = 5
+	recoveryCodesCount        = 10
+	// допускаем расхождение часов клиента на один интервал в обе стороны
+	totpSkew = 1
+	// зашифрованный секрет отличается от base32 секрета префиксом
+	totpSealedPrefix = "aesgcm:"
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollHandler выдает новый секрет и otpauth URI для QR-кода. Второй фактор
+// начинает действовать только после подтверждения кодом в TOTPEnableHandler.
+func (s *Server) TOTPEnrollHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	user, err := s.getUserByID(userID)
+	if err != nil {
+		logger.Log.Error("Get user error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	current, err := s.getTOTP(userID)
+	if err != nil && !errors.Is(err, errorsstorage.ErrTOTPNotExist) {
+		logger.Log.Error("Get totp error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if current.Enabled {
+		http.Error(res, "Двухфакторная аутентификация уже включена", http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		logger.Log.Error("Generate totp secret error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	sealed, err := s.sealTOTPSecret(secret)
+	if err != nil {
+		logger.Log.Error("Encrypt totp secret error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.storage.SaveTOTPSecret(ctx, userID, sealed); err != nil {
+		logger.Log.Error("Save totp secret error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Cache-Control", "no-store")
+	writeJSON(res, models.TOTPEnrollment{
+		Secret: secret,
+		URI:    totp.ProvisioningURI(s.totpIssuer(), user.Login, secret),
+	})
+}
+
+// TOTPEnableHandler включает второй фактор по коду из приложения и отдает коды восстановления.
+func (s *Server) TOTPEnableHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	var body models.TOTPCode
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Code == "" {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	current, err := s.getTOTP(userID)
+	if err != nil {
+		if errors.Is(err, errorsstorage.ErrTOTPNotExist) {
+			http.Error(res, "Сначала получите секрет через /api/user/2fa/enroll", http.StatusConflict)
+			return
+		}
+		logger.Log.Error("Get totp error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if current.Enabled {
+		http.Error(res, "Двухфакторная аутентификация уже включена", http.StatusConflict)
+		return
+	}
+	step, ok := totp.Verify(current.Secret, strings.TrimSpace(body.Code), time.Now(), totpSkew)
+	if !ok {
+		http.Error(res, "Неверный код", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		logger.Log.Error("Generate recovery codes error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.storage.EnableTOTP(ctx, userID, step, hashes); err != nil {
+		logger.Log.Error("Enable totp error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	logger.Log.Info("TOTP enabled", zap.Int("uid", userID))
+	res.Header().Set("Cache-Control", "no-store")
+	writeJSON(res, models.RecoveryCodes{Codes: codes})
+}
+
+// TOTPDisableHandler выключает второй фактор; нужен пароль и код или код восстановления.
+func (s *Server) TOTPDisableHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := UserIDFromContext(req.Context())
+	if !ok {
+		http.Error(res, "Пользователь не авторизован", http.StatusUnauthorized)
+		return
+	}
+	var body models.TOTPDisable
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Code == "" {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	user, err := s.getUserByID(userID)
+	if err != nil {
+		logger.Log.Error("Get user error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	// Подбор пароля и кодов через чужую сессию ограничивается той же блокировкой, что и вход
+	ip := s.clientIP(req)
+	wait, err := s.loginRetryAfter(user.Login, ip)
+	if err != nil {
+		logger.Log.Error("Check login lock error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeRetryAfter(res, wait)
+		return
+	}
+	if !s.matchPasswords(body.Password, user) {
+		s.recordLoginFailure(user.Login, ip)
+		http.Error(res, "Неверный пароль", http.StatusForbidden)
+		return
+	}
+	current, err := s.getTOTP(userID)
+	if err != nil && !errors.Is(err, errorsstorage.ErrTOTPNotExist) {
+		logger.Log.Error("Get totp error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !current.Enabled {
+		http.Error(res, "Двухфакторная аутентификация не включена", http.StatusConflict)
+		return
+	}
+	ok, err = s.checkSecondFactor(current, body.Code)
+	if err != nil {
+		logger.Log.Error("Check second factor error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		s.recordLoginFailure(user.Login, ip)
+		http.Error(res, "Неверный код", http.StatusForbidden)
+		return
+	}
+	if err := s.disableTOTP(userID); err != nil {
+		logger.Log.Error("Disable totp error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	logger.Log.Info("TOTP disabled", zap.Int("uid", userID))
+	res.WriteHeader(http.StatusOK)
+}
+
+// LoginSecondFactorHandler завершает вход: обменивает challenge токен и код на пару токенов.
+func (s *Server) LoginSecondFactorHandler(res http.ResponseWriter, req *http.Request) {
+	var body models.LoginSecondFactor
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.ChallengeToken == "" || body.Code == "" {
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	challengeHash := hashSecretToken(body.ChallengeToken)
+	userID, err := s.storage.ReserveLoginChallengeAttempt(ctx, challengeHash, maxLoginChallengeAttempts)
+	if err != nil {
+		if errors.Is(err, errorsstorage.ErrChallengeNotExist) {
+			http.Error(res, "Недействительный токен входа", http.StatusUnauthorized)
+			return
+		}
+		logger.Log.Error("Reserve login challenge attempt error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	user, err := s.getUserByID(userID)
+	if err != nil {
+		logger.Log.Error("Get user error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if user.Blocked {
+		http.Error(res, "Аккаунт заблокирован", http.StatusForbidden)
+		return
+	}
+	// Неверные коды считаются вместе с неверными паролями, иначе повторный вход по паролю
+	// давал бы новый challenge с новыми попытками
+	ip := s.clientIP(req)
+	wait, err := s.loginRetryAfter(user.Login, ip)
+	if err != nil {
+		logger.Log.Error("Check login lock error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeRetryAfter(res, wait)
+		return
+	}
+	current, err := s.getTOTP(userID)
+	if err != nil && !errors.Is(err, errorsstorage.ErrTOTPNotExist) {
+		logger.Log.Error("Get totp error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	ok := false
+	if current.Enabled {
+		ok, err = s.checkSecondFactor(current, body.Code)
+		if err != nil {
+			logger.Log.Error("Check second factor error", zap.Error(err))
+			http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !ok {
+		s.recordLoginFailure(user.Login, ip)
+		http.Error(res, "Неверный код", http.StatusUnauthorized)
+		return
+	}
+	if err := s.storage.DeleteLoginChallenge(ctx, challengeHash); err != nil {
+		logger.Log.Error("Delete login challenge error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if err := s.clearLoginFailures(loginScopeLogin, user.Login); err != nil {
+		logger.Log.Error("Clear login failures error", zap.Error(err))
+	}
+	s.writeTokens(res, userID)
+}
+
+// AdminDisableTOTPHandler сбрасывает второй фактор пользователю, потерявшему и устройство, и коды восстановления.
+func (s *Server) AdminDisableTOTPHandler(res http.ResponseWriter, req *http.Request) {
+	userID, ok := s.adminTargetUser(res, req)
+	if !ok {
+		return
+	}
+	if err := s.disableTOTP(userID); err != nil {
+		logger.Log.Error("Disable totp error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	logger.Log.Info("TOTP disabled by admin", zap.Int("uid", userID))
+	res.WriteHeader(http.StatusOK)
+}
+
+// writeLoginChallenge вместо токенов отдает challenge, если у пользователя включен второй фактор.
+// Возвращает true, если ответ уже записан.
+func (s *Server) writeLoginChallenge(res http.ResponseWriter, userID int) bool {
+	current, err := s.getTOTP(userID)
+	if errors.Is(err, errorsstorage.ErrTOTPNotExist) || (err == nil && !current.Enabled) {
+		return false
+	}
+	if err != nil {
+		logger.Log.Error("Get totp error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return true
+	}
+	token, err := newSecretToken()
+	if err != nil {
+		logger.Log.Error("Generate login challenge error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return true
+	}
+	ttl := s.loginChallengeTTL()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.storage.CreateLoginChallenge(ctx, hashSecretToken(token), userID, time.Now().Add(ttl)); err != nil {
+		logger.Log.Error("Create login challenge error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return true
+	}
+	resp, err := json.Marshal(models.LoginChallenge{ChallengeToken: token, ExpiresIn: int(ttl.Seconds())})
+	if err != nil {
+		logger.Log.Error("Encode login challenge error", zap.Error(err))
+		http.Error(res, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return true
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusAccepted)
+	res.Write(resp)
+	return true
+}
+
+// checkSecondFactor принимает код из приложения (каждый не более одного раза)
+// или одноразовый код восстановления.
+func (s *Server) checkSecondFactor(current models.TOTP, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if step, ok := totp.Verify(current.Secret, code, time.Now(), totpSkew); ok {
+		return s.storage.UseTOTPStep(ctx, current.UserID, step)
+	}
+	return s.storage.UseRecoveryCode(ctx, current.UserID, hashSecretToken(normalizeRecoveryCode(code)))
+}
+
+func (s *Server) getTOTP(userID int) (models.TOTP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	current, err := s.storage.GetTOTP(ctx, userID)
+	if err != nil {
+		return current, err
+	}
+	current.Secret, err = s.openTOTPSecret(current.Secret)
+	return current, err
+}
+
+// sealTOTPSecret шифрует секрет ключом TOTP_SECRET_KEY. Без ключа секрет хранится как есть.
+func (s *Server) sealTOTPSecret(secret string) (string, error) {
+	aead, err := s.totpCipher()
+	if aead == nil || err != nil {
+		return secret, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return totpSealedPrefix + base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+// openTOTPSecret расшифровывает секрет. Секреты, сохраненные до настройки ключа, возвращаются как есть.
+func (s *Server) openTOTPSecret(stored string) (string, error) {
+	if !strings.HasPrefix(stored, totpSealedPrefix) {
+		return stored, nil
+	}
+	aead, err := s.totpCipher()
+	if err != nil {
+		return "", err
+	}
+	if aead == nil {
+		return "", errors.New("totp secret is encrypted but TOTP_SECRET_KEY is not set")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(stored, totpSealedPrefix))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted totp secret")
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.Wrap(err, "decrypt totp secret")
+	}
+	return string(secret), nil
+}
+
+func (s *Server) totpCipher() (cipher.AEAD, error) {
+	key := s.Config.EnvValues.TOTP.SecretKey
+	if key == "" {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *Server) disableTOTP(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.storage.DisableTOTP(ctx, userID)
+}
+
+func (s *Server) totpIssuer() string {
+	if issuer := s.Config.EnvValues.TOTP.Issuer; issuer != "" {
+		return issuer
+	}
+	return defaultTOTPIssuer
+}
+
+func (s *Server) loginChallengeTTL() time.Duration {
+	if s.Config.EnvValues.TOTP.ChallengeTTL > 0 {
+		return s.Config.EnvValues.TOTP.ChallengeTTL
+	}
+	return defaultLoginChallengeTTL
+}
+
+// newRecoveryCodes возвращает коды вида abcd-efgh для пользователя и их хеши для хранения.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodesCount)
+	hashes := make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryEncoding.EncodeToString(raw))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashSecretToken(code))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Dorrrke/loyality-system.git/internal/logger"
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLoginMinLength     = 3
+	defaultLoginMaxLength     = 64
+	defaultPasswordMinLength  = 8
+	defaultPasswordMaxLength  = 72
+	defaultPasswordMinClasses = 2
+)
+
+// normalizeLogin приводит логин к виду, в котором он хранится: без пробелов по краям и в нижнем регистре.
+func normalizeLogin(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+// validateLogin проверяет уже нормализованный логин.
+func (s *Server) validateLogin(login string) []models.FieldError {
+	conf := s.Config.EnvValues.Validation
+	minLen := positiveOr(conf.LoginMinLength, defaultLoginMinLength)
+	maxLen := positiveOr(conf.LoginMaxLength, defaultLoginMaxLength)
+
+	var errs []models.FieldError
+	if n := utf8.RuneCountInString(login); n < minLen || n > maxLen {
+		errs = append(errs, models.FieldError{Field: "login",
+			Message: fmt.Sprintf("Длина логина должна быть от %d до %d символов", minLen, maxLen)})
+	}
+	pattern, err := conf.LoginRegexp()
+	if err != nil {
+		logger.Log.Error("Invalid login pattern", zap.Error(err))
+		return errs
+	}
+	if login != "" && !pattern.MatchString(login) {
+		errs = append(errs, models.FieldError{Field: "login", Message: "Логин содержит недопустимые символы"})
+	}
+	return errs
+}
+
+func (s *Server) validatePassword(field string, password string, login string) []models.FieldError {
+	conf := s.Config.EnvValues.Validation
+	minLen := positiveOr(conf.PasswordMinLength, defaultPasswordMinLength)
+	maxLen := positiveOr(conf.PasswordMaxLength, defaultPasswordMaxLength)
+	minClasses := positiveOr(conf.PasswordMinClasses, defaultPasswordMinClasses)
+
+	var errs []models.FieldError
+	if utf8.RuneCountInString(password) < minLen {
+		errs = append(errs, models.FieldError{Field: field,
+			Message: fmt.Sprintf("Пароль должен быть не короче %d символов", minLen)})
+	}
+	// bcrypt учитывает только первые 72 байта, поэтому ограничиваем длину в байтах
+	if len(password) > maxLen {
+		errs = append(errs, models.FieldError{Field: field,
+			Message: fmt.Sprintf("Пароль должен быть не длиннее %d байт", maxLen)})
+	}
+	if passwordClasses(password) < minClasses {
+		errs = append(errs, models.FieldError{Field: field,
+			Message: fmt.Sprintf("Пароль должен содержать символы хотя бы %d разных видов: строчные и заглавные буквы, цифры, другие символы", minClasses)})
+	}
+	if login != "" && normalizeLogin(password) == login {
+		errs = append(errs, models.FieldError{Field: field, Message: "Пароль не должен совпадать с логином"})
+	}
+	return errs
+}
+
+func passwordClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+func writeValidationErrors(res http.ResponseWriter, errs []models.FieldError) {
+	resp, err := json.Marshal(models.ValidationErrors{Errors: errs})
+	if err != nil {
+		logger.Log.Error("Encode validation errors error", zap.Error(err))
+		http.Error(res, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusBadRequest)
+	res.Write(resp)
+}
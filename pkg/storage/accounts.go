@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/pkg/errors"
+)
+
+type AccountStorage interface {
+	// AnonymizeUser удаляет учетную запись, оставляя строку users ради финансовых записей.
+	AnonymizeUser(ctx context.Context, userID int) error
+}
+
+// DeletedLogin - логин, который получает удаленный пользователь. Двоеточие не проходит
+// проверку логина при регистрации, поэтому такой логин не займут.
+func DeletedLogin(userID int) string {
+	return "deleted:" + strconv.Itoa(userID)
+}
+
+// AnonymizeUser не удаляет строку users: ON DELETE CASCADE унес бы заказы, списания
+// и журнал баланса, которые нужны бухгалтерии. Вместо этого стираются логин и пароль,
+// а все, что позволяет войти в аккаунт, удаляется.
+func (db *DataBaseStorage) AnonymizeUser(ctx context.Context, userID int) error {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `update users set login = $1, password = '', role = 'user', blocked = true, deleted_at = now()
+		where uid = $2 and deleted_at is null`, DeletedLogin(userID), userID)
+	if err != nil {
+		return errors.Wrap(err, "Anonymize user error")
+	}
+	if tag.RowsAffected() == 0 {
+		return errorsstorage.ErrUserNotExists
+	}
+	for _, table := range []string{"sessions", "password_resets", "login_challenges", "totp_recovery_codes", "user_totp", "idempotency_keys"} {
+		if _, err := tx.Exec(ctx, "delete from "+table+" where uid = $1", userID); err != nil {
+			return errors.Wrap(err, "Delete "+table+" error")
+		}
+	}
+	// Ключи, выпущенные пользователем, отзываем, но не удаляем: по ним видно, кто загружал заказы
+	if _, err := tx.Exec(ctx, "update api_keys set revoked_at = now() where created_by = $1 and revoked_at is null", userID); err != nil {
+		return errors.Wrap(err, "Revoke api keys error")
+	}
+	return tx.Commit(ctx)
+}
+
+func (m *MemStorage) AnonymizeUser(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok || user.deleted {
+		return errorsstorage.ErrUserNotExists
+	}
+	delete(m.logins, user.login)
+	user.login = DeletedLogin(userID)
+	m.logins[user.login] = userID
+	user.password = ""
+	user.role = models.RoleUser
+	user.blocked = true
+	user.deleted = true
+
+	for id, session := range m.sessions {
+		if session.UserID == userID {
+			delete(m.sessions, id)
+		}
+	}
+	for hash, reset := range m.resets {
+		if reset.uid == userID {
+			delete(m.resets, hash)
+		}
+	}
+	for hash, challenge := range m.challenges {
+		if challenge.uid == userID {
+			delete(m.challenges, hash)
+		}
+	}
+	for key := range m.idempotency {
+		if key.uid == userID {
+			delete(m.idempotency, key)
+		}
+	}
+	for _, k := range m.apiKeys {
+		if k.CreatedBy == userID {
+			k.Revoked = true
+		}
+	}
+	delete(m.totp, userID)
+	return nil
+}
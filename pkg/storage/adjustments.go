@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+type AdjustmentStorage interface {
+	InsertBalanceAdjustment(ctx context.Context, adjustment models.BalanceAdjustment) (models.BalanceAdjustment, error)
+	GetBalanceAdjustments(ctx context.Context, userID int) ([]models.BalanceAdjustment, error)
+	GetLedger(ctx context.Context, userID int) ([]models.LedgerEntry, error)
+}
+
+func (db *DataBaseStorage) InsertBalanceAdjustment(ctx context.Context, adjustment models.BalanceAdjustment) (models.BalanceAdjustment, error) {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return adjustment, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Как и при списании, блокируем строку баланса, чтобы списание оператором не увело его в минус
+	var current models.Points
+	if err := tx.QueryRow(ctx, "select current from user_balance where uid = $1 for update", adjustment.UserID).Scan(&current); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return adjustment, errorsstorage.ErrUserNotExists
+		}
+		return adjustment, errors.Wrap(err, "Lock user balance error")
+	}
+	if current+adjustment.Amount < 0 {
+		return adjustment, errorsstorage.ErrInsufficientFunds
+	}
+
+	var createdAt time.Time
+	err = tx.QueryRow(ctx, `insert into balance_adjustments (uid, amount, reason, comment, operator_id)
+		values ($1, $2, $3, $4, $5) returning id, created_at`,
+		adjustment.UserID, adjustment.Amount, adjustment.Reason, adjustment.Comment, adjustment.OperatorID).Scan(&adjustment.ID, &createdAt)
+	if err != nil {
+		return adjustment, errors.Wrap(err, "Insert balance adjustment error")
+	}
+	adjustment.CreatedAt = createdAt.Format(time.RFC3339)
+	if err := appendLedgerEntry(ctx, tx, adjustment.UserID, models.LedgerAdjustment, adjustment.Amount, "", adjustment.ID); err != nil {
+		return adjustment, err
+	}
+	return adjustment, tx.Commit(ctx)
+}
+
+func (db *DataBaseStorage) GetBalanceAdjustments(ctx context.Context, userID int) ([]models.BalanceAdjustment, error) {
+	rows, err := db.DB.Query(ctx, `select id, uid, amount, reason, comment, operator_id, created_at
+		from balance_adjustments where uid = $1 order by created_at, id`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get balance adjustments error")
+	}
+	defer rows.Close()
+	adjustments := []models.BalanceAdjustment{}
+	for rows.Next() {
+		var adjustment models.BalanceAdjustment
+		var date time.Time
+		if err := rows.Scan(&adjustment.ID, &adjustment.UserID, &adjustment.Amount, &adjustment.Reason,
+			&adjustment.Comment, &adjustment.OperatorID, &date); err != nil {
+			return nil, errors.Wrap(err, "Parsing balance adjustment error")
+		}
+		adjustment.CreatedAt = date.Format(time.RFC3339)
+		adjustments = append(adjustments, adjustment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return adjustments, nil
+}
+
+func (db *DataBaseStorage) GetLedger(ctx context.Context, userID int) ([]models.LedgerEntry, error) {
+	rows, err := db.DB.Query(ctx, `select l.kind, l.amount, coalesce(l."order", ''), coalesce(a.reason, ''), l.created_at
+		from balance_ledger l left join balance_adjustments a on a.id = l.adjustment_id
+		where l.uid = $1 order by l.created_at, l.id`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get ledger error")
+	}
+	defer rows.Close()
+	var entries []models.LedgerEntry
+	for rows.Next() {
+		var entry models.LedgerEntry
+		var date time.Time
+		if err := rows.Scan(&entry.Kind, &entry.Amount, &entry.Order, &entry.Reason, &date); err != nil {
+			return nil, errors.Wrap(err, "Parsing ledger entry error")
+		}
+		entry.CreatedAt = date.Format(time.RFC3339)
+		entry.Order = strings.TrimSpace(entry.Order)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errorsstorage.ErrLedgerNotExist
+	}
+	return entries, nil
+}
+
+func (m *MemStorage) InsertBalanceAdjustment(ctx context.Context, adjustment models.BalanceAdjustment) (models.BalanceAdjustment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	balance, ok := m.balances[adjustment.UserID]
+	if !ok {
+		return adjustment, errorsstorage.ErrUserNotExists
+	}
+	if balance.Current+adjustment.Amount < 0 {
+		return adjustment, errorsstorage.ErrInsufficientFunds
+	}
+	adjustment.ID = int64(len(m.adjustments) + 1)
+	adjustment.CreatedAt = time.Now().Format(time.RFC3339)
+	m.adjustments = append(m.adjustments, adjustment)
+	m.appendLedgerEntry(adjustment.UserID, models.LedgerAdjustment, adjustment.Amount, "", adjustment.ID)
+	return adjustment, nil
+}
+
+func (m *MemStorage) GetBalanceAdjustments(ctx context.Context, userID int) ([]models.BalanceAdjustment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	adjustments := []models.BalanceAdjustment{}
+	for _, a := range m.adjustments {
+		if a.UserID == userID {
+			adjustments = append(adjustments, a)
+		}
+	}
+	return adjustments, nil
+}
+
+func (m *MemStorage) GetLedger(ctx context.Context, userID int) ([]models.LedgerEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []models.LedgerEntry
+	for _, e := range m.ledger {
+		if e.uid != userID {
+			continue
+		}
+		entry := models.LedgerEntry{
+			Kind:      e.kind,
+			Amount:    e.amount,
+			Order:     e.order,
+			CreatedAt: e.createdAt.Format(time.RFC3339),
+		}
+		if e.adjustment != 0 {
+			entry.Reason = m.adjustments[e.adjustment-1].Reason
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, errorsstorage.ErrLedgerNotExist
+	}
+	return entries, nil
+}
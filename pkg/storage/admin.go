@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/pkg/errors"
+)
+
+type AdminStorage interface {
+	ListUsers(ctx context.Context, limit int, offset int) ([]models.UserInfo, error)
+	SetUserRole(ctx context.Context, userID int, role string) error
+	SetUserBlocked(ctx context.Context, userID int, blocked bool) error
+}
+
+func (db *DataBaseStorage) ListUsers(ctx context.Context, limit int, offset int) ([]models.UserInfo, error) {
+	rows, err := db.DB.Query(ctx, "select uid, login, role, blocked, deleted_at is not null from users order by uid limit $1 offset $2", limit, offset)
+	if err != nil {
+		return nil, errors.Wrap(err, "List users error")
+	}
+	defer rows.Close()
+	users := []models.UserInfo{}
+	for rows.Next() {
+		var user models.UserInfo
+		if err := rows.Scan(&user.ID, &user.Login, &user.Role, &user.Blocked, &user.Deleted); err != nil {
+			return nil, errors.Wrap(err, "Parsing user error")
+		}
+		user.Login = strings.TrimSpace(user.Login)
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (db *DataBaseStorage) SetUserRole(ctx context.Context, userID int, role string) error {
+	tag, err := db.DB.Exec(ctx, "update users set role = $1 where uid = $2", role, userID)
+	if err != nil {
+		return errors.Wrap(err, "Set user role error")
+	}
+	if tag.RowsAffected() == 0 {
+		return errorsstorage.ErrUserNotExists
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) SetUserBlocked(ctx context.Context, userID int, blocked bool) error {
+	tag, err := db.DB.Exec(ctx, "update users set blocked = $1 where uid = $2", blocked, userID)
+	if err != nil {
+		return errors.Wrap(err, "Set user blocked error")
+	}
+	if tag.RowsAffected() == 0 {
+		return errorsstorage.ErrUserNotExists
+	}
+	return nil
+}
+
+func (m *MemStorage) ListUsers(ctx context.Context, limit int, offset int) ([]models.UserInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]int, 0, len(m.users))
+	for id := range m.users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	users := []models.UserInfo{}
+	for i := offset; i < len(ids) && len(users) < limit; i++ {
+		u := m.users[ids[i]]
+		users = append(users, models.UserInfo{ID: u.uid, Login: u.login, Role: u.role, Blocked: u.blocked, Deleted: u.deleted})
+	}
+	return users, nil
+}
+
+func (m *MemStorage) SetUserRole(ctx context.Context, userID int, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return errorsstorage.ErrUserNotExists
+	}
+	user.role = role
+	return nil
+}
+
+func (m *MemStorage) SetUserBlocked(ctx context.Context, userID int, blocked bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return errorsstorage.ErrUserNotExists
+	}
+	user.blocked = blocked
+	return nil
+}
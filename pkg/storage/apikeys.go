@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+type APIKeyStorage interface {
+	CreateAPIKey(ctx context.Context, key models.APIKey) (models.APIKey, error)
+	// GetAPIKey возвращает только неотозванный ключ, иначе ErrAPIKeyNotExist.
+	GetAPIKey(ctx context.Context, id string) (models.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) error
+	TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error
+}
+
+func (db *DataBaseStorage) CreateAPIKey(ctx context.Context, key models.APIKey) (models.APIKey, error) {
+	var createdAt time.Time
+	err := db.DB.QueryRow(ctx, `insert into api_keys (id, name, key_hash, scopes, created_by)
+		values ($1, $2, $3, $4, $5) returning created_at`,
+		key.ID, key.Name, key.KeyHash, key.Scopes, key.CreatedBy).Scan(&createdAt)
+	if err != nil {
+		return key, errors.Wrap(err, "Insert api key error")
+	}
+	key.CreatedAt = createdAt.Format(time.RFC3339)
+	return key, nil
+}
+
+func (db *DataBaseStorage) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	row := db.DB.QueryRow(ctx, `select id, name, key_hash, scopes, created_by, created_at, last_used_at, revoked_at is not null
+		from api_keys where id = $1 and revoked_at is null`, id)
+	key, err := scanAPIKey(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return key, errorsstorage.ErrAPIKeyNotExist
+		}
+		return key, errors.Wrap(err, "Get api key error")
+	}
+	return key, nil
+}
+
+func (db *DataBaseStorage) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	rows, err := db.DB.Query(ctx, `select id, name, key_hash, scopes, created_by, created_at, last_used_at, revoked_at is not null
+		from api_keys order by created_at, id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "List api keys error")
+	}
+	defer rows.Close()
+	keys := []models.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "Parsing api key error")
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func scanAPIKey(row pgx.Row) (models.APIKey, error) {
+	var key models.APIKey
+	var createdAt time.Time
+	var lastUsedAt *time.Time
+	if err := row.Scan(&key.ID, &key.Name, &key.KeyHash, &key.Scopes, &key.CreatedBy, &createdAt, &lastUsedAt, &key.Revoked); err != nil {
+		return key, err
+	}
+	key.CreatedAt = createdAt.Format(time.RFC3339)
+	if lastUsedAt != nil {
+		key.LastUsedAt = lastUsedAt.Format(time.RFC3339)
+	}
+	return key, nil
+}
+
+func (db *DataBaseStorage) RevokeAPIKey(ctx context.Context, id string) error {
+	tag, err := db.DB.Exec(ctx, "update api_keys set revoked_at = now() where id = $1 and revoked_at is null", id)
+	if err != nil {
+		return errors.Wrap(err, "Revoke api key error")
+	}
+	if tag.RowsAffected() == 0 {
+		return errorsstorage.ErrAPIKeyNotExist
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error {
+	_, err := db.DB.Exec(ctx, "update api_keys set last_used_at = $1 where id = $2", usedAt, id)
+	if err != nil {
+		return errors.Wrap(err, "Touch api key error")
+	}
+	return nil
+}
+
+func (m *MemStorage) CreateAPIKey(ctx context.Context, key models.APIKey) (models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key.CreatedAt = time.Now().Format(time.RFC3339)
+	stored := key
+	m.apiKeys = append(m.apiKeys, &stored)
+	return key, nil
+}
+
+func (m *MemStorage) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, k := range m.apiKeys {
+		if k.ID == id && !k.Revoked {
+			return *k, nil
+		}
+	}
+	return models.APIKey{}, errorsstorage.ErrAPIKeyNotExist
+}
+
+func (m *MemStorage) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]models.APIKey, 0, len(m.apiKeys))
+	for _, k := range m.apiKeys {
+		keys = append(keys, *k)
+	}
+	return keys, nil
+}
+
+func (m *MemStorage) RevokeAPIKey(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, k := range m.apiKeys {
+		if k.ID == id && !k.Revoked {
+			k.Revoked = true
+			return nil
+		}
+	}
+	return errorsstorage.ErrAPIKeyNotExist
+}
+
+func (m *MemStorage) TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, k := range m.apiKeys {
+		if k.ID == id {
+			k.LastUsedAt = usedAt.Format(time.RFC3339)
+		}
+	}
+	return nil
+}
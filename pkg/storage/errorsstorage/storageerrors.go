@@ -7,4 +7,13 @@ var ErrUserNotExists = errors.New("the login/password pair does not exist")
 var ErrOrderNotExist = errors.New("order does not exist")
 var ErrOrdersNotExist = errors.New("orders does not exists, list is empty")
 var ErrWriteOffNotExist = errors.New("write off does not exists, list is empty")
+var ErrLedgerNotExist = errors.New("ledger entries does not exists, list is empty")
 var ErrDataBaseNoChange = errors.New("data base has not change, migration is not complete")
+var ErrInsufficientFunds = errors.New("insufficient funds")
+var ErrUserBlocked = errors.New("user is blocked")
+var ErrResetTokenNotExist = errors.New("password reset token does not exist or expired")
+var ErrSessionNotExist = errors.New("session does not exist or revoked")
+var ErrAPIKeyNotExist = errors.New("api key does not exist or revoked")
+var ErrTOTPNotExist = errors.New("totp is not configured")
+var ErrChallengeNotExist = errors.New("login challenge does not exist or expired")
+var ErrWithdrawalConflict = errors.New("withdrawal for this order already exists")
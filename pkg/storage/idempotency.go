@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+const (
+	// IdempotencyKeyTTL - сколько хранится ответ на запрос с Idempotency-Key.
+	IdempotencyKeyTTL = 24 * time.Hour
+	// IdempotencyPendingTimeout - сколько ключ считается занятым запросом, который еще выполняется.
+	// Если процесс упал, не освободив ключ, по истечении этого времени ключ можно занять снова.
+	IdempotencyPendingTimeout = time.Minute
+)
+
+type IdempotencyStorage interface {
+	// ReserveIdempotencyKey занимает ключ за пользователем. Если ключ уже занят,
+	// возвращает сохранённый ответ и false.
+	ReserveIdempotencyKey(ctx context.Context, userID int, key string, requestHash string) (models.IdempotentResponse, bool, error)
+	CompleteIdempotencyKey(ctx context.Context, userID int, key string, resp models.IdempotentResponse) error
+	DeleteIdempotencyKey(ctx context.Context, userID int, key string) error
+	// DeleteExpiredIdempotencyKeys удаляет ключи всех пользователей, занятые раньше before.
+	DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) error
+}
+
+func (db *DataBaseStorage) ReserveIdempotencyKey(ctx context.Context, userID int, key string, requestHash string) (models.IdempotentResponse, bool, error) {
+	var resp models.IdempotentResponse
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return resp, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	_, err = tx.Exec(ctx, `delete from idempotency_keys where uid = $1 and key = $2
+		and (created_at < $3 or (status_code = 0 and created_at < $4))`,
+		userID, key, now.Add(-IdempotencyKeyTTL), now.Add(-IdempotencyPendingTimeout))
+	if err != nil {
+		return resp, false, errors.Wrap(err, "Delete expired idempotency key error")
+	}
+	tag, err := tx.Exec(ctx, "insert into idempotency_keys (uid, key, request_hash) values ($1, $2, $3) on conflict (uid, key) do nothing",
+		userID, key, requestHash)
+	if err != nil {
+		return resp, false, errors.Wrap(err, "Reserve idempotency key error")
+	}
+	if tag.RowsAffected() == 1 {
+		return resp, true, tx.Commit(ctx)
+	}
+
+	row := tx.QueryRow(ctx, "select request_hash, status_code, content_type, body from idempotency_keys where uid = $1 and key = $2",
+		userID, key)
+	if err := row.Scan(&resp.RequestHash, &resp.StatusCode, &resp.ContentType, &resp.Body); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return resp, false, errors.New("idempotency key disappeared while reserving")
+		}
+		return resp, false, errors.Wrap(err, "Get idempotency key error")
+	}
+	return resp, false, tx.Commit(ctx)
+}
+
+func (db *DataBaseStorage) CompleteIdempotencyKey(ctx context.Context, userID int, key string, resp models.IdempotentResponse) error {
+	_, err := db.DB.Exec(ctx, "update idempotency_keys set status_code = $1, content_type = $2, body = $3 where uid = $4 and key = $5",
+		resp.StatusCode, resp.ContentType, resp.Body, userID, key)
+	if err != nil {
+		return errors.Wrap(err, "Save idempotent response error")
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) DeleteIdempotencyKey(ctx context.Context, userID int, key string) error {
+	_, err := db.DB.Exec(ctx, "delete from idempotency_keys where uid = $1 and key = $2", userID, key)
+	if err != nil {
+		return errors.Wrap(err, "Delete idempotency key error")
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) error {
+	_, err := db.DB.Exec(ctx, "delete from idempotency_keys where created_at < $1", before)
+	if err != nil {
+		return errors.Wrap(err, "Delete expired idempotency keys error")
+	}
+	return nil
+}
+
+type memIdempotencyKey struct {
+	uid int
+	key string
+}
+
+type memIdempotentResponse struct {
+	resp      models.IdempotentResponse
+	createdAt time.Time
+}
+
+func (r *memIdempotentResponse) expired() bool {
+	age := time.Since(r.createdAt)
+	return age >= IdempotencyKeyTTL || (r.resp.StatusCode == 0 && age >= IdempotencyPendingTimeout)
+}
+
+func (m *MemStorage) ReserveIdempotencyKey(ctx context.Context, userID int, key string, requestHash string) (models.IdempotentResponse, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := memIdempotencyKey{uid: userID, key: key}
+	if stored, ok := m.idempotency[k]; ok && !stored.expired() {
+		return stored.resp, false, nil
+	}
+	m.idempotency[k] = &memIdempotentResponse{
+		resp:      models.IdempotentResponse{RequestHash: requestHash},
+		createdAt: time.Now(),
+	}
+	return models.IdempotentResponse{}, true, nil
+}
+
+func (m *MemStorage) CompleteIdempotencyKey(ctx context.Context, userID int, key string, resp models.IdempotentResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.idempotency[memIdempotencyKey{uid: userID, key: key}]
+	if !ok {
+		return nil
+	}
+	resp.RequestHash = stored.resp.RequestHash
+	stored.resp = resp
+	return nil
+}
+
+func (m *MemStorage) DeleteIdempotencyKey(ctx context.Context, userID int, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.idempotency, memIdempotencyKey{uid: userID, key: key})
+	return nil
+}
+
+func (m *MemStorage) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, stored := range m.idempotency {
+		if stored.createdAt.Before(before) {
+			delete(m.idempotency, k)
+		}
+	}
+	return nil
+}
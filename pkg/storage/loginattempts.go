@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+// LoginAttemptStorage считает неудачные попытки входа. scope разделяет счетчики
+// по логину и по IP, key - сам логин или адрес.
+type LoginAttemptStorage interface {
+	// GetLoginLock возвращает время окончания блокировки, нулевое если блокировки нет.
+	GetLoginLock(ctx context.Context, scope string, key string) (time.Time, error)
+	// RecordLoginFailure увеличивает счетчик ошибок и возвращает его. Если ошибок
+	// не было дольше window, счет начинается заново.
+	RecordLoginFailure(ctx context.Context, scope string, key string, window time.Duration) (int, error)
+	LockLogin(ctx context.Context, scope string, key string, until time.Time) error
+	ClearLoginFailures(ctx context.Context, scope string, key string) error
+}
+
+type memLoginKey struct {
+	scope string
+	key   string
+}
+
+type memLoginAttempt struct {
+	failures    int
+	lockedUntil time.Time
+	updatedAt   time.Time
+}
+
+func (db *DataBaseStorage) GetLoginLock(ctx context.Context, scope string, key string) (time.Time, error) {
+	row := db.DB.QueryRow(ctx, "select locked_until from login_attempts where scope = $1 and key = $2", scope, key)
+	var until *time.Time
+	if err := row.Scan(&until); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, errors.Wrap(err, "Get login lock error")
+	}
+	if until == nil {
+		return time.Time{}, nil
+	}
+	return *until, nil
+}
+
+func (db *DataBaseStorage) RecordLoginFailure(ctx context.Context, scope string, key string, window time.Duration) (int, error) {
+	row := db.DB.QueryRow(ctx, `insert into login_attempts (scope, key, failures, updated_at) values ($1, $2, 1, now())
+	on conflict (scope, key) do update set
+		failures = case when login_attempts.updated_at < now() - make_interval(secs => $3) then 1
+			else login_attempts.failures + 1 end,
+		updated_at = now()
+	returning failures`, scope, key, window.Seconds())
+	var failures int
+	if err := row.Scan(&failures); err != nil {
+		return 0, errors.Wrap(err, "Record login failure error")
+	}
+	return failures, nil
+}
+
+func (db *DataBaseStorage) LockLogin(ctx context.Context, scope string, key string, until time.Time) error {
+	_, err := db.DB.Exec(ctx, "update login_attempts set locked_until = $1 where scope = $2 and key = $3", until, scope, key)
+	if err != nil {
+		return errors.Wrap(err, "Lock login error")
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) ClearLoginFailures(ctx context.Context, scope string, key string) error {
+	_, err := db.DB.Exec(ctx, "delete from login_attempts where scope = $1 and key = $2", scope, key)
+	if err != nil {
+		return errors.Wrap(err, "Clear login failures error")
+	}
+	return nil
+}
+
+func (m *MemStorage) GetLoginLock(ctx context.Context, scope string, key string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if attempt, ok := m.attempts[memLoginKey{scope: scope, key: key}]; ok {
+		return attempt.lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+func (m *MemStorage) RecordLoginFailure(ctx context.Context, scope string, key string, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	k := memLoginKey{scope: scope, key: key}
+	attempt, ok := m.attempts[k]
+	if !ok {
+		attempt = &memLoginAttempt{}
+		m.attempts[k] = attempt
+	}
+	if attempt.updatedAt.Before(now.Add(-window)) {
+		attempt.failures = 0
+	}
+	attempt.failures++
+	attempt.updatedAt = now
+	return attempt.failures, nil
+}
+
+func (m *MemStorage) LockLogin(ctx context.Context, scope string, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if attempt, ok := m.attempts[memLoginKey{scope: scope, key: key}]; ok {
+		attempt.lockedUntil = until
+	}
+	return nil
+}
+
+func (m *MemStorage) ClearLoginFailures(ctx context.Context, scope string, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, memLoginKey{scope: scope, key: key})
+	return nil
+}
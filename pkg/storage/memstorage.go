@@ -0,0 +1,383 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/pkg/errors"
+)
+
+type memUser struct {
+	uid      int
+	login    string
+	password string
+	algo     string
+	role     string
+	blocked  bool
+	deleted  bool
+}
+
+func (u *memUser) model() models.User {
+	return models.User{ID: u.uid, Login: u.login, PasswordHash: u.password, PasswordAlgo: u.algo, Role: u.role, Blocked: u.blocked, Deleted: u.deleted}
+}
+
+type memOrder struct {
+	id        int64
+	uid       int
+	number    string
+	status    string
+	accrual   models.Points
+	date      time.Time
+	updatedAt time.Time
+}
+
+type memWithdrawal struct {
+	id          int64
+	uid         int
+	order       string
+	sum         models.Points
+	processedAt time.Time
+}
+
+type memLedgerEntry struct {
+	uid       int
+	kind      string
+	amount    models.Points
+	order     string
+	createdAt time.Time
+	// adjustment - номер корректировки в m.adjustments, начиная с 1; 0 у остальных проводок
+	adjustment int64
+}
+
+type memAccrualJob struct {
+	job       models.AccrualJob
+	nextRunAt time.Time
+}
+
+// MemStorage - потокобезопасная реализация Storage в памяти для тестов и запуска без базы данных.
+type MemStorage struct {
+	mu          sync.Mutex
+	lastUID     int
+	lastJobID   int64
+	pausedUntil time.Time
+	perMinute   int
+	nextSlot    time.Time
+	users       map[int]*memUser
+	logins      map[string]int
+	balances    map[int]*models.Balance
+	orders      []*memOrder
+	orderIndex  map[string]*memOrder
+	withdrawals []memWithdrawal
+	ledger      []memLedgerEntry
+	adjustments []models.BalanceAdjustment
+	jobs        map[string]*memAccrualJob
+	idempotency map[memIdempotencyKey]*memIdempotentResponse
+	sessions    map[string]*models.Session
+	resets      map[string]*memPasswordReset
+	attempts    map[memLoginKey]*memLoginAttempt
+	apiKeys     []*models.APIKey
+	totp        map[int]*memTOTP
+	challenges  map[string]*memLoginChallenge
+}
+
+func NewMemStorage() *MemStorage {
+	m := &MemStorage{}
+	m.reset()
+	return m
+}
+
+func (m *MemStorage) reset() {
+	m.users = make(map[int]*memUser)
+	m.logins = make(map[string]int)
+	m.balances = make(map[int]*models.Balance)
+	m.orders = nil
+	m.orderIndex = make(map[string]*memOrder)
+	m.withdrawals = nil
+	m.ledger = nil
+	m.adjustments = nil
+	m.jobs = make(map[string]*memAccrualJob)
+	m.pausedUntil = time.Time{}
+	m.perMinute = 0
+	m.nextSlot = time.Time{}
+	m.idempotency = make(map[memIdempotencyKey]*memIdempotentResponse)
+	m.sessions = make(map[string]*models.Session)
+	m.resets = make(map[string]*memPasswordReset)
+	m.attempts = make(map[memLoginKey]*memLoginAttempt)
+	m.apiKeys = nil
+	m.totp = make(map[int]*memTOTP)
+	m.challenges = make(map[string]*memLoginChallenge)
+}
+
+func (m *MemStorage) InsertUser(ctx context.Context, login string, passHash string, passAlgo string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.logins[login]; ok {
+		return -1, errorsstorage.ErrLoginCOnflict
+	}
+	m.lastUID++
+	uid := m.lastUID
+	m.users[uid] = &memUser{uid: uid, login: login, password: passHash, algo: passAlgo, role: models.RoleUser}
+	m.logins[login] = uid
+	m.balances[uid] = &models.Balance{}
+	return uid, nil
+}
+
+func (m *MemStorage) CheckUser(ctx context.Context, login string, passHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	uid, ok := m.logins[login]
+	return ok && m.users[uid].password == passHash, nil
+}
+
+func (m *MemStorage) GetUserByLogin(ctx context.Context, login string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	uid, ok := m.logins[login]
+	if !ok {
+		return models.User{}, errorsstorage.ErrUserNotExists
+	}
+	return m.users[uid].model(), nil
+}
+
+func (m *MemStorage) InsertOrder(ctx context.Context, uid int, orderNumber string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[uid]; !ok {
+		return errors.New("Insert order error: user does not exist")
+	}
+	if _, ok := m.orderIndex[orderNumber]; ok {
+		return errors.New("Insert order error: order already exists")
+	}
+	order := &memOrder{id: int64(len(m.orders) + 1), uid: uid, number: orderNumber, status: models.OrderStatusNew, date: time.Now()}
+	order.updatedAt = order.date
+	m.orders = append(m.orders, order)
+	m.orderIndex[orderNumber] = order
+	m.lastJobID++
+	m.jobs[orderNumber] = &memAccrualJob{
+		job:       models.AccrualJob{ID: m.lastJobID, OrderNumber: orderNumber, UserID: uid},
+		nextRunAt: order.date,
+	}
+	return nil
+}
+
+func (m *MemStorage) CheckOrder(ctx context.Context, order string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, ok := m.orderIndex[order]
+	if !ok {
+		return -1, errorsstorage.ErrOrderNotExist
+	}
+	return o.uid, nil
+}
+
+func (m *MemStorage) GetAllOrders(ctx context.Context, uid int) ([]models.Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var orders []models.Order
+	for _, o := range m.orders {
+		if o.uid != uid {
+			continue
+		}
+		orders = append(orders, models.Order{
+			Number:     o.number,
+			Status:     o.status,
+			Accrual:    o.accrual,
+			UploadedAt: o.date.Format(time.RFC3339),
+		})
+	}
+	if len(orders) == 0 {
+		return nil, errorsstorage.ErrOrdersNotExist
+	}
+	return orders, nil
+}
+
+func (m *MemStorage) GetUserBalance(ctx context.Context, userID int) (models.Balance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	balance, ok := m.balances[userID]
+	if !ok {
+		return models.Balance{}, errorsstorage.ErrUserNotExists
+	}
+	return *balance, nil
+}
+
+func (m *MemStorage) GetUsersWithdrawls(ctx context.Context, userID int) ([]models.WithdrawInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var withdrawls []models.WithdrawInfo
+	for _, w := range m.withdrawals {
+		if w.uid != userID {
+			continue
+		}
+		withdrawls = append(withdrawls, models.WithdrawInfo{
+			Order:       w.order,
+			Sum:         w.sum,
+			ProcessedAt: w.processedAt.Format(time.RFC3339),
+		})
+	}
+	if len(withdrawls) == 0 {
+		return nil, errorsstorage.ErrWriteOffNotExist
+	}
+	return withdrawls, nil
+}
+
+func (m *MemStorage) InsertWriteOffBonuces(ctx context.Context, withdraw models.Withdraw, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	balance, ok := m.balances[userID]
+	if !ok {
+		return errorsstorage.ErrUserNotExists
+	}
+	if balance.Current < withdraw.Sum {
+		return errorsstorage.ErrInsufficientFunds
+	}
+	for _, w := range m.withdrawals {
+		if w.uid == userID && w.order == withdraw.Order {
+			return errorsstorage.ErrWithdrawalConflict
+		}
+	}
+	m.withdrawals = append(m.withdrawals, memWithdrawal{
+		id:          int64(len(m.withdrawals) + 1),
+		uid:         userID,
+		order:       withdraw.Order,
+		sum:         withdraw.Sum,
+		processedAt: time.Now(),
+	})
+	m.appendLedgerEntry(userID, models.LedgerWithdrawal, -withdraw.Sum, withdraw.Order, 0)
+	return nil
+}
+
+// appendLedgerEntry вызывается под m.mu, как и в базе меняет журнал и кэш баланса вместе.
+func (m *MemStorage) appendLedgerEntry(userID int, kind string, amount models.Points, order string, adjustment int64) {
+	m.ledger = append(m.ledger, memLedgerEntry{
+		uid:        userID,
+		kind:       kind,
+		amount:     amount,
+		order:      order,
+		createdAt:  time.Now(),
+		adjustment: adjustment,
+	})
+	balance, ok := m.balances[userID]
+	if !ok {
+		balance = &models.Balance{}
+		m.balances[userID] = balance
+	}
+	balance.Current += amount
+	if kind == models.LedgerWithdrawal {
+		balance.Withdraw -= amount
+	}
+}
+
+func (m *MemStorage) UpdateByAccrual(ctx context.Context, accrual models.AccrualModel, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, ok := m.orderIndex[accrual.OrderNumber]
+	if !ok || order.status == models.OrderStatusInvalid || order.status == models.OrderStatusProcessed {
+		delete(m.jobs, accrual.OrderNumber)
+		return nil
+	}
+	if order.status != accrual.Status {
+		order.updatedAt = time.Now()
+	}
+	order.status = accrual.Status
+	order.accrual = accrual.Accrual
+	if accrual.Status == models.OrderStatusProcessed {
+		m.appendLedgerEntry(order.uid, models.LedgerAccrual, accrual.Accrual, order.number, 0)
+	}
+	if accrual.Status == models.OrderStatusInvalid || accrual.Status == models.OrderStatusProcessed {
+		delete(m.jobs, accrual.OrderNumber)
+	}
+	return nil
+}
+
+func (m *MemStorage) ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]models.AccrualJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.pausedUntil.After(now) || m.nextSlot.After(now) {
+		return nil, nil
+	}
+	var ready []*memAccrualJob
+	for _, j := range m.jobs {
+		if !j.nextRunAt.After(now) {
+			ready = append(ready, j)
+		}
+	}
+	sort.Slice(ready, func(i, k int) bool {
+		return ready[i].nextRunAt.Before(ready[k].nextRunAt)
+	})
+	if len(ready) > limit {
+		ready = ready[:limit]
+	}
+	jobs := make([]models.AccrualJob, 0, len(ready))
+	for _, j := range ready {
+		j.nextRunAt = now.Add(lease)
+		jobs = append(jobs, j.job)
+	}
+	if m.perMinute > 0 && len(jobs) > 0 {
+		m.nextSlot = now.Add(time.Duration(len(jobs)) * time.Minute / time.Duration(m.perMinute))
+	}
+	return jobs, nil
+}
+
+func (m *MemStorage) PauseAccrualJobs(ctx context.Context, until time.Time, perMinute int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if until.After(m.pausedUntil) {
+		m.pausedUntil = until
+	}
+	if perMinute > 0 {
+		m.perMinute = perMinute
+	}
+	return nil
+}
+
+func (m *MemStorage) RescheduleAccrualJob(ctx context.Context, job models.AccrualJob, orderStatus string, runAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if order, ok := m.orderIndex[job.OrderNumber]; ok && orderStatus != "" &&
+		order.status != models.OrderStatusInvalid && order.status != models.OrderStatusProcessed {
+		if order.status != orderStatus {
+			order.updatedAt = time.Now()
+		}
+		order.status = orderStatus
+	}
+	if j, ok := m.jobs[job.OrderNumber]; ok {
+		j.job.Attempts = job.Attempts
+		j.nextRunAt = runAt
+	}
+	return nil
+}
+
+func (m *MemStorage) CreateTables(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemStorage) ClearTables(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.reset()
+	return nil
+}
+
+func (m *MemStorage) MigrationUp(migrationPath string, dbURL string) error {
+	return nil
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStorage(t *testing.T) {
+	ctx := context.Background()
+	stor := NewMemStorage()
+
+	uid, err := stor.InsertUser(ctx, "admin", "hash", "bcrypt")
+	require.NoError(t, err)
+	_, err = stor.InsertUser(ctx, "admin", "hash", "bcrypt")
+	assert.ErrorIs(t, err, errorsstorage.ErrLoginCOnflict)
+	_, err = stor.GetUserByLogin(ctx, "nobody")
+	assert.ErrorIs(t, err, errorsstorage.ErrUserNotExists)
+
+	_, err = stor.GetAllOrders(ctx, uid)
+	assert.ErrorIs(t, err, errorsstorage.ErrOrdersNotExist)
+	_, err = stor.CheckOrder(ctx, "12345678903")
+	assert.ErrorIs(t, err, errorsstorage.ErrOrderNotExist)
+
+	require.NoError(t, stor.InsertOrder(ctx, uid, "12345678903"))
+	owner, err := stor.CheckOrder(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, uid, owner)
+
+	jobs, err := stor.ClaimAccrualJobs(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	// пока аренда не истекла, задачу никто другой не получит
+	again, err := stor.ClaimAccrualJobs(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, again)
+
+	job := jobs[0]
+	job.Attempts++
+	require.NoError(t, stor.RescheduleAccrualJob(ctx, job, models.OrderStatusProcessing, time.Now()))
+	jobs, err = stor.ClaimAccrualJobs(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, 1, jobs[0].Attempts)
+
+	require.NoError(t, stor.UpdateByAccrual(ctx, models.AccrualModel{
+		OrderNumber: "12345678903",
+		Status:      models.OrderStatusProcessed,
+		Accrual:     500 * models.Point,
+	}, uid))
+	orders, err := stor.GetAllOrders(ctx, uid)
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusProcessed, orders[0].Status)
+
+	require.NoError(t, stor.RescheduleAccrualJob(ctx, job, "", time.Now()))
+	jobs, err = stor.ClaimAccrualJobs(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, jobs, "processed order must leave the queue")
+}
+
+func TestMemStorageLedger(t *testing.T) {
+	ctx := context.Background()
+	stor := NewMemStorage()
+
+	userID, err := stor.InsertUser(ctx, "admin", "hash", "bcrypt")
+	require.NoError(t, err)
+	for _, order := range []string{"12345678903", "2377225624"} {
+		require.NoError(t, stor.InsertOrder(ctx, userID, order))
+		accrual := models.AccrualModel{OrderNumber: order, Status: models.OrderStatusProcessed, Accrual: 300 * models.Point}
+		require.NoError(t, stor.UpdateByAccrual(ctx, accrual, userID))
+		// повторная обработка того же заказа не должна начислить баллы второй раз
+		require.NoError(t, stor.UpdateByAccrual(ctx, accrual, userID))
+	}
+	user, err := stor.GetUserByLogin(ctx, "admin")
+	require.NoError(t, err)
+	require.NoError(t, stor.InsertWriteOffBonuces(ctx, models.Withdraw{Order: "2377225616", Sum: 100 * models.Point}, user.ID))
+
+	balance, err := stor.GetUserBalance(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 500 * models.Point, Withdraw: 100 * models.Point}, balance)
+	assert.Len(t, stor.ledger, 3)
+}
+
+func TestMemStorageIdempotencyExpiry(t *testing.T) {
+	ctx := context.Background()
+	stor := NewMemStorage()
+
+	_, reserved, err := stor.ReserveIdempotencyKey(ctx, 1, "pending", "hash")
+	require.NoError(t, err)
+	require.True(t, reserved)
+	_, reserved, err = stor.ReserveIdempotencyKey(ctx, 1, "pending", "hash")
+	require.NoError(t, err)
+	assert.False(t, reserved, "key is busy while the request is in progress")
+
+	// ключ, который так и не завершили, через таймаут снова можно занять
+	stor.idempotency[memIdempotencyKey{uid: 1, key: "pending"}].createdAt = time.Now().Add(-IdempotencyPendingTimeout)
+	_, reserved, err = stor.ReserveIdempotencyKey(ctx, 1, "pending", "hash")
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	_, reserved, err = stor.ReserveIdempotencyKey(ctx, 1, "done", "hash")
+	require.NoError(t, err)
+	require.True(t, reserved)
+	require.NoError(t, stor.CompleteIdempotencyKey(ctx, 1, "done", models.IdempotentResponse{StatusCode: 200}))
+	stor.idempotency[memIdempotencyKey{uid: 1, key: "done"}].createdAt = time.Now().Add(-IdempotencyPendingTimeout)
+	stored, reserved, err := stor.ReserveIdempotencyKey(ctx, 1, "done", "hash")
+	require.NoError(t, err)
+	assert.False(t, reserved, "completed response is kept for the whole TTL")
+	assert.Equal(t, 200, stored.StatusCode)
+
+	stor.idempotency[memIdempotencyKey{uid: 1, key: "done"}].createdAt = time.Now().Add(-IdempotencyKeyTTL - time.Minute)
+	require.NoError(t, stor.DeleteExpiredIdempotencyKeys(ctx, time.Now().Add(-IdempotencyKeyTTL)))
+	assert.Len(t, stor.idempotency, 1)
+}
+
+func TestMemStorageAccrualRate(t *testing.T) {
+	ctx := context.Background()
+	stor := NewMemStorage()
+
+	uid, err := stor.InsertUser(ctx, "admin", "hash", "bcrypt")
+	require.NoError(t, err)
+	for _, order := range []string{"12345678903", "2377225624", "2377225616"} {
+		require.NoError(t, stor.InsertOrder(ctx, uid, order))
+	}
+	require.NoError(t, stor.PauseAccrualJobs(ctx, time.Now().Add(-time.Second), 1))
+	jobs, err := stor.ClaimAccrualJobs(ctx, 2, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	// две задачи при одном запросе в минуту занимают лимит на две минуты для всех реплик
+	jobs, err = stor.ClaimAccrualJobs(ctx, 2, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), stor.nextSlot, time.Second)
+
+	stor.nextSlot = time.Now()
+	jobs, err = stor.ClaimAccrualJobs(ctx, 2, time.Minute)
+	require.NoError(t, err)
+	assert.Len(t, jobs, 1)
+}
+
+func TestMemStorageDeleteExpiredSessions(t *testing.T) {
+	ctx := context.Background()
+	stor := NewMemStorage()
+
+	expires := time.Now().Add(time.Hour)
+	for _, id := range []string{"active", "revoked", "expired"} {
+		require.NoError(t, stor.CreateSession(ctx, models.Session{ID: id, UserID: 1, ExpiresAt: expires}))
+	}
+	require.NoError(t, stor.RevokeSession(ctx, "revoked"))
+	stor.sessions["expired"].ExpiresAt = time.Now().Add(-time.Second)
+	require.NoError(t, stor.CreateLoginChallenge(ctx, "live", 1, expires))
+	require.NoError(t, stor.CreateLoginChallenge(ctx, "stale", 1, time.Now().Add(-time.Second)))
+
+	require.NoError(t, stor.DeleteExpiredSessions(ctx))
+	require.NoError(t, stor.DeleteExpiredLoginChallenges(ctx))
+	assert.Len(t, stor.sessions, 1)
+	assert.Contains(t, stor.sessions, "active")
+	assert.Len(t, stor.challenges, 1)
+	assert.Contains(t, stor.challenges, "live")
+}
+
+func TestMemStorageAnonymizeRevokesAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	stor := NewMemStorage()
+
+	uid, err := stor.InsertUser(ctx, "issuer", "hash", "bcrypt")
+	require.NoError(t, err)
+	_, err = stor.CreateAPIKey(ctx, models.APIKey{ID: "key", Name: "shop", Scopes: []string{models.ScopeOrdersWrite}, CreatedBy: uid})
+	require.NoError(t, err)
+
+	require.NoError(t, stor.AnonymizeUser(ctx, uid))
+	_, err = stor.GetAPIKey(ctx, "key")
+	assert.ErrorIs(t, err, errorsstorage.ErrAPIKeyNotExist)
+}
+
+func TestMemStorageListOrdersWithoutLimit(t *testing.T) {
+	ctx := context.Background()
+	stor := NewMemStorage()
+
+	uid, err := stor.InsertUser(ctx, "lister", "hash", "bcrypt")
+	require.NoError(t, err)
+	for _, number := range []string{"12345678903", "79927398713", "4561261212345467"} {
+		require.NoError(t, stor.InsertOrder(ctx, uid, number))
+	}
+
+	page, err := stor.ListOrders(ctx, uid, models.OrderQuery{})
+	require.NoError(t, err)
+	assert.Len(t, page.Orders, 3)
+	assert.Nil(t, page.Next)
+
+	page, err = stor.ListOrders(ctx, uid, models.OrderQuery{Limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, page.Orders, 2)
+	assert.NotNil(t, page.Next)
+}
+
+func TestMemStorageListWithdrawalsWithoutLimit(t *testing.T) {
+	ctx := context.Background()
+	stor := NewMemStorage()
+
+	uid, err := stor.InsertUser(ctx, "spender", "hash", "bcrypt")
+	require.NoError(t, err)
+	require.NoError(t, stor.InsertOrder(ctx, uid, "12345678903"))
+	accrual := models.AccrualModel{OrderNumber: "12345678903", Status: models.OrderStatusProcessed, Accrual: 300 * models.Point}
+	require.NoError(t, stor.UpdateByAccrual(ctx, accrual, uid))
+	for _, order := range []string{"2377225616", "2377225624", "79927398713"} {
+		require.NoError(t, stor.InsertWriteOffBonuces(ctx, models.Withdraw{Order: order, Sum: 10 * models.Point}, uid))
+	}
+
+	page, err := stor.ListWithdrawals(ctx, uid, models.WithdrawalQuery{})
+	require.NoError(t, err)
+	assert.Len(t, page.Withdrawals, 3)
+	assert.Nil(t, page.Next)
+
+	page, err = stor.ListWithdrawals(ctx, uid, models.WithdrawalQuery{Limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, page.Withdrawals, 2)
+	assert.NotNil(t, page.Next)
+}
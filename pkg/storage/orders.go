@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+func (db *DataBaseStorage) GetOrder(ctx context.Context, order string) (models.OrderDetails, error) {
+	row := db.DB.QueryRow(ctx, "select uid, number, status, accrual, date, coalesce(updated_at, date) from orders where number = $1", order)
+	var details models.OrderDetails
+	var date, updatedAt time.Time
+	if err := row.Scan(&details.UserID, &details.Number, &details.Status, &details.Accrual, &date, &updatedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return details, errorsstorage.ErrOrderNotExist
+		}
+		return details, errors.Wrap(err, "Get order error")
+	}
+	details.Number = strings.TrimSpace(details.Number)
+	details.Status = strings.TrimSpace(details.Status)
+	details.UploadedAt = date.Format(time.RFC3339)
+	details.UpdatedAt = updatedAt.Format(time.RFC3339)
+	return details, nil
+}
+
+func (db *DataBaseStorage) ListOrders(ctx context.Context, userID int, query models.OrderQuery) (models.OrderPage, error) {
+	var page models.OrderPage
+	where := []string{"uid = $1"}
+	args := []any{userID}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if len(query.Statuses) != 0 {
+		where = append(where, "rtrim(status) = any("+arg(query.Statuses)+")")
+	}
+	if !query.From.IsZero() {
+		where = append(where, "date >= "+arg(query.From))
+	}
+	if !query.To.IsZero() {
+		where = append(where, "date < "+arg(query.To))
+	}
+	filter := strings.Join(where, " and ")
+	if err := db.DB.QueryRow(ctx, "select count(*) from orders where "+filter, args...).Scan(&page.Total); err != nil {
+		return page, errors.Wrap(err, "Count orders error")
+	}
+
+	// Порядок (date, id) совпадает с индексом orders_uid_date, поэтому курсор
+	// продолжает выдачу без OFFSET и не теряет заказы, загруженные между запросами
+	cmp, dir := ">", "asc"
+	if query.Desc {
+		cmp, dir = "<", "desc"
+	}
+	if query.After != nil {
+		filter += " and (date, id) " + cmp + " (" + arg(query.After.Date) + ", " + arg(query.After.ID) + ")"
+	}
+	limit := ""
+	if query.Limit > 0 {
+		limit = " limit " + arg(query.Limit+1)
+	}
+	rows, err := db.DB.Query(ctx, "select id, number, status, accrual, date from orders where "+filter+
+		" order by date "+dir+", id "+dir+limit, args...)
+	if err != nil {
+		return page, errors.Wrap(err, "List orders error")
+	}
+	defer rows.Close()
+	var last models.PageCursor
+	for rows.Next() {
+		if query.Limit > 0 && len(page.Orders) == query.Limit {
+			page.Next = &models.PageCursor{Date: last.Date, ID: last.ID}
+			break
+		}
+		var order models.Order
+		if err := rows.Scan(&last.ID, &order.Number, &order.Status, &order.Accrual, &last.Date); err != nil {
+			return page, errors.Wrap(err, "Parsing get order db info error")
+		}
+		order.Number = strings.TrimSpace(order.Number)
+		order.Status = strings.TrimSpace(order.Status)
+		order.UploadedAt = last.Date.Format(time.RFC3339)
+		page.Orders = append(page.Orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+	return page, nil
+}
+
+func (m *MemStorage) GetOrder(ctx context.Context, order string) (models.OrderDetails, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, ok := m.orderIndex[order]
+	if !ok {
+		return models.OrderDetails{}, errorsstorage.ErrOrderNotExist
+	}
+	return models.OrderDetails{
+		Order: models.Order{
+			Number:     o.number,
+			Status:     o.status,
+			Accrual:    o.accrual,
+			UploadedAt: o.date.Format(time.RFC3339),
+		},
+		UpdatedAt: o.updatedAt.Format(time.RFC3339),
+		UserID:    o.uid,
+	}, nil
+}
+
+func (m *MemStorage) ListOrders(ctx context.Context, userID int, query models.OrderQuery) (models.OrderPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var page models.OrderPage
+	var matched []*memOrder
+	for _, o := range m.orders {
+		if o.uid != userID || !memOrderMatches(o, query) {
+			continue
+		}
+		matched = append(matched, o)
+	}
+	page.Total = len(matched)
+	less := func(a *memOrder, date time.Time, id int64) bool {
+		return a.date.Before(date) || (a.date.Equal(date) && a.id < id)
+	}
+	sort.Slice(matched, func(i, k int) bool {
+		if query.Desc {
+			return less(matched[k], matched[i].date, matched[i].id)
+		}
+		return less(matched[i], matched[k].date, matched[k].id)
+	})
+	if query.After != nil {
+		cursor := &memOrder{date: query.After.Date, id: query.After.ID}
+		rest := matched[:0]
+		for _, o := range matched {
+			if (!query.Desc && less(cursor, o.date, o.id)) || (query.Desc && less(o, cursor.date, cursor.id)) {
+				rest = append(rest, o)
+			}
+		}
+		matched = rest
+	}
+	if query.Limit > 0 && len(matched) > query.Limit {
+		last := matched[query.Limit-1]
+		page.Next = &models.PageCursor{Date: last.date, ID: last.id}
+		matched = matched[:query.Limit]
+	}
+	for _, o := range matched {
+		page.Orders = append(page.Orders, models.Order{
+			Number:     o.number,
+			Status:     o.status,
+			Accrual:    o.accrual,
+			UploadedAt: o.date.Format(time.RFC3339),
+		})
+	}
+	return page, nil
+}
+
+func memOrderMatches(o *memOrder, query models.OrderQuery) bool {
+	if len(query.Statuses) != 0 {
+		found := false
+		for _, s := range query.Statuses {
+			found = found || s == o.status
+		}
+		if !found {
+			return false
+		}
+	}
+	if !query.From.IsZero() && o.date.Before(query.From) {
+		return false
+	}
+	if !query.To.IsZero() && !o.date.Before(query.To) {
+		return false
+	}
+	return true
+}
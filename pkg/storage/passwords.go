@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+type PasswordStorage interface {
+	GetUserByID(ctx context.Context, userID int) (models.User, error)
+	UpdatePassword(ctx context.Context, userID int, passHash string, passAlgo string) error
+	// ChangePassword в одной транзакции меняет пароль и отзывает все сессии пользователя,
+	// кроме keepSessionID (пустая строка - все).
+	ChangePassword(ctx context.Context, userID int, passHash string, passAlgo string, keepSessionID string) error
+	CreatePasswordReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error
+	// ConsumePasswordReset удаляет токен сброса и возвращает id его пользователя.
+	// Остальные токены пользователя тоже удаляются.
+	ConsumePasswordReset(ctx context.Context, tokenHash string) (int, error)
+}
+
+type memPasswordReset struct {
+	uid       int
+	expiresAt time.Time
+}
+
+func (db *DataBaseStorage) GetUserByID(ctx context.Context, userID int) (models.User, error) {
+	row := db.DB.QueryRow(ctx, "select uid, login, password, password_algo, role, blocked, deleted_at is not null from users where uid = $1", userID)
+	var user models.User
+	if err := row.Scan(&user.ID, &user.Login, &user.PasswordHash, &user.PasswordAlgo, &user.Role, &user.Blocked, &user.Deleted); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user, errorsstorage.ErrUserNotExists
+		}
+		return user, errors.Wrap(err, "Error parsing db info")
+	}
+	user.Login = strings.TrimSpace(user.Login)
+	return user, nil
+}
+
+func (db *DataBaseStorage) UpdatePassword(ctx context.Context, userID int, passHash string, passAlgo string) error {
+	tag, err := db.DB.Exec(ctx, "update users set password = $1, password_algo = $2 where uid = $3", passHash, passAlgo, userID)
+	if err != nil {
+		return errors.Wrap(err, "Update password error")
+	}
+	if tag.RowsAffected() == 0 {
+		return errorsstorage.ErrUserNotExists
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) ChangePassword(ctx context.Context, userID int, passHash string, passAlgo string, keepSessionID string) error {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "update users set password = $1, password_algo = $2 where uid = $3", passHash, passAlgo, userID)
+	if err != nil {
+		return errors.Wrap(err, "Update password error")
+	}
+	if tag.RowsAffected() == 0 {
+		return errorsstorage.ErrUserNotExists
+	}
+	_, err = tx.Exec(ctx, "update sessions set revoked_at = now() where uid = $1 and id <> $2 and revoked_at is null", userID, keepSessionID)
+	if err != nil {
+		return errors.Wrap(err, "Revoke user sessions error")
+	}
+	return tx.Commit(ctx)
+}
+
+func (db *DataBaseStorage) CreatePasswordReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	// Заодно удаляем истекшие токены всех пользователей, иначе неиспользованные копились бы
+	_, err := db.DB.Exec(ctx, "delete from password_resets where expires_at <= now()")
+	if err != nil {
+		return errors.Wrap(err, "Delete expired password resets error")
+	}
+	_, err = db.DB.Exec(ctx, "insert into password_resets (token_hash, uid, expires_at) values ($1, $2, $3)",
+		tokenHash, userID, expiresAt)
+	if err != nil {
+		return errors.Wrap(err, "Insert password reset error")
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) ConsumePasswordReset(ctx context.Context, tokenHash string) (int, error) {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, "delete from password_resets where token_hash = $1 returning uid, expires_at > now()", tokenHash)
+	var (
+		uid   int
+		valid bool
+	)
+	if err := row.Scan(&uid, &valid); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return -1, errorsstorage.ErrResetTokenNotExist
+		}
+		return -1, errors.Wrap(err, "Consume password reset error")
+	}
+	if _, err := tx.Exec(ctx, "delete from password_resets where uid = $1", uid); err != nil {
+		return -1, errors.Wrap(err, "Delete password resets error")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return -1, err
+	}
+	if !valid {
+		return -1, errorsstorage.ErrResetTokenNotExist
+	}
+	return uid, nil
+}
+
+func (m *MemStorage) GetUserByID(ctx context.Context, userID int) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return models.User{}, errorsstorage.ErrUserNotExists
+	}
+	return user.model(), nil
+}
+
+func (m *MemStorage) UpdatePassword(ctx context.Context, userID int, passHash string, passAlgo string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return errorsstorage.ErrUserNotExists
+	}
+	user.password = passHash
+	user.algo = passAlgo
+	return nil
+}
+
+func (m *MemStorage) ChangePassword(ctx context.Context, userID int, passHash string, passAlgo string, keepSessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return errorsstorage.ErrUserNotExists
+	}
+	user.password = passHash
+	user.algo = passAlgo
+	for id, session := range m.sessions {
+		if session.UserID == userID && id != keepSessionID {
+			session.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (m *MemStorage) CreatePasswordReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for hash, r := range m.resets {
+		if !r.expiresAt.After(now) {
+			delete(m.resets, hash)
+		}
+	}
+	m.resets[tokenHash] = &memPasswordReset{uid: userID, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *MemStorage) ConsumePasswordReset(ctx context.Context, tokenHash string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reset, ok := m.resets[tokenHash]
+	if !ok {
+		return -1, errorsstorage.ErrResetTokenNotExist
+	}
+	for hash, r := range m.resets {
+		if r.uid == reset.uid {
+			delete(m.resets, hash)
+		}
+	}
+	if !reset.expiresAt.After(time.Now()) {
+		return -1, errorsstorage.ErrResetTokenNotExist
+	}
+	return reset.uid, nil
+}
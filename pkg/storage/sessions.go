@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+type SessionStorage interface {
+	CreateSession(ctx context.Context, session models.Session) error
+	// GetSession возвращает только действующую сессию, иначе ErrSessionNotExist.
+	GetSession(ctx context.Context, id string) (models.Session, error)
+	// RotateSession меняет хеш refresh токена, если предъявлен текущий. Иначе ErrSessionNotExist.
+	RotateSession(ctx context.Context, id string, oldHash string, newHash string, expiresAt time.Time) error
+	RevokeSession(ctx context.Context, id string) error
+	// RevokeUserSessions отзывает все сессии пользователя, кроме exceptID (пустая строка - все).
+	RevokeUserSessions(ctx context.Context, userID int, exceptID string) error
+	// DeleteExpiredSessions удаляет истекшие и отозванные сессии всех пользователей.
+	DeleteExpiredSessions(ctx context.Context) error
+}
+
+func (db *DataBaseStorage) CreateSession(ctx context.Context, session models.Session) error {
+	_, err := db.DB.Exec(ctx, "insert into sessions (id, uid, refresh_hash, expires_at) values ($1, $2, $3, $4)",
+		session.ID, session.UserID, session.RefreshHash, session.ExpiresAt)
+	if err != nil {
+		return errors.Wrap(err, "Insert session error")
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) GetSession(ctx context.Context, id string) (models.Session, error) {
+	row := db.DB.QueryRow(ctx, `select id, uid, refresh_hash, expires_at from sessions
+		where id = $1 and revoked_at is null and expires_at > now()`, id)
+	var session models.Session
+	if err := row.Scan(&session.ID, &session.UserID, &session.RefreshHash, &session.ExpiresAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return session, errorsstorage.ErrSessionNotExist
+		}
+		return session, errors.Wrap(err, "Get session error")
+	}
+	return session, nil
+}
+
+func (db *DataBaseStorage) RotateSession(ctx context.Context, id string, oldHash string, newHash string, expiresAt time.Time) error {
+	tag, err := db.DB.Exec(ctx, `update sessions set refresh_hash = $1, expires_at = $2
+		where id = $3 and refresh_hash = $4 and revoked_at is null and expires_at > now()`,
+		newHash, expiresAt, id, oldHash)
+	if err != nil {
+		return errors.Wrap(err, "Rotate session error")
+	}
+	if tag.RowsAffected() == 0 {
+		return errorsstorage.ErrSessionNotExist
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) RevokeSession(ctx context.Context, id string) error {
+	_, err := db.DB.Exec(ctx, "update sessions set revoked_at = now() where id = $1 and revoked_at is null", id)
+	if err != nil {
+		return errors.Wrap(err, "Revoke session error")
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) RevokeUserSessions(ctx context.Context, userID int, exceptID string) error {
+	_, err := db.DB.Exec(ctx, "update sessions set revoked_at = now() where uid = $1 and id <> $2 and revoked_at is null", userID, exceptID)
+	if err != nil {
+		return errors.Wrap(err, "Revoke user sessions error")
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) DeleteExpiredSessions(ctx context.Context) error {
+	_, err := db.DB.Exec(ctx, "delete from sessions where expires_at <= now() or revoked_at is not null")
+	if err != nil {
+		return errors.Wrap(err, "Delete expired sessions error")
+	}
+	return nil
+}
+
+func (m *MemStorage) CreateSession(ctx context.Context, session models.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[session.ID] = &session
+	return nil
+}
+
+func (m *MemStorage) GetSession(ctx context.Context, id string) (models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok || session.Revoked || !session.ExpiresAt.After(time.Now()) {
+		return models.Session{}, errorsstorage.ErrSessionNotExist
+	}
+	return *session, nil
+}
+
+func (m *MemStorage) RotateSession(ctx context.Context, id string, oldHash string, newHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok || session.Revoked || !session.ExpiresAt.After(time.Now()) || session.RefreshHash != oldHash {
+		return errorsstorage.ErrSessionNotExist
+	}
+	session.RefreshHash = newHash
+	session.ExpiresAt = expiresAt
+	return nil
+}
+
+func (m *MemStorage) RevokeSession(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session, ok := m.sessions[id]; ok {
+		session.Revoked = true
+	}
+	return nil
+}
+
+func (m *MemStorage) RevokeUserSessions(ctx context.Context, userID int, exceptID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, session := range m.sessions {
+		if session.UserID == userID && id != exceptID {
+			session.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (m *MemStorage) DeleteExpiredSessions(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, session := range m.sessions {
+		if session.Revoked || !session.ExpiresAt.After(now) {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
@@ -3,7 +3,6 @@ package storage
 import (
 	"context"
 	"embed"
-	"strconv"
 	"strings"
 	"time"
 
@@ -21,49 +20,64 @@ import (
 )
 
 type Storage interface {
-	InsertUser(ctx context.Context, login string, passHash string) (string, error)
+	InsertUser(ctx context.Context, login string, passHash string, passAlgo string) (int, error)
 	CheckUser(ctx context.Context, login string, passHash string) (bool, error)
-	InsertOrder(ctx context.Context, uuid string, orderNumber string) error
-	GetAllOrders(ctx context.Context, userID string) ([]models.Order, error)
+	InsertOrder(ctx context.Context, userID int, orderNumber string) error
+	GetAllOrders(ctx context.Context, userID int) ([]models.Order, error)
 	GetUserBalance(ctx context.Context, userID int) (models.Balance, error)
 	GetUsersWithdrawls(ctx context.Context, userID int) ([]models.WithdrawInfo, error)
-	InsertWriteOffBonuces(ctx context.Context, withdraw models.Withdraw, current float32, userID int) error
-	GetUserByLogin(ctx context.Context, login string, password string) (int, string, error)
-	CheckOrder(ctx context.Context, order string) (string, error)
-	UpdateByAccrual(ctx context.Context, accrual models.AccrualModel, userID string) error
+	InsertWriteOffBonuces(ctx context.Context, withdraw models.Withdraw, userID int) error
+	GetUserByLogin(ctx context.Context, login string) (models.User, error)
+	CheckOrder(ctx context.Context, order string) (int, error)
+	// GetOrder возвращает заказ вместе с uid владельца, иначе ErrOrderNotExist.
+	GetOrder(ctx context.Context, order string) (models.OrderDetails, error)
+	UpdateByAccrual(ctx context.Context, accrual models.AccrualModel, userID int) error
 	CreateTables(ctx context.Context) error
 	ClearTables(ctx context.Context) error
-	GetNoTerminateOrders(ctx context.Context) ([]string, error)
+	ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]models.AccrualJob, error)
+	RescheduleAccrualJob(ctx context.Context, job models.AccrualJob, orderStatus string, runAt time.Time) error
+	// PauseAccrualJobs до until перестает выдавать задачи начисления всем репликам, а после
+	// выдает их не чаще perMinute в минуту на все реплики вместе, если perMinute больше нуля.
+	PauseAccrualJobs(ctx context.Context, until time.Time, perMinute int) error
 	MigrationUp(migrationPath string, dbURL string) error
+	IdempotencyStorage
+	SessionStorage
+	PasswordStorage
+	AdjustmentStorage
+	APIKeyStorage
+	TOTPStorage
+	AccountStorage
+	// ListOrders возвращает страницу заказов пользователя по фильтрам.
+	ListOrders(ctx context.Context, userID int, query models.OrderQuery) (models.OrderPage, error)
+	// ListWithdrawals возвращает страницу списаний пользователя и итоги по диапазону.
+	ListWithdrawals(ctx context.Context, userID int, query models.WithdrawalQuery) (models.WithdrawalPage, error)
+	LoginAttemptStorage
+	AdminStorage
 }
 
 type DataBaseStorage struct {
 	DB *pgxpool.Pool
 }
 
-func (db *DataBaseStorage) InsertUser(ctx context.Context, login string, passHash string) (string, error) {
-	row := db.DB.QueryRow(ctx, "insert into users (login, password) values ($1, $2) RETURNING uid;", login, passHash)
-	var uuid string
-	if err := row.Scan(&uuid); err != nil {
+func (db *DataBaseStorage) InsertUser(ctx context.Context, login string, passHash string, passAlgo string) (int, error) {
+	row := db.DB.QueryRow(ctx, "insert into users (login, password, password_algo) values ($1, $2, $3) RETURNING uid;", login, passHash, passAlgo)
+	var userID int
+	if err := row.Scan(&userID); err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
 			if pgerrcode.IsIntegrityConstraintViolation(pgErr.Code) {
 				logger.Log.Error("Register error", zap.Error(errorsstorage.ErrLoginCOnflict))
-				return ``, errorsstorage.ErrLoginCOnflict
+				return -1, errorsstorage.ErrLoginCOnflict
 			}
-			return "", err
+			return -1, err
 		}
-		return "", err
-	}
-	userID, err := strconv.Atoi(uuid)
-	if err != nil {
-		logger.Log.Error("str to int err", zap.Error(err))
+		return -1, err
 	}
-	_, err = db.DB.Exec(ctx, "insert into user_balance (uid, current, withdrawn) values ($1, 0, 0)", userID)
+	_, err := db.DB.Exec(ctx, "insert into user_balance (uid, current, withdrawn) values ($1, 0, 0)", userID)
 	if err != nil {
-		return ``, errors.Wrap(err, "Insert user balance error")
+		return -1, errors.Wrap(err, "Insert user balance error")
 	}
-	return uuid, nil
+	return userID, nil
 }
 func (db *DataBaseStorage) CheckUser(ctx context.Context, login string, passHash string) (bool, error) {
 	row := db.DB.QueryRow(ctx, "Select Exists(select * from users where login = $1 and password = $2)", login, passHash)
@@ -73,40 +87,47 @@ func (db *DataBaseStorage) CheckUser(ctx context.Context, login string, passHash
 	}
 	return exists, nil
 }
-func (db *DataBaseStorage) GetUserByLogin(ctx context.Context, login string, password string) (int, string, error) {
-	row := db.DB.QueryRow(ctx, "Select uid, password FROM users where login = $1", login)
-	var (
-		uid  int
-		pass string
-	)
-	if err := row.Scan(&uid, &pass); err != nil {
+func (db *DataBaseStorage) GetUserByLogin(ctx context.Context, login string) (models.User, error) {
+	row := db.DB.QueryRow(ctx, "Select uid, login, password, password_algo, role, blocked, deleted_at is not null FROM users where login = $1", login)
+	var user models.User
+	if err := row.Scan(&user.ID, &user.Login, &user.PasswordHash, &user.PasswordAlgo, &user.Role, &user.Blocked, &user.Deleted); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return -1, ``, errorsstorage.ErrUserNotExists
+			return user, errorsstorage.ErrUserNotExists
 		}
-		return -1, ``, errors.Wrap(err, "Error parsing db info")
+		return user, errors.Wrap(err, "Error parsing db info")
 	}
-
-	return uid, pass, nil
+	user.Login = strings.TrimSpace(user.Login)
+	return user, nil
 }
-func (db *DataBaseStorage) InsertOrder(ctx context.Context, uuid string, orderNumber string) error {
-	_, err := db.DB.Exec(ctx, "insert into orders (uid, number, status, accrual) values ($1, $2, $3, 0)", uuid, orderNumber, "NEW")
+func (db *DataBaseStorage) InsertOrder(ctx context.Context, userID int, orderNumber string) error {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "insert into orders (uid, number, status, accrual) values ($1, $2, $3, 0)", userID, orderNumber, models.OrderStatusNew)
 	if err != nil {
 		return errors.Wrap(err, "Insert order error")
 	}
-	return nil
+	_, err = tx.Exec(ctx, "insert into accrual_jobs (order_number, uid) values ($1, $2) on conflict (order_number) do nothing", orderNumber, userID)
+	if err != nil {
+		return errors.Wrap(err, "Insert accrual job error")
+	}
+	return tx.Commit(ctx)
 }
-func (db *DataBaseStorage) CheckOrder(ctx context.Context, order string) (string, error) {
+func (db *DataBaseStorage) CheckOrder(ctx context.Context, order string) (int, error) {
 	row := db.DB.QueryRow(ctx, "select uid from orders where number = $1", order)
-	var uid string
+	var uid int
 	if err := row.Scan(&uid); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return "", errorsstorage.ErrOrderNotExist
+			return -1, errorsstorage.ErrOrderNotExist
 		}
-		return "", errors.Wrap(err, "Scan row error")
+		return -1, errors.Wrap(err, "Scan row error")
 	}
 	return uid, nil
 }
-func (db *DataBaseStorage) GetAllOrders(ctx context.Context, userID string) ([]models.Order, error) {
+func (db *DataBaseStorage) GetAllOrders(ctx context.Context, userID int) ([]models.Order, error) {
 	rows, err := db.DB.Query(ctx, "select number, status, accrual, date from orders where uid = $1 order by date", userID)
 	if err != nil {
 		return nil, errors.Wrap(err, "Get orders error")
@@ -179,30 +200,73 @@ func (db *DataBaseStorage) GetUsersWithdrawls(ctx context.Context, userID int) (
 
 	return withdrawls, nil
 }
-func (db *DataBaseStorage) InsertWriteOffBonuces(ctx context.Context, withdraw models.Withdraw, current float32, userID int) error {
+func (db *DataBaseStorage) InsertWriteOffBonuces(ctx context.Context, withdraw models.Withdraw, userID int) error {
 
 	tx, err := db.DB.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
-	if _, err := tx.Prepare(ctx, "update user balance", "update user_balance set current = $1, withdrawn = $2 where uid = $3"); err != nil {
-		return err
+
+	// Строка баланса блокируется до конца транзакции, поэтому параллельные списания
+	// проверяют остаток по очереди и не могут увести его в минус
+	var current models.Points
+	if err := tx.QueryRow(ctx, "select current from user_balance where uid = $1 for update", userID).Scan(&current); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errorsstorage.ErrUserNotExists
+		}
+		return errors.Wrap(err, "Lock user balance error")
 	}
-	if _, err := tx.Prepare(ctx, "update history", `insert into withdrawals ("order", sum, uid) values ($1, $2, $3)`); err != nil {
-		return err
+	if current < withdraw.Sum {
+		return errorsstorage.ErrInsufficientFunds
+	}
+	// Уникальный индекс может отсутствовать в базе с повторами в старых данных, поэтому
+	// повтор проверяется и здесь, под той же блокировкой баланса
+	var exists bool
+	err = tx.QueryRow(ctx, `select exists(select 1 from withdrawals where uid = $1 and "order" = $2)`, userID, withdraw.Order).Scan(&exists)
+	if err != nil {
+		return errors.Wrap(err, "Check withdrawal error")
+	}
+	if exists {
+		return errorsstorage.ErrWithdrawalConflict
 	}
 
-	if _, err := tx.Exec(ctx, "update user balance", current, withdraw.Sum, userID); err != nil {
-		return err
+	if _, err := tx.Exec(ctx, `insert into withdrawals ("order", sum, uid) values ($1, $2, $3)`, withdraw.Order, withdraw.Sum, userID); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return errorsstorage.ErrWithdrawalConflict
+		}
+		return errors.Wrap(err, "Insert withdrawal error")
 	}
-	if _, err := tx.Exec(ctx, "update history", withdraw.Order, withdraw.Sum, userID); err != nil {
+	if err := appendLedgerEntry(ctx, tx, userID, models.LedgerWithdrawal, -withdraw.Sum, withdraw.Order, 0); err != nil {
 		return err
 	}
 
 	return tx.Commit(ctx)
 }
-func (db *DataBaseStorage) UpdateByAccrual(ctx context.Context, accrual models.AccrualModel, userID string) error {
+
+// appendLedgerEntry добавляет проводку в журнал balance_ledger и в той же транзакции
+// обновляет кэш баланса в user_balance. Других способов менять баланс быть не должно.
+// adjustmentID ссылается на запись balance_adjustments, для остальных проводок он 0.
+func appendLedgerEntry(ctx context.Context, tx pgx.Tx, userID int, kind string, amount models.Points, order string, adjustmentID int64) error {
+	_, err := tx.Exec(ctx, `insert into balance_ledger (uid, kind, amount, "order", adjustment_id) values ($1, $2, $3, nullif($4, ''), nullif($5, 0))`,
+		userID, kind, amount, order, adjustmentID)
+	if err != nil {
+		return errors.Wrap(err, "Insert ledger entry error")
+	}
+	var withdrawn models.Points
+	if kind == models.LedgerWithdrawal {
+		withdrawn = -amount
+	}
+	_, err = tx.Exec(ctx, "update user_balance set current = current + $1, withdrawn = withdrawn + $2 where uid = $3",
+		amount, withdrawn, userID)
+	if err != nil {
+		return errors.Wrap(err, "Update balance error")
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) UpdateByAccrual(ctx context.Context, accrual models.AccrualModel, userID int) error {
 	tx, err := db.DB.Begin(ctx)
 	if err != nil {
 		return err
@@ -210,27 +274,200 @@ func (db *DataBaseStorage) UpdateByAccrual(ctx context.Context, accrual models.A
 
 	defer tx.Rollback(ctx)
 
-	if _, err := tx.Prepare(ctx, "update order", "update orders set status = $1, accrual = $2 where number = $3"); err != nil {
-		return err
+	// Заказ в конечном статусе больше не трогаем, иначе повторная обработка задачи начислит баллы дважды
+	tag, err := tx.Exec(ctx, `update orders set status = $1, accrual = $2,
+		updated_at = case when rtrim(status) is distinct from $1::text then now() else updated_at end
+		where number = $3 and status not in ($4, $5)`,
+		accrual.Status, accrual.Accrual, accrual.OrderNumber, models.OrderStatusInvalid, models.OrderStatusProcessed)
+	if err != nil {
+		return errors.Wrap(err, "Update order error")
 	}
-	if _, err := tx.Prepare(ctx, "update balance", "update user_balance set current = $1 where uid = $2"); err != nil {
-		return err
+	final := accrual.Status == models.OrderStatusInvalid || accrual.Status == models.OrderStatusProcessed
+	if tag.RowsAffected() != 0 && accrual.Status == models.OrderStatusProcessed {
+		if err := appendLedgerEntry(ctx, tx, userID, models.LedgerAccrual, accrual.Accrual, accrual.OrderNumber, 0); err != nil {
+			return err
+		}
 	}
+	if final || tag.RowsAffected() == 0 {
+		if _, err := tx.Exec(ctx, "delete from accrual_jobs where order_number = $1", accrual.OrderNumber); err != nil {
+			return errors.Wrap(err, "Delete accrual job error")
+		}
+	}
+	return tx.Commit(ctx)
+}
 
-	if _, err := tx.Exec(ctx, "update order", accrual.Status, accrual.Accrual, accrual.OrderNumber); err != nil {
-		return err
+func (db *DataBaseStorage) ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]models.AccrualJob, error) {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Строку паузы блокируем, чтобы реплики по очереди расходовали общий лимит запросов
+	var perMinute int
+	ready := true
+	err = tx.QueryRow(ctx, `select requests_per_minute, paused_until <= now() and coalesce(next_slot, now()) <= now()
+		from accrual_pause for update`).Scan(&perMinute, &ready)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, errors.Wrap(err, "Get accrual pause error")
+	}
+	if !ready {
+		return nil, nil
+	}
+
+	// Задачи захватываются арендой: next_run_at сдвигается вперёд, поэтому другие реплики
+	// не возьмут их, пока аренда не истечёт, а SKIP LOCKED не даёт им ждать друг друга
+	rows, err := tx.Query(ctx, `update accrual_jobs set next_run_at = now() + make_interval(secs => $2)
+	where id in (
+		select id from accrual_jobs where next_run_at <= now()
+		order by next_run_at limit $1
+		for update skip locked
+	)
+	returning id, order_number, uid, attempts`, limit, lease.Seconds())
+	if err != nil {
+		return nil, errors.Wrap(err, "Claim accrual jobs error")
+	}
+	var jobs []models.AccrualJob
+	for rows.Next() {
+		var job models.AccrualJob
+		if err := rows.Scan(&job.ID, &job.OrderNumber, &job.UserID, &job.Attempts); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "Parsing accrual job error")
+		}
+		jobs = append(jobs, job)
 	}
-	uid, err := strconv.Atoi(userID)
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Каждая задача - один запрос: следующую выдачу любой реплике откладываем на столько,
+	// сколько занимают эти запросы при разрешенной частоте
+	if perMinute > 0 && len(jobs) > 0 {
+		_, err = tx.Exec(ctx, "update accrual_pause set next_slot = now() + make_interval(secs => $1)",
+			float64(len(jobs))*60/float64(perMinute))
+		if err != nil {
+			return nil, errors.Wrap(err, "Update accrual pause error")
+		}
+	}
+	return jobs, tx.Commit(ctx)
+}
+
+func (db *DataBaseStorage) PauseAccrualJobs(ctx context.Context, until time.Time, perMinute int) error {
+	_, err := db.DB.Exec(ctx, `insert into accrual_pause (id, paused_until, requests_per_minute) values (true, $1, $2)
+	on conflict (id) do update set paused_until = greatest(accrual_pause.paused_until, excluded.paused_until),
+		requests_per_minute = case when excluded.requests_per_minute > 0
+			then excluded.requests_per_minute else accrual_pause.requests_per_minute end`, until, perMinute)
 	if err != nil {
-		logger.Log.Error("str to int err", zap.Error(err))
+		return errors.Wrap(err, "Pause accrual jobs error")
 	}
-	logger.Log.Info("UserID", zap.String("UserId str", userID), zap.Int("UserId int", uid))
-	if _, err := tx.Exec(ctx, "update balance", accrual.Accrual, uid); err != nil {
+	return nil
+}
+
+func (db *DataBaseStorage) RescheduleAccrualJob(ctx context.Context, job models.AccrualJob, orderStatus string, runAt time.Time) error {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
+
+	if orderStatus != "" {
+		_, err = tx.Exec(ctx, `update orders set status = $1,
+			updated_at = case when rtrim(status) is distinct from $1::text then now() else updated_at end
+			where number = $2 and status not in ($3, $4)`,
+			orderStatus, job.OrderNumber, models.OrderStatusInvalid, models.OrderStatusProcessed)
+		if err != nil {
+			return errors.Wrap(err, "Update order status error")
+		}
+	}
+	_, err = tx.Exec(ctx, "update accrual_jobs set attempts = $1, next_run_at = $2 where id = $3", job.Attempts, runAt, job.ID)
+	if err != nil {
+		return errors.Wrap(err, "Reschedule accrual job error")
+	}
 	return tx.Commit(ctx)
 }
 
+// columnType возвращает тип колонки из information_schema, например "text" или "character".
+func columnType(ctx context.Context, tx pgx.Tx, table string, column string) (string, error) {
+	var dataType string
+	err := tx.QueryRow(ctx, `SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`, table, column).Scan(&dataType)
+	if err != nil {
+		return "", err
+	}
+	return dataType, nil
+}
+
+// isPointsColumn проверяет, что колонка уже имеет тип numeric(18,2).
+func isPointsColumn(ctx context.Context, tx pgx.Tx, table string, column string) (bool, error) {
+	var dataType string
+	var precision, scale *int
+	err := tx.QueryRow(ctx, `SELECT data_type, numeric_precision, numeric_scale FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`, table, column).Scan(&dataType, &precision, &scale)
+	if err != nil {
+		return false, err
+	}
+	return dataType == "numeric" && precision != nil && *precision == 18 && scale != nil && *scale == 2, nil
+}
+
+// claimSchemaStep отмечает одноразовый шаг схемы выполненным и возвращает true, если его
+// еще никто не выполнял. Параллельный старт другой реплики ждет на первичном ключе и получает false.
+func claimSchemaStep(ctx context.Context, tx pgx.Tx, name string) (bool, error) {
+	tag, err := tx.Exec(ctx, `INSERT INTO schema_steps (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, name)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// backfillBalanceLedger переносит в журнал балансы, накопленные до его появления: списания как есть,
+// а остаток - одной корректировкой, чтобы сумма проводок совпала с текущим балансом. Затем балансы,
+// разошедшиеся с журналом, пересчитываются по нему, и каждое исправление пишется в лог.
+func backfillBalanceLedger(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, `WITH legacy AS (
+			SELECT b.uid, b.current, coalesce((SELECT sum(w.sum) FROM withdrawals w WHERE w.uid = b.uid), 0) AS withdrawn
+			FROM user_balance b
+			WHERE NOT EXISTS (SELECT 1 FROM balance_ledger l WHERE l.uid = b.uid)
+		)
+		INSERT INTO balance_ledger (uid, kind, amount, "order", created_at)
+		SELECT w.uid, 'withdrawal', -w.sum, btrim(w."order"), w.processed_at
+		FROM withdrawals w JOIN legacy USING (uid)
+		UNION ALL
+		SELECT uid, 'adjustment', current + withdrawn, NULL, now()
+		FROM legacy WHERE current + withdrawn <> 0`)
+	if err != nil {
+		return errors.Wrap(err, "balance_ledger backfill err")
+	}
+	// Внешний select видит user_balance до обновления, поэтому возвращает и старые значения
+	rows, err := tx.Query(ctx, `WITH ledger AS (
+			SELECT uid, sum(amount) AS current, coalesce(-sum(amount) FILTER (WHERE kind = 'withdrawal'), 0) AS withdrawn
+			FROM balance_ledger GROUP BY uid
+		), fixed AS (
+			UPDATE user_balance b SET current = l.current, withdrawn = l.withdrawn
+			FROM ledger l
+			WHERE b.uid = l.uid AND (b.current <> l.current OR b.withdrawn <> l.withdrawn)
+			RETURNING b.uid, l.current, l.withdrawn
+		)
+		SELECT f.uid, old.current, old.withdrawn, f.current, f.withdrawn
+		FROM fixed f JOIN user_balance old ON old.uid = f.uid`)
+	if err != nil {
+		return errors.Wrap(err, "user_balance rebuild err")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid int
+		var was, now models.Balance
+		if err := rows.Scan(&uid, &was.Current, &was.Withdraw, &now.Current, &now.Withdraw); err != nil {
+			return errors.Wrap(err, "user_balance rebuild err")
+		}
+		logger.Log.Warn("User balance differed from ledger and was rebuilt",
+			zap.Int("uid", uid),
+			zap.Stringer("current_was", was.Current), zap.Stringer("current", now.Current),
+			zap.Stringer("withdrawn_was", was.Withdraw), zap.Stringer("withdrawn", now.Withdraw))
+	}
+	return errors.Wrap(rows.Err(), "user_balance rebuild err")
+}
+
 func (db *DataBaseStorage) CreateTables(ctx context.Context) error {
 	tx, err := db.DB.Begin(ctx)
 	if err != nil {
@@ -241,24 +478,68 @@ func (db *DataBaseStorage) CreateTables(ctx context.Context) error {
 	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS users
 	(
 			uid serial PRIMARY KEY,
-			login character(255) NOT NULL,
-			password character(64) NOT NULL
+			login text NOT NULL,
+			password text NOT NULL,
+			password_algo text NOT NULL DEFAULT 'bcrypt',
+			role text NOT NULL DEFAULT 'user',
+			blocked boolean NOT NULL DEFAULT false,
+			deleted_at timestamp with time zone
 	)`)
 	if err != nil {
 		return errors.Wrap(err, "users table err")
 	}
+	// character(64) дополнял хеши пробелами и не вмещал argon2id. Смена типа переписывает
+	// таблицу под эксклюзивной блокировкой, поэтому выполняется только один раз
+	passwordType, err := columnType(ctx, tx, "users", "password")
+	if err != nil {
+		return errors.Wrap(err, "users password column err")
+	}
+	if passwordType != "text" {
+		_, err = tx.Exec(ctx, `ALTER TABLE users ALTER COLUMN password TYPE text USING rtrim(password)`)
+		if err != nil {
+			return errors.Wrap(err, "users password column err")
+		}
+	}
+	_, err = tx.Exec(ctx, `ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS password_algo text NOT NULL DEFAULT 'bcrypt',
+		ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'user',
+		ADD COLUMN IF NOT EXISTS blocked boolean NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone`)
+	if err != nil {
+		return errors.Wrap(err, "users columns err")
+	}
 
 	_, err = tx.Exec(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS login_id ON users (login)`)
 	if err != nil {
 		return errors.Wrap(err, "users index err")
 	}
+	// Логины теперь хранятся нормализованными. Старые записи, которые после нормализации
+	// совпали бы с другим пользователем, оставляем как есть, чтобы не нарушить уникальность.
+	// Переход выполняется один раз, пока колонка еще character
+	loginType, err := columnType(ctx, tx, "users", "login")
+	if err != nil {
+		return errors.Wrap(err, "users login column err")
+	}
+	if loginType != "text" {
+		_, err = tx.Exec(ctx, `ALTER TABLE users ALTER COLUMN login TYPE text USING rtrim(login)`)
+		if err != nil {
+			return errors.Wrap(err, "users login column err")
+		}
+		_, err = tx.Exec(ctx, `UPDATE users SET login = lower(btrim(login))
+		WHERE login <> lower(btrim(login)) AND NOT EXISTS (
+			SELECT 1 FROM users other WHERE other.uid <> users.uid AND lower(btrim(other.login)) = lower(btrim(users.login))
+		)`)
+		if err != nil {
+			return errors.Wrap(err, "users login normalization err")
+		}
+	}
 
 	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS user_balance
 	(
 		id serial PRIMARY KEY,
 		uid integer NOT NULL,
-		current numeric(5,2) NOT NULL,
-		withdrawn numeric(5,2) NOT NULL,
+		current numeric(18,2) NOT NULL,
+		withdrawn numeric(18,2) NOT NULL,
 		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
 	)`)
 	if err != nil {
@@ -269,7 +550,7 @@ func (db *DataBaseStorage) CreateTables(ctx context.Context) error {
 		id serial PRIMARY KEY,
 		"number" character(55) NOT NULL,
 		status character(125),
-		accrual numeric(5,2),
+		accrual numeric(18,2),
 		date timestamp with time zone NOT NULL DEFAULT now(),
 		uid integer NOT NULL DEFAULT 1,
 		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
@@ -278,16 +559,26 @@ func (db *DataBaseStorage) CreateTables(ctx context.Context) error {
 		return errors.Wrap(err, "orders table err")
 	}
 
+	_, err = tx.Exec(ctx, `ALTER TABLE orders ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone`)
+	if err != nil {
+		return errors.Wrap(err, "orders columns err")
+	}
+
 	_, err = tx.Exec(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS order_id ON orders (number)`)
 	if err != nil {
 		return errors.Wrap(err, "orders table index err")
 	}
 
+	_, err = tx.Exec(ctx, `CREATE INDEX IF NOT EXISTS orders_uid_date ON orders (uid, date, id)`)
+	if err != nil {
+		return errors.Wrap(err, "orders table index err")
+	}
+
 	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS withdrawals
 	(
 		w_id serial PRIMARY KEY,
 		"order" character(255) NOT NULL,
-		sum numeric(5,2) NOT NULL,
+		sum numeric(18,2) NOT NULL,
 		processed_at timestamp with time zone NOT NULL DEFAULT now(),
 		uid integer NOT NULL,
 		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
@@ -299,6 +590,301 @@ func (db *DataBaseStorage) CreateTables(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "withdrawals table index err")
 	}
+
+	_, err = tx.Exec(ctx, `CREATE INDEX IF NOT EXISTS withdrawals_uid_processed_at ON withdrawals (uid, processed_at, w_id)`)
+	if err != nil {
+		return errors.Wrap(err, "withdrawals table index err")
+	}
+
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS accrual_jobs
+	(
+		id bigserial PRIMARY KEY,
+		order_number text NOT NULL,
+		uid integer NOT NULL,
+		attempts integer NOT NULL DEFAULT 0,
+		next_run_at timestamp with time zone NOT NULL DEFAULT now(),
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "accrual_jobs table err")
+	}
+	_, err = tx.Exec(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS accrual_jobs_order ON accrual_jobs (order_number)`)
+	if err != nil {
+		return errors.Wrap(err, "accrual_jobs table index err")
+	}
+	_, err = tx.Exec(ctx, `CREATE INDEX IF NOT EXISTS accrual_jobs_next_run ON accrual_jobs (next_run_at)`)
+	if err != nil {
+		return errors.Wrap(err, "accrual_jobs table index err")
+	}
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS balance_ledger
+	(
+		id bigserial PRIMARY KEY,
+		uid integer NOT NULL,
+		kind text NOT NULL,
+		amount numeric(18,2) NOT NULL,
+		"order" text,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "balance_ledger table err")
+	}
+	_, err = tx.Exec(ctx, `CREATE INDEX IF NOT EXISTS balance_ledger_uid ON balance_ledger (uid, created_at)`)
+	if err != nil {
+		return errors.Wrap(err, "balance_ledger table index err")
+	}
+	_, err = tx.Exec(ctx, `CREATE OR REPLACE FUNCTION balance_ledger_immutable() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'balance_ledger entries are immutable';
+	END;
+	$$ LANGUAGE plpgsql`)
+	if err != nil {
+		return errors.Wrap(err, "balance_ledger trigger func err")
+	}
+	_, err = tx.Exec(ctx, `DROP TRIGGER IF EXISTS balance_ledger_no_update ON balance_ledger`)
+	if err != nil {
+		return errors.Wrap(err, "balance_ledger trigger err")
+	}
+	_, err = tx.Exec(ctx, `CREATE TRIGGER balance_ledger_no_update BEFORE UPDATE ON balance_ledger
+		FOR EACH ROW EXECUTE FUNCTION balance_ledger_immutable()`)
+	if err != nil {
+		return errors.Wrap(err, "balance_ledger trigger err")
+	}
+	// Перенос старых балансов в журнал и сверка балансов с ним проходят по всем пользователям,
+	// поэтому выполняются один раз, а не на каждом старте
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_steps
+	(
+		name text PRIMARY KEY,
+		applied_at timestamp with time zone NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "schema_steps table err")
+	}
+	backfill, err := claimSchemaStep(ctx, tx, "balance_ledger_backfill")
+	if err != nil {
+		return errors.Wrap(err, "schema_steps err")
+	}
+	if backfill {
+		if err := backfillBalanceLedger(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	// Если в старых данных уже есть повторные списания по одному заказу, индекс не создастся и
+	// откатит всю схему. Такие записи нужно разобрать вручную, автоматически удалять финансовые
+	// данные нельзя, поэтому до тех пор индекс пропускаем
+	var duplicates bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM withdrawals GROUP BY uid, "order" HAVING count(*) > 1)`).Scan(&duplicates)
+	if err != nil {
+		return errors.Wrap(err, "withdrawals duplicates check err")
+	}
+	if duplicates {
+		logger.Log.Warn("Duplicate withdrawals found, unique index withdrawals_uid_order is not created")
+	} else {
+		_, err = tx.Exec(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS withdrawals_uid_order ON withdrawals (uid, "order")`)
+		if err != nil {
+			return errors.Wrap(err, "withdrawals table index err")
+		}
+	}
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS idempotency_keys
+	(
+		uid integer NOT NULL,
+		key text NOT NULL,
+		request_hash text NOT NULL,
+		status_code integer NOT NULL DEFAULT 0,
+		content_type text NOT NULL DEFAULT '',
+		body bytea,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		PRIMARY KEY (uid, key),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "idempotency_keys table err")
+	}
+	_, err = tx.Exec(ctx, `CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at)`)
+	if err != nil {
+		return errors.Wrap(err, "idempotency_keys table index err")
+	}
+
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS sessions
+	(
+		id text PRIMARY KEY,
+		uid integer NOT NULL,
+		refresh_hash text NOT NULL,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		expires_at timestamp with time zone NOT NULL,
+		revoked_at timestamp with time zone,
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "sessions table err")
+	}
+	_, err = tx.Exec(ctx, `CREATE INDEX IF NOT EXISTS sessions_uid ON sessions (uid)`)
+	if err != nil {
+		return errors.Wrap(err, "sessions table index err")
+	}
+	_, err = tx.Exec(ctx, `CREATE INDEX IF NOT EXISTS sessions_expires_at ON sessions (expires_at)`)
+	if err != nil {
+		return errors.Wrap(err, "sessions table index err")
+	}
+
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS password_resets
+	(
+		token_hash text PRIMARY KEY,
+		uid integer NOT NULL,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		expires_at timestamp with time zone NOT NULL,
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "password_resets table err")
+	}
+	_, err = tx.Exec(ctx, `CREATE INDEX IF NOT EXISTS password_resets_expires_at ON password_resets (expires_at)`)
+	if err != nil {
+		return errors.Wrap(err, "password_resets table index err")
+	}
+
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS login_attempts
+	(
+		scope text NOT NULL,
+		key text NOT NULL,
+		failures integer NOT NULL DEFAULT 0,
+		locked_until timestamp with time zone,
+		updated_at timestamp with time zone NOT NULL DEFAULT now(),
+		PRIMARY KEY (scope, key)
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "login_attempts table err")
+	}
+
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS balance_adjustments
+	(
+		id bigserial PRIMARY KEY,
+		uid integer NOT NULL,
+		amount numeric(18,2) NOT NULL,
+		reason text NOT NULL,
+		comment text NOT NULL DEFAULT '',
+		operator_id integer NOT NULL,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE,
+		FOREIGN KEY (operator_id) REFERENCES users (uid) ON UPDATE CASCADE
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "balance_adjustments table err")
+	}
+	_, err = tx.Exec(ctx, `CREATE INDEX IF NOT EXISTS balance_adjustments_uid ON balance_adjustments (uid, created_at)`)
+	if err != nil {
+		return errors.Wrap(err, "balance_adjustments table index err")
+	}
+	_, err = tx.Exec(ctx, `ALTER TABLE balance_ledger
+		ADD COLUMN IF NOT EXISTS adjustment_id bigint REFERENCES balance_adjustments (id)`)
+	if err != nil {
+		return errors.Wrap(err, "balance_ledger columns err")
+	}
+
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS api_keys
+	(
+		id text PRIMARY KEY,
+		name text NOT NULL,
+		key_hash text NOT NULL,
+		scopes text[] NOT NULL,
+		created_by integer NOT NULL,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		last_used_at timestamp with time zone,
+		revoked_at timestamp with time zone,
+		FOREIGN KEY (created_by) REFERENCES users (uid) ON UPDATE CASCADE
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "api_keys table err")
+	}
+
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS user_totp
+	(
+		uid integer PRIMARY KEY,
+		secret text NOT NULL,
+		enabled boolean NOT NULL DEFAULT false,
+		last_step bigint NOT NULL DEFAULT 0,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "user_totp table err")
+	}
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS totp_recovery_codes
+	(
+		uid integer NOT NULL,
+		code_hash text NOT NULL,
+		PRIMARY KEY (uid, code_hash),
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "totp_recovery_codes table err")
+	}
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS login_challenges
+	(
+		token_hash text PRIMARY KEY,
+		uid integer NOT NULL,
+		attempts integer NOT NULL DEFAULT 0,
+		expires_at timestamp with time zone NOT NULL,
+		FOREIGN KEY (uid) REFERENCES users (uid) ON UPDATE CASCADE ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "login_challenges table err")
+	}
+	_, err = tx.Exec(ctx, `CREATE INDEX IF NOT EXISTS login_challenges_expires_at ON login_challenges (expires_at)`)
+	if err != nil {
+		return errors.Wrap(err, "login_challenges table index err")
+	}
+
+	// Одна строка на всю систему: пауза после 429 от системы расчета и разрешенная частота
+	// запросов действуют на все реплики
+	_, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS accrual_pause
+	(
+		id boolean PRIMARY KEY DEFAULT true CHECK (id),
+		paused_until timestamp with time zone NOT NULL,
+		requests_per_minute integer NOT NULL DEFAULT 0,
+		next_slot timestamp with time zone
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "accrual_pause table err")
+	}
+	_, err = tx.Exec(ctx, `ALTER TABLE accrual_pause
+		ADD COLUMN IF NOT EXISTS requests_per_minute integer NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS next_slot timestamp with time zone`)
+	if err != nil {
+		return errors.Wrap(err, "accrual_pause columns err")
+	}
+
+	// Таблицы, созданные до перехода на numeric(18,2), расширяем на месте. ALTER берет
+	// эксклюзивную блокировку, поэтому тип меняем только у колонок, которые еще не расширены
+	for _, col := range []struct{ table, column string }{
+		{"user_balance", "current"},
+		{"user_balance", "withdrawn"},
+		{"orders", "accrual"},
+		{"withdrawals", "sum"},
+		{"balance_ledger", "amount"},
+	} {
+		wide, err := isPointsColumn(ctx, tx, col.table, col.column)
+		if err != nil {
+			return errors.Wrap(err, col.table+" columns err")
+		}
+		if wide {
+			continue
+		}
+		_, err = tx.Exec(ctx, `ALTER TABLE `+col.table+` ALTER COLUMN `+col.column+` TYPE numeric(18,2)`)
+		if err != nil {
+			return errors.Wrap(err, col.table+" columns err")
+		}
+	}
+
+	// Незавершённые заказы, загруженные до появления очереди, тоже должны дойти до системы начислений
+	_, err = tx.Exec(ctx, `INSERT INTO accrual_jobs (order_number, uid)
+		SELECT btrim(number), uid FROM orders WHERE status NOT IN ('INVALID', 'PROCESSED')
+		ON CONFLICT (order_number) DO NOTHING`)
+	if err != nil {
+		return errors.Wrap(err, "accrual_jobs backfill err")
+	}
 	return tx.Commit(ctx)
 }
 
@@ -327,6 +913,66 @@ func (db *DataBaseStorage) ClearTables(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "withdrawals table err")
 	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM accrual_jobs`)
+	if err != nil {
+		return errors.Wrap(err, "accrual_jobs table err")
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM balance_ledger`)
+	if err != nil {
+		return errors.Wrap(err, "balance_ledger table err")
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM balance_adjustments`)
+	if err != nil {
+		return errors.Wrap(err, "balance_adjustments table err")
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM idempotency_keys`)
+	if err != nil {
+		return errors.Wrap(err, "idempotency_keys table err")
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM login_challenges`)
+	if err != nil {
+		return errors.Wrap(err, "login_challenges table err")
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM totp_recovery_codes`)
+	if err != nil {
+		return errors.Wrap(err, "totp_recovery_codes table err")
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM user_totp`)
+	if err != nil {
+		return errors.Wrap(err, "user_totp table err")
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM api_keys`)
+	if err != nil {
+		return errors.Wrap(err, "api_keys table err")
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM sessions`)
+	if err != nil {
+		return errors.Wrap(err, "sessions table err")
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM password_resets`)
+	if err != nil {
+		return errors.Wrap(err, "password_resets table err")
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM login_attempts`)
+	if err != nil {
+		return errors.Wrap(err, "login_attempts table err")
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM accrual_pause`)
+	if err != nil {
+		return errors.Wrap(err, "accrual_pause table err")
+	}
 	return tx.Commit(ctx)
 }
 
@@ -353,29 +999,3 @@ func (db *DataBaseStorage) MigrationUp(migrationPath string, dbURL string) error
 	logger.Log.Info("Migration applied succsessfully")
 	return nil
 }
-
-func (db *DataBaseStorage) GetNoTerminateOrders(ctx context.Context) ([]string, error) {
-	row, err := db.DB.Query(ctx, `SELECT number FROM orders WHERE status != 'INVALID' or status !='PROCESSED'`)
-	if err != nil {
-		return nil, errors.Wrap(err, "Get orders error")
-	}
-	defer row.Close()
-	var orderNumbers []string
-	for row.Next() {
-		var orderNumber string
-		if err := row.Scan(&orderNumber); err != nil {
-			return nil, errors.Wrap(err, "Parsing withdrawls info error")
-		}
-		orderNumbers = append(orderNumbers, orderNumber)
-	}
-	err = row.Err()
-	if err != nil {
-		return nil, err
-	}
-
-	if len(orderNumbers) == 0 {
-		return nil, errorsstorage.ErrOrderNotExist
-	}
-
-	return orderNumbers, nil
-}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/Dorrrke/loyality-system.git/pkg/storage/errorsstorage"
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+type TOTPStorage interface {
+	GetTOTP(ctx context.Context, userID int) (models.TOTP, error)
+	// SaveTOTPSecret выдает новый секрет, еще не включенный.
+	SaveTOTPSecret(ctx context.Context, userID int, secret string) error
+	// EnableTOTP включает второй фактор и заменяет коды восстановления.
+	EnableTOTP(ctx context.Context, userID int, step int64, recoveryHashes []string) error
+	DisableTOTP(ctx context.Context, userID int) error
+	// UseTOTPStep запоминает интервал принятого кода; false, если код этого или более
+	// позднего интервала уже использован.
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	// UseRecoveryCode удаляет код восстановления; false, если такого кода нет.
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error)
+	CreateLoginChallenge(ctx context.Context, tokenHash string, userID int, expiresAt time.Time) error
+	// ReserveLoginChallengeAttempt до проверки кода списывает одну попытку действующего challenge
+	// и возвращает его пользователя. ErrChallengeNotExist, если challenge нет, он истек или
+	// попытки кончились.
+	ReserveLoginChallengeAttempt(ctx context.Context, tokenHash string, maxAttempts int) (int, error)
+	DeleteLoginChallenge(ctx context.Context, tokenHash string) error
+	// DeleteExpiredLoginChallenges удаляет истекшие challenge всех пользователей.
+	DeleteExpiredLoginChallenges(ctx context.Context) error
+}
+
+type memTOTP struct {
+	totp     models.TOTP
+	recovery map[string]struct{}
+}
+
+type memLoginChallenge struct {
+	uid       int
+	attempts  int
+	expiresAt time.Time
+}
+
+func (db *DataBaseStorage) GetTOTP(ctx context.Context, userID int) (models.TOTP, error) {
+	row := db.DB.QueryRow(ctx, "select uid, secret, enabled, last_step from user_totp where uid = $1", userID)
+	var totp models.TOTP
+	if err := row.Scan(&totp.UserID, &totp.Secret, &totp.Enabled, &totp.LastStep); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return totp, errorsstorage.ErrTOTPNotExist
+		}
+		return totp, errors.Wrap(err, "Get totp error")
+	}
+	return totp, nil
+}
+
+func (db *DataBaseStorage) SaveTOTPSecret(ctx context.Context, userID int, secret string) error {
+	_, err := db.DB.Exec(ctx, `insert into user_totp (uid, secret) values ($1, $2)
+		on conflict (uid) do update set secret = excluded.secret, enabled = false, last_step = 0, created_at = now()`,
+		userID, secret)
+	if err != nil {
+		return errors.Wrap(err, "Save totp secret error")
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) EnableTOTP(ctx context.Context, userID int, step int64, recoveryHashes []string) error {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "update user_totp set enabled = true, last_step = $1 where uid = $2", step, userID)
+	if err != nil {
+		return errors.Wrap(err, "Enable totp error")
+	}
+	if tag.RowsAffected() == 0 {
+		return errorsstorage.ErrTOTPNotExist
+	}
+	if _, err := tx.Exec(ctx, "delete from totp_recovery_codes where uid = $1", userID); err != nil {
+		return errors.Wrap(err, "Delete recovery codes error")
+	}
+	for _, hash := range recoveryHashes {
+		if _, err := tx.Exec(ctx, "insert into totp_recovery_codes (uid, code_hash) values ($1, $2)", userID, hash); err != nil {
+			return errors.Wrap(err, "Insert recovery code error")
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (db *DataBaseStorage) DisableTOTP(ctx context.Context, userID int) error {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "delete from totp_recovery_codes where uid = $1", userID); err != nil {
+		return errors.Wrap(err, "Delete recovery codes error")
+	}
+	if _, err := tx.Exec(ctx, "delete from user_totp where uid = $1", userID); err != nil {
+		return errors.Wrap(err, "Disable totp error")
+	}
+	return tx.Commit(ctx)
+}
+
+func (db *DataBaseStorage) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	tag, err := db.DB.Exec(ctx, "update user_totp set last_step = $1 where uid = $2 and last_step < $1", step, userID)
+	if err != nil {
+		return false, errors.Wrap(err, "Use totp step error")
+	}
+	return tag.RowsAffected() != 0, nil
+}
+
+func (db *DataBaseStorage) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	tag, err := db.DB.Exec(ctx, "delete from totp_recovery_codes where uid = $1 and code_hash = $2", userID, codeHash)
+	if err != nil {
+		return false, errors.Wrap(err, "Use recovery code error")
+	}
+	return tag.RowsAffected() != 0, nil
+}
+
+func (db *DataBaseStorage) CreateLoginChallenge(ctx context.Context, tokenHash string, userID int, expiresAt time.Time) error {
+	_, err := db.DB.Exec(ctx, "insert into login_challenges (token_hash, uid, expires_at) values ($1, $2, $3)",
+		tokenHash, userID, expiresAt)
+	if err != nil {
+		return errors.Wrap(err, "Insert login challenge error")
+	}
+	return nil
+}
+
+func (db *DataBaseStorage) ReserveLoginChallengeAttempt(ctx context.Context, tokenHash string, maxAttempts int) (int, error) {
+	// Попытка списывается одним update, поэтому параллельные запросы не проверят больше maxAttempts кодов
+	row := db.DB.QueryRow(ctx, `update login_challenges set attempts = attempts + 1
+		where token_hash = $1 and expires_at > now() and attempts < $2 returning uid`, tokenHash, maxAttempts)
+	var uid int
+	if err := row.Scan(&uid); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return -1, errorsstorage.ErrChallengeNotExist
+		}
+		return -1, errors.Wrap(err, "Reserve login challenge attempt error")
+	}
+	return uid, nil
+}
+
+func (db *DataBaseStorage) DeleteLoginChallenge(ctx context.Context, tokenHash string) error {
+	_, err := db.DB.Exec(ctx, "delete from login_challenges where token_hash = $1", tokenHash)
+	if err != nil {
+		return errors.Wrap(err, "Delete login challenge error")
+	}
+	return nil
+}
+
+func (m *MemStorage) GetTOTP(ctx context.Context, userID int) (models.TOTP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totp[userID]
+	if !ok {
+		return models.TOTP{}, errorsstorage.ErrTOTPNotExist
+	}
+	return t.totp, nil
+}
+
+func (m *MemStorage) SaveTOTPSecret(ctx context.Context, userID int, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.totp[userID] = &memTOTP{
+		totp:     models.TOTP{UserID: userID, Secret: secret},
+		recovery: make(map[string]struct{}),
+	}
+	return nil
+}
+
+func (m *MemStorage) EnableTOTP(ctx context.Context, userID int, step int64, recoveryHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totp[userID]
+	if !ok {
+		return errorsstorage.ErrTOTPNotExist
+	}
+	t.totp.Enabled = true
+	t.totp.LastStep = step
+	t.recovery = make(map[string]struct{}, len(recoveryHashes))
+	for _, hash := range recoveryHashes {
+		t.recovery[hash] = struct{}{}
+	}
+	return nil
+}
+
+func (m *MemStorage) DisableTOTP(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.totp, userID)
+	return nil
+}
+
+func (m *MemStorage) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totp[userID]
+	if !ok || t.totp.LastStep >= step {
+		return false, nil
+	}
+	t.totp.LastStep = step
+	return true, nil
+}
+
+func (m *MemStorage) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totp[userID]
+	if !ok {
+		return false, nil
+	}
+	if _, ok := t.recovery[codeHash]; !ok {
+		return false, nil
+	}
+	delete(t.recovery, codeHash)
+	return true, nil
+}
+
+func (db *DataBaseStorage) DeleteExpiredLoginChallenges(ctx context.Context) error {
+	_, err := db.DB.Exec(ctx, "delete from login_challenges where expires_at <= now()")
+	if err != nil {
+		return errors.Wrap(err, "Delete expired login challenges error")
+	}
+	return nil
+}
+
+func (m *MemStorage) CreateLoginChallenge(ctx context.Context, tokenHash string, userID int, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.challenges[tokenHash] = &memLoginChallenge{uid: userID, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *MemStorage) ReserveLoginChallengeAttempt(ctx context.Context, tokenHash string, maxAttempts int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.challenges[tokenHash]
+	if !ok || !c.expiresAt.After(time.Now()) || c.attempts >= maxAttempts {
+		return -1, errorsstorage.ErrChallengeNotExist
+	}
+	c.attempts++
+	return c.uid, nil
+}
+
+func (m *MemStorage) DeleteLoginChallenge(ctx context.Context, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.challenges, tokenHash)
+	return nil
+}
+
+func (m *MemStorage) DeleteExpiredLoginChallenges(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for hash, c := range m.challenges {
+		if !c.expiresAt.After(now) {
+			delete(m.challenges, hash)
+		}
+	}
+	return nil
+}
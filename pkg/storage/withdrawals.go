@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dorrrke/loyality-system.git/pkg/models"
+	"github.com/pkg/errors"
+)
+
+func (db *DataBaseStorage) ListWithdrawals(ctx context.Context, userID int, query models.WithdrawalQuery) (models.WithdrawalPage, error) {
+	var page models.WithdrawalPage
+	where := []string{"uid = $1"}
+	args := []any{userID}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if !query.From.IsZero() {
+		where = append(where, "processed_at >= "+arg(query.From))
+	}
+	if !query.To.IsZero() {
+		where = append(where, "processed_at < "+arg(query.To))
+	}
+	filter := strings.Join(where, " and ")
+	err := db.DB.QueryRow(ctx, "select count(*), coalesce(sum(sum), 0) from withdrawals where "+filter, args...).
+		Scan(&page.Total, &page.Sum)
+	if err != nil {
+		return page, errors.Wrap(err, "Count withdrawals error")
+	}
+
+	cmp, dir := ">", "asc"
+	if query.Desc {
+		cmp, dir = "<", "desc"
+	}
+	if query.After != nil {
+		filter += " and (processed_at, w_id) " + cmp + " (" + arg(query.After.Date) + ", " + arg(query.After.ID) + ")"
+	}
+	limit := ""
+	if query.Limit > 0 {
+		limit = " limit " + arg(query.Limit+1)
+	}
+	rows, err := db.DB.Query(ctx, `select w_id, "order", sum, processed_at from withdrawals where `+filter+
+		" order by processed_at "+dir+", w_id "+dir+limit, args...)
+	if err != nil {
+		return page, errors.Wrap(err, "List withdrawals error")
+	}
+	defer rows.Close()
+	var last models.PageCursor
+	for rows.Next() {
+		if query.Limit > 0 && len(page.Withdrawals) == query.Limit {
+			page.Next = &models.PageCursor{Date: last.Date, ID: last.ID}
+			break
+		}
+		var withdraw models.WithdrawInfo
+		if err := rows.Scan(&last.ID, &withdraw.Order, &withdraw.Sum, &last.Date); err != nil {
+			return page, errors.Wrap(err, "Parsing withdrawls info error")
+		}
+		withdraw.Order = strings.TrimSpace(withdraw.Order)
+		withdraw.ProcessedAt = last.Date.Format(time.RFC3339)
+		page.Withdrawals = append(page.Withdrawals, withdraw)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+	return page, nil
+}
+
+func (m *MemStorage) ListWithdrawals(ctx context.Context, userID int, query models.WithdrawalQuery) (models.WithdrawalPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var page models.WithdrawalPage
+	var matched []memWithdrawal
+	for _, w := range m.withdrawals {
+		if w.uid != userID ||
+			(!query.From.IsZero() && w.processedAt.Before(query.From)) ||
+			(!query.To.IsZero() && !w.processedAt.Before(query.To)) {
+			continue
+		}
+		matched = append(matched, w)
+		page.Total++
+		page.Sum += w.sum
+	}
+	less := func(date time.Time, id int64, other time.Time, otherID int64) bool {
+		return date.Before(other) || (date.Equal(other) && id < otherID)
+	}
+	sort.Slice(matched, func(i, k int) bool {
+		if query.Desc {
+			i, k = k, i
+		}
+		return less(matched[i].processedAt, matched[i].id, matched[k].processedAt, matched[k].id)
+	})
+	if query.After != nil {
+		rest := matched[:0]
+		for _, w := range matched {
+			if (!query.Desc && less(query.After.Date, query.After.ID, w.processedAt, w.id)) ||
+				(query.Desc && less(w.processedAt, w.id, query.After.Date, query.After.ID)) {
+				rest = append(rest, w)
+			}
+		}
+		matched = rest
+	}
+	if query.Limit > 0 && len(matched) > query.Limit {
+		last := matched[query.Limit-1]
+		page.Next = &models.PageCursor{Date: last.processedAt, ID: last.id}
+		matched = matched[:query.Limit]
+	}
+	for _, w := range matched {
+		page.Withdrawals = append(page.Withdrawals, models.WithdrawInfo{
+			Order:       w.order,
+			Sum:         w.sum,
+			ProcessedAt: w.processedAt.Format(time.RFC3339),
+		})
+	}
+	return page, nil
+}
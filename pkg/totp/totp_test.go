@@ -0,0 +1,72 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Секрет "12345678901234567890" из RFC 6238, ожидаемые коды - младшие 6 цифр из приложения B.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+	}
+	for _, tt := range tests {
+		code, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		require.NoError(t, err)
+		assert.Equal(t, tt.code, code, "time %d", tt.unix)
+	}
+
+	_, err := Code("not base32!", time.Now())
+	assert.ErrorIs(t, err, ErrInvalidSecret)
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, err := Code(rfcSecret, now.Add(-Period*time.Second))
+	require.NoError(t, err)
+
+	step, ok := Verify(rfcSecret, code, now, 1)
+	assert.True(t, ok, "previous step is accepted with skew 1")
+	assert.Equal(t, Step(now)-1, step)
+
+	_, ok = Verify(rfcSecret, code, now, 0)
+	assert.False(t, ok)
+	_, ok = Verify(rfcSecret, "12345", now, 1)
+	assert.False(t, ok)
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	require.NoError(t, err)
+	other, err := GenerateSecret()
+	require.NoError(t, err)
+	assert.NotEqual(t, secret, other)
+
+	code, err := Code(secret, time.Now())
+	require.NoError(t, err)
+	_, ok := Verify(secret, code, time.Now(), 1)
+	assert.True(t, ok)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(ProvisioningURI("Gophermart", "user@example.com", rfcSecret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Gophermart:user@example.com", uri.Path)
+	assert.Equal(t, rfcSecret, uri.Query().Get("secret"))
+	assert.Equal(t, "Gophermart", uri.Query().Get("issuer"))
+}